@@ -1,10 +1,13 @@
 package conf
 
 import (
+	"errors"
 	"fmt"
 	"os"
-
-	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 )
 
 const (
@@ -12,8 +15,33 @@ const (
 	defaultStorageType = "boltdb"
 	// boldtb
 	defaultBotlDBPath = "/home/vaultmanager/data/bolt.db"
+	// file
+	defaultFileStorePath = "/home/vaultmanager/data/store"
+	// backup
+	defaultBackupInterval   = 24 * time.Hour
+	defaultBackupKeep       = 7
+	defaultBackupEncryption = "rsa"
 	// kubernetes
 	defaultAccessKeysMode = "in-cluster"
+	// identity
+	defaultGroupType = "internal"
+	// secrets
+	defaultUpdatePolicy = "create_only"
+	// approle export
+	defaultRotationThreshold = 0.5
+	defaultGracePeriod       = 10 * time.Minute
+	// secret export
+	defaultExportSecretType  = "Opaque"
+	defaultExporter          = "kubernetes"
+	defaultFileExportFormat  = "files"
+	managedByLabel           = "app.kubernetes.io/managed-by"
+	reservedAnnotationPrefix = "vault-unlocker/"
+	// discovery
+	defaultDiscoveryPort           = 8200
+	defaultDiscoveryScheme         = "http"
+	defaultDiscoveryResyncInterval = 30 * time.Second
+	// custom resources
+	defaultResourcesResyncInterval = 5 * time.Minute
 	// vault
 	defaultAccessKeysNumber = 3
 	defaultVaultUrl         = "http://localhost:8200"
@@ -21,22 +49,100 @@ const (
 	defaultEncryptionPath = "/home/vaultmanager/data/encryption/"
 )
 
+// Allowed values of the enum settings, checked by UnmarshalYAML and listed
+// by the schema.
+var (
+	storageTypes      = []string{"boltdb", "file", "kubernetes"}
+	backupEncryptions = []string{"passphrase", "rsa"}
+	accessModes       = []string{"in-cluster", "out-cluster"}
+	discoverySchemes  = []string{"http", "https"}
+	fileExportFormats = []string{"files", "env", "template"}
+	groupTypes        = []string{"internal", "external"}
+	updatePolicies    = []string{"create_only", "merge_missing_keys", "overwrite", "rotate"}
+	exportSecretTypes = []string{"Opaque", "kubernetes.io/basic-auth", "kubernetes.io/dockerconfigjson"}
+)
+
+// choices formats allowed values for error messages.
+func choices(values []string) string {
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
 type config struct {
 	Provisioner *Provisioner `yaml:"provisioner"`
 	Unlocker    *Unlocker    `yaml:"unlocker"`
 	Encryption  *Encryption  `yaml:"encryption"`
 	Exporter    *Exporter    `yaml:"exporter"`
 	Storage     *Storage     `yaml:"storage"`
+	Resources   *Resources   `yaml:"resources"`
+	Metrics     *Metrics     `yaml:"metrics"`
 }
 
 type Exporter struct {
-	Kubernetes *Kubernetes `yaml:"kubernetes"`
+	Kubernetes *Kubernetes    `yaml:"kubernetes"`
+	Clusters   []Cluster      `yaml:"clusters"`
+	Files      []FileExporter `yaml:"files"`
+}
+
+// Cluster is an additional kubernetes exporter, exports select it by name.
+type Cluster struct {
+	Name       string     `yaml:"name"`
+	Kubernetes Kubernetes `yaml:",inline"`
+}
+
+// FileExporter writes exports below Path for hosts without kubernetes, the
+// format is files (one file per key), env or template.
+type FileExporter struct {
+	Name     string `yaml:"name"`
+	Format   string `yaml:"format"`
+	Path     string `yaml:"path"`
+	Template string `yaml:"template"`
 }
 
 type Provisioner struct {
-	Auth     []Auth   `yaml:"auth"`
-	Mount    []Mount  `yaml:"mounts"`
-	Policies []Policy `yaml:"policies"`
+	Auth       []Auth      `yaml:"auth"`
+	Mount      []Mount     `yaml:"mounts"`
+	Policies   []Policy    `yaml:"policies"`
+	Identity   *Identity   `yaml:"identity"`
+	Namespaces []Namespace `yaml:"namespaces"`
+}
+
+// Namespace holds the desired state of a vault namespace (Enterprise /
+// OpenBao). Path is relative to the parent namespace, children are nested
+// through the embedded provisioner.
+type Namespace struct {
+	Path        string      `yaml:"path"`
+	Provisioner Provisioner `yaml:",inline"`
+}
+
+type Identity struct {
+	Entities []Entity `yaml:"entities"`
+	Groups   []Group  `yaml:"groups"`
+}
+
+type Entity struct {
+	Name     string            `yaml:"name"`
+	Policies []string          `yaml:"policies"`
+	Metadata map[string]string `yaml:"metadata"`
+	Disabled bool              `yaml:"disabled"`
+	Aliases  []IdentityAlias   `yaml:"aliases"`
+}
+
+type Group struct {
+	Name           string            `yaml:"name"`
+	Type           string            `yaml:"type"`
+	Policies       []string          `yaml:"policies"`
+	Metadata       map[string]string `yaml:"metadata"`
+	MemberEntities []string          `yaml:"member_entities"`
+	MemberGroups   []string          `yaml:"member_groups"`
+	Alias          *IdentityAlias    `yaml:"alias"`
+}
+
+// IdentityAlias binds an entity or an external group to a name known by an
+// auth mount. Mount is the auth path as configured in provisioner.auth, the
+// accessor is looked up at reconcile time.
+type IdentityAlias struct {
+	Name  string `yaml:"name"`
+	Mount string `yaml:"mount"`
 }
 
 type Auth struct {
@@ -47,42 +153,132 @@ type Auth struct {
 }
 
 type User struct {
-	Name     string   `yaml:"name"`
-	Pass     string   `yaml:"pass"`
-	Policies []string `yaml:"policies"`
+	Name     string        `yaml:"name"`
+	Pass     string        `yaml:"pass"`
+	Policies []string      `yaml:"policies"`
+	Export   *SecretExport `yaml:"export"`
 }
 
 type AppRole struct {
-	Name        string   `yaml:"name"`
-	PolicyNames []string `yaml:"policies"`
-	SecretIdTTL int      `yaml:"secret_id_ttl"`
-	TokenTTL    int      `yaml:"token_ttl"`
-	TokenMaxTTL int      `yaml:"token_max_ttl"`
-	Export      *struct {
-		Namespace string `yaml:"namespace"`
-	} `yaml:"export"`
+	Name        string         `yaml:"name"`
+	PolicyNames []string       `yaml:"policies"`
+	SecretIdTTL int            `yaml:"secret_id_ttl"`
+	TokenTTL    int            `yaml:"token_ttl"`
+	TokenMaxTTL int            `yaml:"token_max_ttl"`
+	Export      *AppRoleExport `yaml:"export"`
 }
 
+// AppRoleExport publishes role_id and secret_id to a kubernetes secret. The
+// secret-id is rotated once RotationThreshold of secret_id_ttl has elapsed,
+// superseded ones are destroyed after GracePeriod. With WrapTTL set only a
+// response-wrapping token of the secret-id is exported.
+type AppRoleExport struct {
+	Namespace         string         `yaml:"namespace"`
+	RotationThreshold float64        `yaml:"rotation_threshold"`
+	GracePeriod       time.Duration  `yaml:"grace_period"`
+	WrapTTL           time.Duration  `yaml:"wrap_ttl"`
+	Metadata          ExportMetadata `yaml:",inline"`
+}
+
+// ExportMetadata is added to an exported kubernetes secret. Force takes over
+// secrets that were not created by the unlocker.
+type ExportMetadata struct {
+	Exporter    string            `yaml:"exporter"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+	Force       bool              `yaml:"force"`
+}
+
+// Policy is given inline through Rules, read from File (.hcl or .json) or
+// read from every file of Dir, named after the file. ${var.NAME} references
+// in the rules are replaced by Vars.
 type Policy struct {
-	Name  string `yaml:"name"`
-	Rules string `yaml:"rules"`
+	Name  string            `yaml:"name"`
+	Rules string            `yaml:"rules"`
+	File  string            `yaml:"file"`
+	Dir   string            `yaml:"dir"`
+	Vars  map[string]string `yaml:"vars"`
+	// entry is the index of the config entry a dir policy comes from
+	entry int
 }
 
 type Mount struct {
-	Type    string    `yaml:"type"`
-	Path    string    `yaml:"path"`
-	Secrets []Secrets `yaml:"secrets"`
+	Type         string        `yaml:"type"`
+	Path         string        `yaml:"path"`
+	Secrets      []Secrets     `yaml:"secrets"`
+	Certificates []Certificate `yaml:"certificates"`
+}
+
+// Certificate is issued from a role of a pki mount and exported as a
+// kubernetes.io/tls secret. It is renewed RenewBefore its expiry, or once two
+// thirds of its lifetime elapsed when RenewBefore is not set.
+type Certificate struct {
+	Role        string             `yaml:"role"`
+	CommonName  string             `yaml:"common_name"`
+	AltNames    []string           `yaml:"alt_names"`
+	IPSans      []string           `yaml:"ip_sans"`
+	TTL         time.Duration      `yaml:"ttl"`
+	RenewBefore time.Duration      `yaml:"renew_before"`
+	Export      *CertificateExport `yaml:"export"`
+}
+
+type CertificateExport struct {
+	Namespace string         `yaml:"namespace"`
+	Name      string         `yaml:"name"`
+	Metadata  ExportMetadata `yaml:",inline"`
 }
 
 type Secrets struct {
-	Path string                 `yaml:"path"`
-	Name string                 `yaml:"name"`
-	Data map[string]interface{} `yaml:"data"`
+	Path           string                 `yaml:"path"`
+	Name           string                 `yaml:"name"`
+	Data           map[string]interface{} `yaml:"data"`
+	UpdatePolicy   string                 `yaml:"update_policy"`
+	RotationPeriod time.Duration          `yaml:"rotation_period"`
+	Export         *SecretExport          `yaml:"export"`
+}
+
+// SecretExport syncs userpass credentials or kv secret data to a kubernetes
+// secret. Name defaults to the user or secret name, Keys renames data keys
+// (source: target) and dockerconfigjson secrets are built from the username
+// and password keys for Registry.
+type SecretExport struct {
+	Namespace string            `yaml:"namespace"`
+	Name      string            `yaml:"name"`
+	Type      string            `yaml:"type"`
+	Keys      map[string]string `yaml:"keys"`
+	Registry  string            `yaml:"registry"`
+	Metadata  ExportMetadata    `yaml:",inline"`
 }
 
 type Unlocker struct {
-	NumberKeys int    `yaml:"number_keys"`
-	Url        string `yaml:"url"`
+	NumberKeys int        `yaml:"number_keys"`
+	Url        string     `yaml:"url"`
+	Discovery  *Discovery `yaml:"discovery"`
+}
+
+// Discovery is the operator mode: every running pod matching LabelSelector is
+// unsealed through its pod IP as soon as it starts, and re-checked every
+// ResyncInterval.
+type Discovery struct {
+	Namespace      string        `yaml:"namespace"`
+	LabelSelector  string        `yaml:"label_selector"`
+	Port           int           `yaml:"port"`
+	Scheme         string        `yaml:"scheme"`
+	TLSSkipVerify  bool          `yaml:"tls_skip_verify"`
+	ResyncInterval time.Duration `yaml:"resync_interval"`
+}
+
+// Resources enables provisioning from VaultPolicy, VaultAuthMount,
+// VaultAppRole and VaultKVSecret custom resources in Namespaces (all when
+// empty). Every resource is reconciled again each ResyncInterval.
+type Resources struct {
+	Namespaces     []string      `yaml:"namespaces"`
+	ResyncInterval time.Duration `yaml:"resync_interval"`
+}
+
+// Metrics serves prometheus metrics on Address, it is read once at startup.
+type Metrics struct {
+	Address string `yaml:"address"`
 }
 
 type Encryption struct {
@@ -90,12 +286,41 @@ type Encryption struct {
 }
 
 type Storage struct {
-	StorageType string  `yaml:"type"`
-	BoltDB      *BoltBD `yaml:"boltdb"`
+	StorageType string     `yaml:"type"`
+	BoltDB      *BoltBD    `yaml:"boltdb"`
+	File        *FileStore `yaml:"file"`
+	Backup      *Backup    `yaml:"backup"`
+}
+
+// FileStore keeps one file per key under Path. Encrypt seals every value
+// with a data key wrapped by the encryption key pair.
+type FileStore struct {
+	Path    string `yaml:"path"`
+	Encrypt bool   `yaml:"encrypt"`
 }
 
+// Backup writes an encrypted archive of the storage to Path every Interval
+// and keeps the Keep most recent ones. rsa archives are encrypted with the
+// encryption key pair, passphrase archives with Passphrase.
+type Backup struct {
+	Path       string        `yaml:"path"`
+	Interval   time.Duration `yaml:"interval"`
+	Keep       int           `yaml:"keep"`
+	Encryption string        `yaml:"encryption"`
+	Passphrase string        `yaml:"passphrase"`
+}
+
+// Kubernetes selects how the cluster is reached. out-cluster reads the
+// kubeconfig (default ~/.kube/config) and its current context unless Context
+// is set, or connects to Host directly with Token and CA (a PEM file path or
+// inline PEM).
 type Kubernetes struct {
-	Access string `yaml:"access"`
+	Access     string `yaml:"access"`
+	Kubeconfig string `yaml:"kubeconfig"`
+	Context    string `yaml:"context"`
+	Host       string `yaml:"host"`
+	Token      string `yaml:"token"`
+	CA         string `yaml:"ca"`
 }
 
 type BoltBD struct {
@@ -103,14 +328,13 @@ type BoltBD struct {
 	Buckets []string
 }
 
+// NewConfig decodes content strictly: unknown keys, invalid values and
+// semantic errors are all reported, see Validate.
 func NewConfig(content []byte) (*config, error) {
+	return NewConfigFromFiles([]File{{Content: content}})
+}
 
-	c := &config{}
-	err := yaml.Unmarshal(content, c)
-	if err != nil {
-		return nil, err
-	}
-
+func (c *config) withDefaults() *config {
 	if c.Unlocker == nil {
 		c.Unlocker = getDefaultUnlocker()
 	}
@@ -123,8 +347,13 @@ func NewConfig(content []byte) (*config, error) {
 		c.Encryption = getDefaultEncryption()
 	}
 
-	return c, nil
+	// discovery and custom resources talk to the cluster through the
+	// kubernetes exporter client
+	if c.Exporter == nil && (c.Unlocker.Discovery != nil || c.Resources != nil) {
+		c.Exporter = &Exporter{Kubernetes: getDefaultKubernetes()}
+	}
 
+	return c
 }
 
 func (c *config) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -135,6 +364,518 @@ func (c *config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if c.Provisioner == nil {
+		return nil
+	}
+
+	exporters := map[string]bool{defaultExporter: true}
+	if c.Exporter != nil {
+		for _, cluster := range c.Exporter.Clusters {
+			exporters[cluster.Name] = true
+		}
+		for _, f := range c.Exporter.Files {
+			exporters[f.Name] = true
+		}
+	}
+
+	for _, name := range c.Provisioner.exporterNames() {
+		if !exporters[name] {
+			return fmt.Errorf("export references unknown exporter: %s", name)
+		}
+	}
+
+	return nil
+}
+
+func (p *Provisioner) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*p = Provisioner{}
+	type plain Provisioner
+	err := unmarshal((*plain)(p))
+	if err != nil {
+		return err
+	}
+
+	return p.validate()
+}
+
+// exporterNames lists the exporters used by every export block, child
+// namespaces included.
+func (p *Provisioner) exporterNames() []string {
+	var names []string
+	for _, auth := range p.Auth {
+		for _, role := range auth.AppRoles {
+			if role.Export != nil {
+				names = append(names, role.Export.Metadata.Exporter)
+			}
+		}
+		for _, user := range auth.Users {
+			if user.Export != nil {
+				names = append(names, user.Export.Metadata.Exporter)
+			}
+		}
+	}
+
+	for _, mount := range p.Mount {
+		for _, secret := range mount.Secrets {
+			if secret.Export != nil {
+				names = append(names, secret.Export.Metadata.Exporter)
+			}
+		}
+		for _, cert := range mount.Certificates {
+			names = append(names, cert.Export.Metadata.Exporter)
+		}
+	}
+
+	for _, ns := range p.Namespaces {
+		names = append(names, ns.Provisioner.exporterNames()...)
+	}
+
+	return names
+}
+
+func (p *Provisioner) validate() error {
+	namespaces := map[string]bool{}
+	for _, ns := range p.Namespaces {
+		if namespaces[ns.Path] {
+			return fmt.Errorf("duplicated namespace: %s", ns.Path)
+		}
+		namespaces[ns.Path] = true
+	}
+
+	if p.Identity == nil {
+		return nil
+	}
+
+	authPaths := map[string]bool{}
+	for _, auth := range p.Auth {
+		authPaths[strings.Trim(auth.Path, "/")] = true
+	}
+
+	for _, entity := range p.Identity.Entities {
+		for _, alias := range entity.Aliases {
+			if !authPaths[strings.Trim(alias.Mount, "/")] {
+				return fmt.Errorf("identity entity %s: alias %s references unknown auth mount: %s", entity.Name, alias.Name, alias.Mount)
+			}
+		}
+	}
+
+	for _, group := range p.Identity.Groups {
+		if group.Alias != nil && !authPaths[strings.Trim(group.Alias.Mount, "/")] {
+			return fmt.Errorf("identity group %s: alias %s references unknown auth mount: %s", group.Name, group.Alias.Name, group.Alias.Mount)
+		}
+	}
+
+	return nil
+}
+
+func (n *Namespace) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*n = Namespace{}
+	type plain Namespace
+	err := unmarshal((*plain)(n))
+	if err != nil {
+		return err
+	}
+
+	n.Path = strings.Trim(n.Path, "/")
+	if n.Path == "" {
+		return errors.New("namespace path is required")
+	}
+
+	if strings.Contains(n.Path, "/") {
+		return fmt.Errorf("namespace path must be a single segment, nest namespaces instead. path=%v", n.Path)
+	}
+
+	// inlined fields bypass Provisioner.UnmarshalYAML
+	if err := n.Provisioner.validate(); err != nil {
+		return fmt.Errorf("namespace %s: %w", n.Path, err)
+	}
+
+	return nil
+}
+
+func (i *Identity) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*i = Identity{}
+	type plain Identity
+	err := unmarshal((*plain)(i))
+	if err != nil {
+		return err
+	}
+
+	entities := map[string]bool{}
+	for _, entity := range i.Entities {
+		if entities[entity.Name] {
+			return fmt.Errorf("duplicated identity entity: %s", entity.Name)
+		}
+		entities[entity.Name] = true
+	}
+
+	groups := map[string]bool{}
+	for _, group := range i.Groups {
+		if groups[group.Name] {
+			return fmt.Errorf("duplicated identity group: %s", group.Name)
+		}
+		groups[group.Name] = true
+	}
+
+	for _, group := range i.Groups {
+		for _, member := range group.MemberEntities {
+			if !entities[member] {
+				return fmt.Errorf("identity group %s: unknown member entity: %s", group.Name, member)
+			}
+		}
+		for _, member := range group.MemberGroups {
+			if !groups[member] {
+				return fmt.Errorf("identity group %s: unknown member group: %s", group.Name, member)
+			}
+		}
+	}
+
+	_, err = SortGroups(i.Groups)
+	return err
+}
+
+// SortGroups orders groups so that member groups always come before the
+// groups that contain them, vault needs their ids when writing the parent.
+// Groups that are, directly or through other groups, members of themselves
+// are rejected: vault would accept them but a group can't be written before
+// the ids of its member groups are known.
+func SortGroups(groups []Group) ([]Group, error) {
+	byName := map[string]Group{}
+	for _, group := range groups {
+		byName[group.Name] = group
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	sorted := make([]Group, 0, len(groups))
+
+	var visit func(name string, chain []string) error
+	visit = func(name string, chain []string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("group membership cycle: %s", strings.Join(append(chain, name), " -> "))
+		}
+
+		group, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown group: %s", name)
+		}
+
+		state[name] = visiting
+		for _, member := range group.MemberGroups {
+			if err := visit(member, append(chain, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		sorted = append(sorted, group)
+		return nil
+	}
+
+	for _, group := range groups {
+		if err := visit(group.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+func (e *Entity) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*e = Entity{}
+	type plain Entity
+	err := unmarshal((*plain)(e))
+	if err != nil {
+		return err
+	}
+
+	if e.Name == "" {
+		return errors.New("identity entity name is required")
+	}
+
+	return nil
+}
+
+func (g *Group) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*g = Group{}
+	type plain Group
+	err := unmarshal((*plain)(g))
+	if err != nil {
+		return err
+	}
+
+	if g.Name == "" {
+		return errors.New("identity group name is required")
+	}
+
+	if g.Type == "" {
+		g.Type = defaultGroupType
+	}
+
+	if !slices.Contains(groupTypes, g.Type) {
+		return fmt.Errorf("identity group %s: invalid type, choose one of %s. option=%v", g.Name, choices(groupTypes), g.Type)
+	}
+
+	if g.Type == "external" && (len(g.MemberEntities) > 0 || len(g.MemberGroups) > 0) {
+		return fmt.Errorf("identity group %s: external groups can not have explicit members", g.Name)
+	}
+
+	if g.Type == "internal" && g.Alias != nil {
+		return fmt.Errorf("identity group %s: only external groups can have an alias", g.Name)
+	}
+
+	return nil
+}
+
+func (a *IdentityAlias) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*a = IdentityAlias{}
+	type plain IdentityAlias
+	err := unmarshal((*plain)(a))
+	if err != nil {
+		return err
+	}
+
+	if a.Name == "" || a.Mount == "" {
+		return fmt.Errorf("identity alias requires name and mount. name=%v mount=%v", a.Name, a.Mount)
+	}
+
+	return nil
+}
+
+func (p *Policy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*p = Policy{}
+	type plain Policy
+	err := unmarshal((*plain)(p))
+	if err != nil {
+		return err
+	}
+
+	sources := 0
+	for _, source := range []string{p.Rules, p.File, p.Dir} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("policy %s: set exactly one of rules, file or dir", p.Name)
+	}
+
+	if p.Rules != "" && p.Name == "" {
+		return errors.New("policy name is required")
+	}
+
+	if p.Dir != "" && p.Name != "" {
+		return fmt.Errorf("policy %s: dir policies are named after their files", p.Name)
+	}
+
+	return nil
+}
+
+func (m *Mount) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = Mount{}
+	type plain Mount
+	err := unmarshal((*plain)(m))
+	if err != nil {
+		return err
+	}
+
+	if len(m.Certificates) > 0 && m.Type != "pki" {
+		return fmt.Errorf("mount %s: certificates are only supported on pki mounts", m.Path)
+	}
+
+	if len(m.Secrets) > 0 && m.Type == "pki" {
+		return fmt.Errorf("mount %s: secrets are not supported on pki mounts", m.Path)
+	}
+
+	exports := map[string]bool{}
+	for _, cert := range m.Certificates {
+		target := cert.Export.Namespace + "/" + cert.Export.Name
+		if exports[target] {
+			return fmt.Errorf("mount %s: duplicated certificate export: %s", m.Path, target)
+		}
+		exports[target] = true
+	}
+
+	return nil
+}
+
+func (c *Certificate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = Certificate{}
+	type plain Certificate
+	err := unmarshal((*plain)(c))
+	if err != nil {
+		return err
+	}
+
+	if c.Role == "" {
+		return fmt.Errorf("certificate role is required")
+	}
+
+	if c.CommonName == "" {
+		return fmt.Errorf("certificate %s: common_name is required", c.Role)
+	}
+
+	if c.Export == nil || c.Export.Name == "" {
+		return fmt.Errorf("certificate %s: export name is required", c.CommonName)
+	}
+
+	if err := c.Export.Metadata.validate(); err != nil {
+		return fmt.Errorf("certificate %s: %w", c.CommonName, err)
+	}
+
+	if c.Export.Namespace == "" && c.Export.Metadata.Exporter == defaultExporter {
+		return fmt.Errorf("certificate %s: export namespace is required", c.CommonName)
+	}
+
+	if c.TTL < 0 || c.RenewBefore < 0 {
+		return fmt.Errorf("certificate %s: ttl and renew_before can not be negative", c.CommonName)
+	}
+
+	if c.TTL > 0 && c.RenewBefore >= c.TTL {
+		return fmt.Errorf("certificate %s: renew_before must be shorter than ttl", c.CommonName)
+	}
+
+	return nil
+}
+
+func (s *Secrets) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = Secrets{}
+	type plain Secrets
+	err := unmarshal((*plain)(s))
+	if err != nil {
+		return err
+	}
+
+	if err := validateGenerators(s.Data); err != nil {
+		return fmt.Errorf("secret %s/%s: %w", s.Path, s.Name, err)
+	}
+
+	if s.UpdatePolicy == "" {
+		s.UpdatePolicy = defaultUpdatePolicy
+	}
+
+	if !slices.Contains(updatePolicies, s.UpdatePolicy) {
+		return fmt.Errorf("secret %s/%s: invalid update_policy, choose one of %s. option=%v", s.Path, s.Name, choices(updatePolicies), s.UpdatePolicy)
+	}
+
+	if s.UpdatePolicy == "rotate" && s.RotationPeriod <= 0 {
+		return fmt.Errorf("secret %s/%s: update_policy rotate requires a positive rotation_period", s.Path, s.Name)
+	}
+
+	if s.UpdatePolicy != "rotate" && s.RotationPeriod != 0 {
+		return fmt.Errorf("secret %s/%s: rotation_period requires update_policy rotate", s.Path, s.Name)
+	}
+
+	return nil
+}
+
+func (e *AppRoleExport) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*e = AppRoleExport{}
+	type plain AppRoleExport
+	err := unmarshal((*plain)(e))
+	if err != nil {
+		return err
+	}
+
+	if e.RotationThreshold == 0 {
+		e.RotationThreshold = defaultRotationThreshold
+	}
+
+	if e.RotationThreshold < 0 || e.RotationThreshold > 1 {
+		return fmt.Errorf("invalid approle export rotation_threshold, must be between 0 and 1: %v", e.RotationThreshold)
+	}
+
+	if e.GracePeriod == 0 {
+		e.GracePeriod = defaultGracePeriod
+	}
+
+	if e.GracePeriod < 0 {
+		return fmt.Errorf("invalid approle export grace_period: %v", e.GracePeriod)
+	}
+
+	if e.WrapTTL < 0 || (e.WrapTTL > 0 && e.WrapTTL < time.Second) {
+		return fmt.Errorf("invalid approle export wrap_ttl, must be at least 1s: %v", e.WrapTTL)
+	}
+
+	if err := e.Metadata.validate(); err != nil {
+		return fmt.Errorf("approle export: %w", err)
+	}
+
+	if e.Namespace == "" && e.Metadata.Exporter == defaultExporter {
+		return fmt.Errorf("approle export namespace is required")
+	}
+
+	return nil
+}
+
+func (e *SecretExport) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*e = SecretExport{}
+	type plain SecretExport
+	err := unmarshal((*plain)(e))
+	if err != nil {
+		return err
+	}
+
+	if err := e.Metadata.validate(); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	if e.Namespace == "" && e.Metadata.Exporter == defaultExporter {
+		return fmt.Errorf("export namespace is required")
+	}
+
+	if e.Type == "" {
+		e.Type = defaultExportSecretType
+	}
+
+	if !slices.Contains(exportSecretTypes, e.Type) {
+		return fmt.Errorf("invalid export type, must be one of %s: %s", choices(exportSecretTypes), e.Type)
+	}
+
+	if e.Type == "kubernetes.io/dockerconfigjson" && e.Registry == "" {
+		return fmt.Errorf("export type kubernetes.io/dockerconfigjson requires a registry")
+	}
+
+	if e.Type != "kubernetes.io/dockerconfigjson" && e.Registry != "" {
+		return fmt.Errorf("export registry is only supported for type kubernetes.io/dockerconfigjson")
+	}
+
+	targets := map[string]bool{}
+	for source, target := range e.Keys {
+		if target == "" {
+			return fmt.Errorf("export key %s: target name is required", source)
+		}
+		if targets[target] {
+			return fmt.Errorf("export key %s: duplicated target name: %s", source, target)
+		}
+		targets[target] = true
+	}
+
+	return nil
+}
+
+// validate defaults the exporter and keeps the managed-by label and the
+// vault-unlocker/ annotations for the unlocker itself.
+func (m *ExportMetadata) validate() error {
+	if m.Exporter == "" {
+		m.Exporter = defaultExporter
+	}
+
+	if _, ok := m.Labels[managedByLabel]; ok {
+		return fmt.Errorf("label %s is reserved", managedByLabel)
+	}
+
+	for k := range m.Annotations {
+		if strings.HasPrefix(k, reservedAnnotationPrefix) {
+			return fmt.Errorf("annotation %s is reserved", k)
+		}
+	}
+
 	return nil
 }
 
@@ -161,6 +902,90 @@ func (u *Unlocker) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func (d *Discovery) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*d = Discovery{}
+	type plain Discovery
+	err := unmarshal((*plain)(d))
+	if err != nil {
+		return err
+	}
+
+	if d.LabelSelector == "" {
+		return fmt.Errorf("discovery label_selector is required")
+	}
+
+	if d.Port == 0 {
+		d.Port = defaultDiscoveryPort
+	}
+
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("invalid discovery port: %d", d.Port)
+	}
+
+	if d.Scheme == "" {
+		d.Scheme = defaultDiscoveryScheme
+	}
+
+	if !slices.Contains(discoverySchemes, d.Scheme) {
+		return fmt.Errorf("discovery scheme invalid, choose one of %s. option=%v", choices(discoverySchemes), d.Scheme)
+	}
+
+	if d.ResyncInterval == 0 {
+		d.ResyncInterval = defaultDiscoveryResyncInterval
+	}
+
+	if d.ResyncInterval < time.Second {
+		return fmt.Errorf("invalid discovery resync_interval, must be at least 1s: %v", d.ResyncInterval)
+	}
+
+	return nil
+}
+
+func (r *Resources) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*r = Resources{}
+	type plain Resources
+	err := unmarshal((*plain)(r))
+	if err != nil {
+		return err
+	}
+
+	if r.ResyncInterval == 0 {
+		r.ResyncInterval = defaultResourcesResyncInterval
+	}
+
+	if r.ResyncInterval < time.Second {
+		return fmt.Errorf("invalid resources resync_interval, must be at least 1s: %v", r.ResyncInterval)
+	}
+
+	seen := map[string]bool{}
+	for _, ns := range r.Namespaces {
+		if ns == "" {
+			return fmt.Errorf("resources namespace can not be empty")
+		}
+		if seen[ns] {
+			return fmt.Errorf("duplicated resources namespace: %s", ns)
+		}
+		seen[ns] = true
+	}
+
+	return nil
+}
+
+func (m *Metrics) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = Metrics{}
+	type plain Metrics
+	err := unmarshal((*plain)(m))
+	if err != nil {
+		return err
+	}
+
+	if m.Address == "" {
+		return fmt.Errorf("metrics address is required")
+	}
+
+	return nil
+}
+
 func (e *Encryption) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	*e = Encryption{}
 	type plain Encryption
@@ -188,6 +1013,55 @@ func (s *Exporter) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		s.Kubernetes = getDefaultKubernetes()
 	}
 
+	names := map[string]bool{defaultExporter: true}
+	for _, c := range s.Clusters {
+		if names[c.Name] {
+			return fmt.Errorf("duplicated exporter name: %s", c.Name)
+		}
+		names[c.Name] = true
+	}
+	for _, f := range s.Files {
+		if names[f.Name] {
+			return fmt.Errorf("duplicated exporter name: %s", f.Name)
+		}
+		names[f.Name] = true
+	}
+
+	return nil
+}
+
+func (f *FileExporter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*f = FileExporter{}
+	type plain FileExporter
+	err := unmarshal((*plain)(f))
+	if err != nil {
+		return err
+	}
+
+	if f.Name == "" {
+		return fmt.Errorf("file exporter name is required")
+	}
+
+	if f.Path == "" {
+		return fmt.Errorf("file exporter %s: path is required", f.Name)
+	}
+
+	if f.Format == "" {
+		f.Format = defaultFileExportFormat
+	}
+
+	if !slices.Contains(fileExportFormats, f.Format) {
+		return fmt.Errorf("file exporter %s: invalid format, choose one of %s. format=%v", f.Name, choices(fileExportFormats), f.Format)
+	}
+
+	if f.Format == "template" && f.Template == "" {
+		return fmt.Errorf("file exporter %s: format template requires a template file", f.Name)
+	}
+
+	if f.Format != "template" && f.Template != "" {
+		return fmt.Errorf("file exporter %s: template is only supported with format template", f.Name)
+	}
+
 	return nil
 }
 
@@ -207,8 +1081,16 @@ func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		s.StorageType = defaultStorageType
 	}
 
-	if s.StorageType != "kubernetes" && s.StorageType != "boltdb" {
-		return fmt.Errorf("invalid storage type :%s", s.StorageType)
+	if !slices.Contains(storageTypes, s.StorageType) {
+		return fmt.Errorf("invalid storage type, choose one of %s. type=%v", choices(storageTypes), s.StorageType)
+	}
+
+	if s.StorageType == "file" && s.File == nil {
+		s.File = getDefaultFileStore()
+	}
+
+	if s.StorageType != "file" && s.File != nil {
+		return fmt.Errorf("file settings require storage type file: %s", s.StorageType)
 	}
 
 	return nil
@@ -222,13 +1104,112 @@ func (k *Kubernetes) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	return k.validate()
+}
+
+func (k *Kubernetes) validate() error {
+	outCluster := k.Kubeconfig != "" || k.Context != "" || k.Host != ""
 	if k.Access == "" {
 		k.Access = defaultAccessKeysMode
-		return nil
+		if outCluster {
+			k.Access = "out-cluster"
+		}
+	}
+
+	if !slices.Contains(accessModes, k.Access) {
+		return fmt.Errorf("kubernetes configuration invalid, choose one of %s. option=%v", choices(accessModes), k.Access)
+	}
+
+	if k.Access == "in-cluster" && outCluster {
+		return fmt.Errorf("kubernetes configuration invalid, kubeconfig, context and host require access out-cluster")
+	}
+
+	if k.Host != "" && (k.Kubeconfig != "" || k.Context != "") {
+		return fmt.Errorf("kubernetes configuration invalid, host can not be combined with kubeconfig or context")
+	}
+
+	if k.Host == "" && (k.Token != "" || k.CA != "") {
+		return fmt.Errorf("kubernetes configuration invalid, token and ca require a host")
+	}
+
+	return nil
+}
+
+func (c *Cluster) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = Cluster{}
+	type plain Cluster
+	err := unmarshal((*plain)(c))
+	if err != nil {
+		return err
 	}
 
-	if k.Access != "in-cluster" && k.Access != "out-cluster" {
-		return fmt.Errorf("kubernetes configuration invalid, choose one of [in-cluster, out-cluster]. option=%v", k.Access)
+	if c.Name == "" {
+		return fmt.Errorf("cluster name is required")
+	}
+
+	if err := c.Kubernetes.validate(); err != nil {
+		return fmt.Errorf("cluster %s: %w", c.Name, err)
+	}
+
+	return nil
+}
+
+func (b *Backup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*b = Backup{Keep: defaultBackupKeep}
+	type plain Backup
+	err := unmarshal((*plain)(b))
+	if err != nil {
+		return err
+	}
+
+	if b.Path == "" {
+		return errors.New("backup path is required")
+	}
+
+	if b.Interval == 0 {
+		b.Interval = defaultBackupInterval
+	}
+
+	if b.Interval < time.Minute {
+		return fmt.Errorf("invalid backup interval, must be at least 1m: %v", b.Interval)
+	}
+
+	if b.Keep < 0 {
+		return fmt.Errorf("invalid backup keep, must be positive: %d", b.Keep)
+	}
+
+	if b.Encryption == "" {
+		b.Encryption = defaultBackupEncryption
+		if b.Passphrase != "" {
+			b.Encryption = "passphrase"
+		}
+	}
+
+	if !slices.Contains(backupEncryptions, b.Encryption) {
+		return fmt.Errorf("invalid backup encryption, choose one of %s. encryption=%v", choices(backupEncryptions), b.Encryption)
+	}
+
+	if b.Encryption == "passphrase" && b.Passphrase == "" {
+		return errors.New("backup encryption passphrase requires a passphrase")
+	}
+
+	if b.Encryption != "passphrase" && b.Passphrase != "" {
+		return errors.New("backup passphrase requires encryption passphrase")
+	}
+
+	return nil
+}
+
+func (f *FileStore) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*f = FileStore{}
+	type plain FileStore
+	err := unmarshal((*plain)(f))
+	if err != nil {
+		return err
+	}
+
+	if f.Path == "" {
+		f.Path = defaultFileStorePath
 	}
 
 	return nil
@@ -255,6 +1236,43 @@ func ReadFile(path string) ([]byte, error) {
 	return os.ReadFile(path)
 }
 
+// WriteFileAtomic never leaves a partially written file behind, readers see
+// either the old or the new content. The temporary file gets perm before any
+// data is written, and the directory is synced after the rename.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
 func getDefaultUnlocker() *Unlocker {
 	return &Unlocker{
 		NumberKeys: defaultAccessKeysNumber,
@@ -282,6 +1300,12 @@ func getDefaultBoltDB() *BoltBD {
 	}
 }
 
+func getDefaultFileStore() *FileStore {
+	return &FileStore{
+		Path: defaultFileStorePath,
+	}
+}
+
 func getDefaultEncryption() *Encryption {
 	return &Encryption{
 		Path: defaultEncryptionPath,
@@ -2,7 +2,10 @@ package conf_test
 
 import (
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 	"vault-unlocker/conf"
 
 	"github.com/stretchr/testify/assert"
@@ -132,35 +135,33 @@ storage:
 func TestKubernetesConfig(t *testing.T) {
 
 	scenarios := []struct {
-		data              []byte
-		expectedAccess    string
-		expectedNamespace string
+		data           []byte
+		expectedAccess string
 	}{
 		{
 			data: []byte(`
 storage:
   type: kubernetes
+exporter:
   kubernetes:
     access: in-cluster
-    namespace: my-namespace
 `),
-			expectedAccess:    "in-cluster",
-			expectedNamespace: "my-namespace",
+			expectedAccess: "in-cluster",
 		},
 
 		{
 			data: []byte(`
 storage:
   type: kubernetes
+exporter:
   kubernetes:
     access: out-cluster
 `),
-			expectedAccess:    "out-cluster",
-			expectedNamespace: "",
+			expectedAccess: "out-cluster",
 		},
 		{
 			data: []byte(`
-storage:
+exporter:
   kubernetes:
 `),
 			expectedAccess: "in-cluster",
@@ -168,9 +169,9 @@ storage:
 	}
 
 	for _, scenario := range scenarios {
-		_, err := conf.NewConfig(scenario.data)
+		c, err := conf.NewConfig(scenario.data)
 		assert.NoError(t, err)
-
+		assert.Equal(t, scenario.expectedAccess, c.Exporter.Kubernetes.Access)
 	}
 }
 
@@ -207,6 +208,57 @@ storage:
 	}
 }
 
+func TestFileStoreConfig(t *testing.T) {
+	cfg, err := conf.NewConfig([]byte("storage:\n  type: file\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, &conf.FileStore{Path: "/home/vaultmanager/data/store"}, cfg.Storage.File)
+
+	cfg, err = conf.NewConfig([]byte("storage:\n  type: file\n  file:\n    path: /data\n    encrypt: true\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, &conf.FileStore{Path: "/data", Encrypt: true}, cfg.Storage.File)
+
+	_, err = conf.NewConfig([]byte("storage:\n  file:\n    path: /data\n"))
+	assert.ErrorContains(t, err, "file settings require storage type file")
+}
+
+func TestBackupConfig(t *testing.T) {
+	cfg, err := conf.NewConfig([]byte(`
+storage:
+  backup:
+    path: /backups
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, &conf.Backup{Path: "/backups", Interval: 24 * time.Hour, Keep: 7, Encryption: "rsa"}, cfg.Storage.Backup)
+
+	cfg, err = conf.NewConfig([]byte(`
+storage:
+  backup:
+    path: /backups
+    interval: 1h
+    keep: 0
+    passphrase: secret
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, &conf.Backup{Path: "/backups", Interval: time.Hour, Keep: 0, Encryption: "passphrase", Passphrase: "secret"}, cfg.Storage.Backup)
+
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `{}`, expectedErr: "backup path is required"},
+		{data: `{path: /b, interval: 10s}`, expectedErr: "invalid backup interval"},
+		{data: `{path: /b, keep: -1}`, expectedErr: "invalid backup keep"},
+		{data: `{path: /b, encryption: age}`, expectedErr: "invalid backup encryption"},
+		{data: `{path: /b, encryption: passphrase}`, expectedErr: "requires a passphrase"},
+		{data: `{path: /b, encryption: rsa, passphrase: secret}`, expectedErr: "backup passphrase requires encryption passphrase"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte("storage:\n  backup: " + scenario.data + "\n"))
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+	}
+}
+
 func TestInvalidKubernetes(t *testing.T) {
 	scenarios := []struct {
 		data        []byte
@@ -215,7 +267,6 @@ func TestInvalidKubernetes(t *testing.T) {
 		{
 			data: []byte(`
 exporter:
-  type: kubernetes
   kubernetes:
     access: oua-cluster
 `),
@@ -244,13 +295,8 @@ func TestGeneratorConfig(t *testing.T) {
 	}{
 		{
 			data: []byte(`
-manager:
-  repeat_interval: 60 # seconds
-  operation_timeout: 50 # seconds
-
 unlocker:
   number_keys: 3
-  request_timeout: 5
   # url: http://localhost:8200
 
 encryption:
@@ -258,9 +304,6 @@ encryption:
 
 storage:
   type: boltdb
-  kubernetes:
-    access: out-cluster
-    namespace: monitoring
   boltdb:
     path: "./tests/vault/data/integration.db"
 
@@ -357,13 +400,8 @@ func TestAppRoleConfig(t *testing.T) {
 	}{
 		{
 			data: []byte(`
-manager:
-  repeat_interval: 60 # seconds
-  operation_timeout: 50 # seconds
-
 unlocker:
   number_keys: 3
-  request_timeout: 5
   # url: http://localhost:8200
 
 encryption:
@@ -371,9 +409,6 @@ encryption:
 
 storage:
   type: boltdb
-  kubernetes:
-    access: out-cluster
-    namespace: monitoring
   boltdb:
     path: "./tests/vault/data/integration.db"
 
@@ -382,23 +417,23 @@ provisioner:
     - name: external-secret-operator
       rules: |
         path "cluster/metadata/*" {
-          capabilities = ["read"," list"]
+          capabilities = ["read","list"]
         }
         path "cluster/data/*" {
-          capabilities = ["read"," list"]
+          capabilities = ["read","list"]
         }
     - name: external-secret-operator-2
       rules: |
-        path "cluster/metadata/*" { capabilities = ["read"," list"] }
-        path "cluster/data/*" { capabilities = ["read"," list"] }
+        path "cluster/metadata/*" { capabilities = ["read","list"] }
+        path "cluster/data/*" { capabilities = ["read","list"] }
   auth:
   - type: approle
     path: approle
     approles:
     - name: external-secret-operator
       policies:
-        - external-secret-operator-policy
-        - my-sec-policy
+        - external-secret-operator
+        - external-secret-operator-2
       secret_id_ttl: 0
       token_ttl: 3600
       token_max_ttl: 7200
@@ -406,13 +441,13 @@ provisioner:
         namespace: security
     - name: external-secret-operator-2
       policies:
-        - external-secret-operator-policy
+        - external-secret-operator
       secret_id_ttl: 0
       token_ttl: 3600
       token_max_ttl: 7200
     - name: external-secret-operator-3
       policies:
-        - external-secret-operator-policy
+        - external-secret-operator
       secret_id_ttl: 0
       token_ttl: 3600
       token_max_ttl: 7200
@@ -490,7 +525,6 @@ func TestExporterConfig(t *testing.T) {
 		{
 			data: []byte(`
 exporter:
-  type: kubernetes
   kubernetes:
     access: out-cluster
 `),
@@ -511,3 +545,809 @@ exporter:
 	}
 
 }
+
+func TestIdentityConfig(t *testing.T) {
+	data := []byte(`
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+    - type: oidc
+      path: oidc
+  identity:
+    entities:
+      - name: daniel
+        policies:
+          - admin
+        metadata:
+          team: platform
+        aliases:
+          - name: daniel
+            mount: userpass
+    groups:
+      - name: platform
+        policies:
+          - admin
+        member_entities:
+          - daniel
+        member_groups:
+          - sre
+      - name: sre
+        type: external
+        alias:
+          name: sre-team
+          mount: oidc
+`)
+
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	identity := cfg.Provisioner.Identity
+	assert.Len(t, identity.Entities, 1)
+	assert.Equal(t, "userpass", identity.Entities[0].Aliases[0].Mount)
+	assert.Equal(t, "platform", identity.Entities[0].Metadata["team"])
+	assert.Len(t, identity.Groups, 2)
+	assert.Equal(t, "internal", identity.Groups[0].Type)
+	assert.Equal(t, "external", identity.Groups[1].Type)
+	assert.Equal(t, "sre-team", identity.Groups[1].Alias.Name)
+}
+
+func TestInvalidIdentityConfig(t *testing.T) {
+	scenarios := []struct {
+		data        []byte
+		expectedErr string
+	}{
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    groups:
+      - name: sre
+        type: unknown
+`),
+			expectedErr: "invalid type",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    entities:
+      - name: daniel
+    groups:
+      - name: sre
+        type: external
+        member_entities:
+          - daniel
+`),
+			expectedErr: "external groups can not have explicit members",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    groups:
+      - name: sre
+        member_entities:
+          - ghost
+`),
+			expectedErr: "unknown member entity: ghost",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    groups:
+      - name: platform
+        member_groups:
+          - sre
+      - name: sre
+        member_groups:
+          - oncall
+      - name: oncall
+        member_groups:
+          - platform
+`),
+			expectedErr: "group membership cycle: platform -> sre -> oncall -> platform",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    groups:
+      - name: sre
+        member_groups:
+          - sre
+`),
+			expectedErr: "group membership cycle: sre -> sre",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    entities:
+      - name: daniel
+      - name: daniel
+`),
+			expectedErr: "duplicated identity entity",
+		},
+		{
+			data: []byte(`
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+  identity:
+    entities:
+      - name: daniel
+        aliases:
+          - name: daniel
+            mount: ldap
+`),
+			expectedErr: "unknown auth mount: ldap",
+		},
+		{
+			data: []byte(`
+provisioner:
+  identity:
+    entities:
+      - name: daniel
+        aliases:
+          - name: daniel
+`),
+			expectedErr: "requires name and mount",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig(scenario.data)
+		assert.ErrorContains(t, err, scenario.expectedErr)
+	}
+}
+
+func TestNamespacesConfig(t *testing.T) {
+	data := []byte(`
+provisioner:
+  namespaces:
+    - path: /team-a/
+      policies:
+        - name: reader
+          rules: path "secret/*" { capabilities = ["read"] }
+      auth:
+        - type: approle
+          path: approle
+      namespaces:
+        - path: dev
+          mounts:
+            - type: kv-v2
+              path: secret
+`)
+
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	ns := cfg.Provisioner.Namespaces
+	assert.Len(t, ns, 1)
+	assert.Equal(t, "team-a", ns[0].Path)
+	assert.Equal(t, "reader", ns[0].Provisioner.Policies[0].Name)
+	assert.Equal(t, "approle", ns[0].Provisioner.Auth[0].Path)
+	assert.Equal(t, "dev", ns[0].Provisioner.Namespaces[0].Path)
+	assert.Equal(t, "secret", ns[0].Provisioner.Namespaces[0].Provisioner.Mount[0].Path)
+}
+
+func TestInvalidNamespacesConfig(t *testing.T) {
+	scenarios := []struct {
+		data        []byte
+		expectedErr string
+	}{
+		{
+			data: []byte(`
+provisioner:
+  namespaces:
+    - policies: []
+`),
+			expectedErr: "namespace path is required",
+		},
+		{
+			data: []byte(`
+provisioner:
+  namespaces:
+    - path: team-a/dev
+`),
+			expectedErr: "single segment",
+		},
+		{
+			data: []byte(`
+provisioner:
+  namespaces:
+    - path: team-a
+    - path: team-a
+`),
+			expectedErr: "duplicated namespace",
+		},
+		{
+			data: []byte(`
+provisioner:
+  namespaces:
+    - path: team-a
+      identity:
+        entities:
+          - name: daniel
+            aliases:
+              - name: daniel
+                mount: userpass
+`),
+			expectedErr: "namespace team-a: identity entity daniel",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig(scenario.data)
+		assert.ErrorContains(t, err, scenario.expectedErr)
+	}
+}
+
+func TestSecretGeneratorsConfig(t *testing.T) {
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `value: "*random*"`},
+		{data: `value: "*random:64:hex*"`},
+		{data: `value: "*uuid*"`},
+		{data: `value: "*password:24:symbols*"`},
+		{data: `value: "*password-policy:strong*"`},
+		{data: `value: "*rsa:4096*"`},
+		{data: `value: "*ed25519*"`},
+		{data: `value: "*bcrypt:password*"`},
+		{data: `value: "not*a*generator"`},
+		{data: `nested: {list: ["*uuid*", "*random:8*"]}`},
+		{data: `value: "*random:abc*"`, expectedErr: "invalid length"},
+		{data: `value: "*random:16:emoji*"`, expectedErr: "unknown charset"},
+		{data: `value: "*password:24:hex*"`, expectedErr: "password charset"},
+		{data: `value: "*rsa:1024*"`, expectedErr: "bits must be one of"},
+		{data: `value: "*uuid:4*"`, expectedErr: "takes no arguments"},
+		{data: `value: "*bcrypt:missing*"`, expectedErr: "references unknown key: missing"},
+		{data: `value: "*magic*"`, expectedErr: "value: unknown generator: *magic*"},
+		{data: `nested: {list: ["*magic*"]}`, expectedErr: "nested: list: [0]: unknown generator"},
+		{data: `list: ["*bcrypt:password*"]`, expectedErr: "only supported inside maps"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: cluster
+    secrets:
+      - path: app
+        name: db
+        data:
+          password: "*random*"
+          ` + scenario.data + `
+`)
+		_, err := conf.NewConfig(data)
+		if scenario.expectedErr == "" {
+			assert.NoError(t, err, scenario.data)
+			continue
+		}
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+	}
+}
+
+func TestSecretSourcesConfig(t *testing.T) {
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `value: ${env:DB_PASSWORD}`},
+		{data: `value: ${file:/run/secrets/db}`},
+		{data: `value: ${ref:cluster/db#password}`},
+		{data: `value: "postgres://app:${ref:cluster/db#password}@db:5432"`},
+		{data: `value: ${env:}`, expectedErr: "env requires an argument"},
+		{data: `value: ${ref:cluster/db}`, expectedErr: "mount/path#key"},
+		{data: `value: ${ref:#password}`, expectedErr: "mount/path#key"},
+		{data: `nested: {list: ["${ref:cluster/db#}"]}`, expectedErr: "nested: list: [0]: source ${ref:cluster/db#}"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: cluster
+    secrets:
+      - path: app
+        name: db
+        data:
+          ` + scenario.data + `
+`)
+		_, err := conf.NewConfig(data)
+		if scenario.expectedErr == "" {
+			assert.NoError(t, err, scenario.data)
+			continue
+		}
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+	}
+}
+
+func TestExpandSources(t *testing.T) {
+	resolve := func(src conf.Source) (interface{}, error) {
+		if src.Kind == "ref" {
+			return 5432, nil
+		}
+		return src.Arg, nil
+	}
+
+	value, err := conf.ExpandSources("${ref:db/conn#port}", resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, 5432, value)
+
+	value, err = conf.ExpandSources("host=${env:HOST} port=${ref:db/conn#port}", resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, "host=HOST port=5432", value)
+
+	value, err = conf.ExpandSources("no sources", resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, "no sources", value)
+
+	// an escaped source is a literal and never resolved
+	value, err = conf.ExpandSources("$${env:HOST} ${env:HOST}", resolve)
+	assert.NoError(t, err)
+	assert.Equal(t, "${env:HOST} HOST", value)
+
+	sources, err := conf.ParseSources("$${env:HOST}")
+	assert.NoError(t, err)
+	assert.Empty(t, sources)
+}
+
+func TestSecretUpdatePolicyConfig(t *testing.T) {
+	scenarios := []struct {
+		data           string
+		expectedPolicy string
+		expectedErr    string
+	}{
+		{data: ``, expectedPolicy: "create_only"},
+		{data: `update_policy: merge_missing_keys`, expectedPolicy: "merge_missing_keys"},
+		{data: `update_policy: overwrite`, expectedPolicy: "overwrite"},
+		{data: "update_policy: rotate\n        rotation_period: 720h", expectedPolicy: "rotate"},
+		{data: `update_policy: rotate`, expectedErr: "requires a positive rotation_period"},
+		{data: `rotation_period: 1h`, expectedErr: "requires update_policy rotate"},
+		{data: `update_policy: sometimes`, expectedErr: "invalid update_policy"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: cluster
+    secrets:
+      - path: app
+        name: db
+        ` + scenario.data + `
+        data:
+          password: "*random*"
+`)
+		cfg, err := conf.NewConfig(data)
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+		assert.Equal(t, scenario.expectedPolicy, cfg.Provisioner.Mount[0].Secrets[0].UpdatePolicy)
+	}
+}
+
+func TestAppRoleExportConfig(t *testing.T) {
+	scenarios := []struct {
+		data              string
+		expectedThreshold float64
+		expectedGrace     time.Duration
+		expectedErr       string
+	}{
+		{data: ``, expectedThreshold: 0.5, expectedGrace: 10 * time.Minute},
+		{data: "rotation_threshold: 0.8\n            grace_period: 1h", expectedThreshold: 0.8, expectedGrace: time.Hour},
+		{data: `rotation_threshold: 1.5`, expectedErr: "rotation_threshold"},
+		{data: `rotation_threshold: -0.1`, expectedErr: "rotation_threshold"},
+		{data: `grace_period: -1m`, expectedErr: "grace_period"},
+		{data: `wrap_ttl: 500ms`, expectedErr: "wrap_ttl"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: eso
+          secret_id_ttl: 3600
+          export:
+            namespace: security
+            ` + scenario.data + `
+`)
+		cfg, err := conf.NewConfig(data)
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+		export := cfg.Provisioner.Auth[0].AppRoles[0].Export
+		assert.Equal(t, "security", export.Namespace)
+		assert.Equal(t, scenario.expectedThreshold, export.RotationThreshold)
+		assert.Equal(t, scenario.expectedGrace, export.GracePeriod)
+	}
+}
+
+func TestSecretExportConfig(t *testing.T) {
+	scenarios := []struct {
+		data         string
+		expectedType string
+		expectedErr  string
+	}{
+		{data: `namespace: apps`, expectedType: "Opaque"},
+		{data: "namespace: apps\n            type: kubernetes.io/basic-auth", expectedType: "kubernetes.io/basic-auth"},
+		{data: "namespace: apps\n            type: kubernetes.io/dockerconfigjson\n            registry: ghcr.io", expectedType: "kubernetes.io/dockerconfigjson"},
+		{data: `name: x`, expectedErr: "namespace is required"},
+		{data: "namespace: apps\n            type: kubernetes.io/tls", expectedErr: "invalid export type"},
+		{data: "namespace: apps\n            type: kubernetes.io/dockerconfigjson", expectedErr: "requires a registry"},
+		{data: "namespace: apps\n            registry: ghcr.io", expectedErr: "registry is only supported"},
+		{data: "namespace: apps\n            keys:\n              a: x\n              b: x", expectedErr: "duplicated target name"},
+		{data: "namespace: apps\n            labels:\n              app.kubernetes.io/managed-by: me", expectedErr: "is reserved"},
+		{data: "namespace: apps\n            annotations:\n              vault-unlocker/content-hash: x", expectedErr: "is reserved"},
+		{data: "namespace: apps\n            force: true\n            labels:\n              team: ci\n            annotations:\n              owner: ci", expectedType: "Opaque"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          pass: s3cret
+          export:
+            ` + scenario.data + `
+`)
+		cfg, err := conf.NewConfig(data)
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+		assert.Equal(t, scenario.expectedType, cfg.Provisioner.Auth[0].Users[0].Export.Type)
+	}
+}
+
+func TestCertificatesConfig(t *testing.T) {
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: "type: pki\n    certificates:\n      - role: web\n        common_name: web.svc\n        ttl: 720h\n        renew_before: 240h\n        export: {namespace: apps, name: web-tls}"},
+		{data: "type: kv-v2\n    certificates:\n      - role: web\n        common_name: web.svc\n        export: {namespace: apps, name: web-tls}", expectedErr: "only supported on pki mounts"},
+		{data: "type: pki\n    secrets:\n      - name: x\n        data: {k: v}", expectedErr: "not supported on pki mounts"},
+		{data: "type: pki\n    certificates:\n      - common_name: web.svc\n        export: {namespace: apps, name: web-tls}", expectedErr: "role is required"},
+		{data: "type: pki\n    certificates:\n      - role: web\n        export: {namespace: apps, name: web-tls}", expectedErr: "common_name is required"},
+		{data: "type: pki\n    certificates:\n      - role: web\n        common_name: web.svc", expectedErr: "export name is required"},
+		{data: "type: pki\n    certificates:\n      - role: web\n        common_name: web.svc\n        ttl: 1h\n        renew_before: 2h\n        export: {namespace: apps, name: web-tls}", expectedErr: "renew_before must be shorter"},
+		{data: "type: pki\n    certificates:\n      - role: web\n        common_name: a.svc\n        export: {namespace: apps, name: tls}\n      - role: web\n        common_name: b.svc\n        export: {namespace: apps, name: tls}", expectedErr: "duplicated certificate export"},
+	}
+
+	for _, scenario := range scenarios {
+		data := []byte(`
+provisioner:
+  mounts:
+  - path: pki
+    ` + scenario.data + `
+`)
+		_, err := conf.NewConfig(data)
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+	}
+}
+
+func TestFileExportersConfig(t *testing.T) {
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `
+exporter:
+  files:
+    - name: local
+      path: /run/secrets
+    - name: dotenv
+      format: env
+      path: /srv/app
+    - name: rendered
+      format: template
+      path: /etc/app
+      template: /etc/app/config.tpl
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          pass: s3cret
+          export:
+            exporter: dotenv
+`},
+		{data: `
+exporter:
+  files:
+    - name: local
+`, expectedErr: "path is required"},
+		{data: `
+exporter:
+  files:
+    - name: kubernetes
+      path: /tmp
+`, expectedErr: "duplicated exporter name"},
+		{data: `
+exporter:
+  files:
+    - name: local
+      format: xml
+      path: /tmp
+`, expectedErr: "invalid format"},
+		{data: `
+exporter:
+  files:
+    - name: local
+      format: template
+      path: /tmp
+`, expectedErr: "requires a template file"},
+		{data: `
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          export:
+            exporter: missing
+`, expectedErr: "unknown exporter: missing"},
+		{data: `
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          export:
+            name: ci
+`, expectedErr: "namespace is required"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte(scenario.data))
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+	}
+}
+
+func TestKubernetesClustersConfig(t *testing.T) {
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `
+exporter:
+  kubernetes:
+    kubeconfig: /etc/unlocker/kubeconfig
+    context: central
+  clusters:
+    - name: edge
+      host: https://edge:6443
+      token: abc
+      ca: /etc/unlocker/edge-ca.crt
+    - name: west
+      context: west
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: app
+          export:
+            namespace: apps
+            exporter: edge
+`},
+		{data: `
+exporter:
+  kubernetes:
+    access: in-cluster
+    context: central
+`, expectedErr: "require access out-cluster"},
+		{data: `
+exporter:
+  kubernetes:
+    host: https://a
+    kubeconfig: /x
+`, expectedErr: "host can not be combined"},
+		{data: `
+exporter:
+  kubernetes:
+    token: abc
+`, expectedErr: "token and ca require a host"},
+		{data: `
+exporter:
+  clusters:
+    - host: https://a
+`, expectedErr: "cluster name is required"},
+		{data: `
+exporter:
+  clusters:
+    - name: edge
+      access: in-cluster
+      host: https://a
+`, expectedErr: "cluster edge"},
+		{data: `
+exporter:
+  clusters:
+    - name: edge
+      host: https://a
+  files:
+    - name: edge
+      path: /tmp
+`, expectedErr: "duplicated exporter name"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte(scenario.data))
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+			continue
+		}
+		assert.NoError(t, err, scenario.data)
+	}
+
+	cfg, err := conf.NewConfig([]byte(scenarios[0].data))
+	assert.NoError(t, err)
+	assert.Equal(t, "out-cluster", cfg.Exporter.Kubernetes.Access)
+	assert.Equal(t, "out-cluster", cfg.Exporter.Clusters[1].Kubernetes.Access)
+	assert.Equal(t, "west", cfg.Exporter.Clusters[1].Kubernetes.Context)
+}
+
+func TestDiscoveryConfig(t *testing.T) {
+	cfg, err := conf.NewConfig([]byte(`
+unlocker:
+  url: http://vault-active.vault:8200
+  discovery:
+    namespace: vault
+    label_selector: app.kubernetes.io/name=vault
+`))
+	assert.NoError(t, err)
+	d := cfg.Unlocker.Discovery
+	assert.Equal(t, 8200, d.Port)
+	assert.Equal(t, "http", d.Scheme)
+	assert.Equal(t, 30*time.Second, d.ResyncInterval)
+	assert.NotNil(t, cfg.Exporter)
+
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `namespace: vault`, expectedErr: "label_selector is required"},
+		{data: "label_selector: a=b\n    scheme: ftp", expectedErr: "scheme invalid"},
+		{data: "label_selector: a=b\n    port: 70000", expectedErr: "invalid discovery port"},
+		{data: "label_selector: a=b\n    resync_interval: 10ms", expectedErr: "resync_interval"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte(`
+unlocker:
+  discovery:
+    ` + scenario.data + `
+`))
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+	}
+}
+
+func TestResourcesConfig(t *testing.T) {
+	cfg, err := conf.NewConfig([]byte(`
+resources:
+  namespaces: [team-a]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a"}, cfg.Resources.Namespaces)
+	assert.Equal(t, 5*time.Minute, cfg.Resources.ResyncInterval)
+	assert.NotNil(t, cfg.Exporter)
+
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{data: `resync_interval: 10ms`, expectedErr: "resync_interval"},
+		{data: `namespaces: [a, a]`, expectedErr: "duplicated resources namespace: a"},
+		{data: `namespaces: [""]`, expectedErr: "namespace can not be empty"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte("resources:\n  " + scenario.data + "\n"))
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+	}
+}
+
+func TestMetricsConfig(t *testing.T) {
+	cfg, err := conf.NewConfig([]byte("metrics:\n  address: :9102\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, ":9102", cfg.Metrics.Address)
+
+	_, err = conf.NewConfig([]byte("metrics: {}\n"))
+	assert.ErrorContains(t, err, "metrics address is required")
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret")
+
+	assert.NoError(t, conf.WriteFileAtomic(path, []byte("old"), 0600))
+	assert.NoError(t, conf.WriteFileAtomic(path, []byte("new"), 0600))
+
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", string(content))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1, "no temporary file is left behind")
+
+	assert.Error(t, conf.WriteFileAtomic(filepath.Join(dir, "missing", "secret"), []byte("x"), 0600))
+}
+
+func TestSortGroups(t *testing.T) {
+	scenarios := []struct {
+		name          string
+		groups        []conf.Group
+		expectedOrder []string
+		expectedErr   string
+	}{
+		{
+			name: "members first",
+			groups: []conf.Group{
+				{Name: "platform", MemberGroups: []string{"sre", "dev"}},
+				{Name: "sre", MemberGroups: []string{"oncall"}},
+				{Name: "dev"},
+				{Name: "oncall"},
+			},
+			expectedOrder: []string{"oncall", "sre", "dev", "platform"},
+		},
+		{
+			name: "cycle",
+			groups: []conf.Group{
+				{Name: "a", MemberGroups: []string{"b"}},
+				{Name: "b", MemberGroups: []string{"a"}},
+			},
+			expectedErr: "a -> b -> a",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		sorted, err := conf.SortGroups(scenario.groups)
+		if scenario.expectedErr != "" {
+			assert.ErrorContains(t, err, scenario.expectedErr, scenario.name)
+			continue
+		}
+
+		assert.NoError(t, err, scenario.name)
+		names := []string{}
+		for _, group := range sorted {
+			names = append(names, group.Name)
+		}
+		assert.Equal(t, scenario.expectedOrder, names, scenario.name)
+	}
+}
@@ -0,0 +1,171 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// generators
+	defaultRandomLength   = 32
+	defaultRandomCharset  = "alnum"
+	defaultPasswordLength = 24
+	defaultRSABits        = 2048
+)
+
+// Charsets usable by the random and password generators.
+var Charsets = map[string]string{
+	"alnum":   "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789",
+	"alpha":   "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"lower":   "abcdefghijklmnopqrstuvwxyz",
+	"upper":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"numeric": "0123456789",
+	"hex":     "0123456789abcdef",
+	"symbols": "!#$%&()*+,-.:;<=>?@[]^_{|}~",
+}
+
+// Generator describes a secret value produced at provisioning time. It is
+// written in the config as a string wrapped by asterisks:
+//
+//	*random*                 32 alphanumeric characters
+//	*random:64:hex*          length and charset
+//	*uuid*                   random (v4) uuid
+//	*password:24:symbols*    at least one lower, upper, digit (and symbol)
+//	*password-policy:name*   generated by a vault password policy
+//	*rsa:4096*               PEM encoded private key
+//	*ed25519*                PEM encoded private key
+//	*bcrypt:key*             bcrypt hash of a sibling key
+type Generator struct {
+	Kind    string
+	Length  int
+	Charset string
+	Bits    int
+	Ref     string
+}
+
+// ParseGenerator reports whether value is a generator marker and, if so,
+// returns its parsed form. Unknown generators or bad arguments are errors.
+func ParseGenerator(value string) (*Generator, bool, error) {
+	if len(value) < 3 || !strings.HasPrefix(value, "*") || !strings.HasSuffix(value, "*") {
+		return nil, false, nil
+	}
+
+	parts := strings.Split(value[1:len(value)-1], ":")
+	kind, args := parts[0], parts[1:]
+	g := &Generator{Kind: kind}
+
+	switch kind {
+	case "random", "password":
+		if len(args) > 2 {
+			return nil, true, fmt.Errorf("generator %s: too many arguments", value)
+		}
+
+		g.Length = defaultRandomLength
+		g.Charset = defaultRandomCharset
+		if kind == "password" {
+			g.Length = defaultPasswordLength
+		}
+
+		if len(args) > 0 {
+			length, err := strconv.Atoi(args[0])
+			if err != nil || length < 1 || length > 4096 {
+				return nil, true, fmt.Errorf("generator %s: invalid length: %s", value, args[0])
+			}
+			g.Length = length
+		}
+
+		if len(args) > 1 {
+			g.Charset = args[1]
+		}
+
+		if _, ok := Charsets[g.Charset]; !ok {
+			return nil, true, fmt.Errorf("generator %s: unknown charset: %s", value, g.Charset)
+		}
+
+		if kind == "password" && g.Charset != "alnum" && g.Charset != "symbols" {
+			return nil, true, fmt.Errorf("generator %s: password charset must be one of [alnum, symbols]", value)
+		}
+
+		if kind == "password" && g.Length < 4 {
+			return nil, true, fmt.Errorf("generator %s: password length must be at least 4", value)
+		}
+
+	case "uuid", "ed25519":
+		if len(args) > 0 {
+			return nil, true, fmt.Errorf("generator %s: takes no arguments", value)
+		}
+
+	case "rsa":
+		if len(args) > 1 {
+			return nil, true, fmt.Errorf("generator %s: too many arguments", value)
+		}
+
+		g.Bits = defaultRSABits
+		if len(args) == 1 {
+			bits, err := strconv.Atoi(args[0])
+			if err != nil || (bits != 2048 && bits != 3072 && bits != 4096) {
+				return nil, true, fmt.Errorf("generator %s: bits must be one of [2048, 3072, 4096]", value)
+			}
+			g.Bits = bits
+		}
+
+	case "bcrypt", "password-policy":
+		if len(args) != 1 || args[0] == "" {
+			return nil, true, fmt.Errorf("generator %s: requires exactly one argument", value)
+		}
+		g.Ref = args[0]
+
+	default:
+		return nil, true, fmt.Errorf("unknown generator: %s", value)
+	}
+
+	return g, true, nil
+}
+
+// validateGenerators walks secret data, including nested maps and lists, and
+// checks every generator marker and source. bcrypt must reference a sibling
+// key.
+func validateGenerators(data map[string]interface{}) error {
+	for key, value := range data {
+		if err := validateGeneratorValue(value, data); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func validateGeneratorValue(value interface{}, siblings map[string]interface{}) error {
+	switch val := value.(type) {
+	case string:
+		if _, err := ParseSources(val); err != nil {
+			return err
+		}
+		g, ok, err := ParseGenerator(val)
+		if err != nil || !ok {
+			return err
+		}
+		if g.Kind != "bcrypt" {
+			return nil
+		}
+		if siblings == nil {
+			return fmt.Errorf("generator %s: bcrypt is only supported inside maps", val)
+		}
+		ref, ok := siblings[g.Ref].(string)
+		if !ok {
+			return fmt.Errorf("generator %s: references unknown key: %s", val, g.Ref)
+		}
+		if refGen, isGen, _ := ParseGenerator(ref); isGen && refGen.Kind == "bcrypt" {
+			return fmt.Errorf("generator %s: can not reference another bcrypt value", val)
+		}
+	case map[string]interface{}:
+		return validateGenerators(val)
+	case []interface{}:
+		for i, item := range val {
+			if err := validateGeneratorValue(item, nil); err != nil {
+				return fmt.Errorf("[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// interpolationPattern matches, in order of precedence:
+//
+//	$${                           escaped, a literal ${
+//	${file:/path}                 file content, trailing new lines removed
+//	${NAME} ${NAME:-default}      environment variable, default when unset or empty
+var interpolationPattern = regexp.MustCompile(`\$\$\{|\$\{(?:file:([^}]*)|([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?)\}`)
+
+// interpolate expands the environment variables and files referenced by the
+// values of node before the config is decoded. Secret data keeps its ${file:}
+// sources and its $${ escapes, they are resolved at reconcile time like
+// ${env:} and ${ref:}. The expanded values are recorded so problems never
+// reveal them.
+func (m *merger) interpolate(node *yaml.Node, key string, secretData bool) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i].Value
+			m.interpolate(node.Content[i+1], name, secretData || (key == "secrets" && name == "data"))
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			m.interpolate(item, key, secretData)
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		value, err := m.expand(node.Value, secretData)
+		if err != nil {
+			m.problem(node, err.Error())
+			return
+		}
+		node.Value = value
+		m.expanded[node] = true
+		if node.Style == 0 {
+			node.Tag = (&yaml.Node{Kind: yaml.ScalarNode, Value: value}).ShortTag()
+		}
+	}
+}
+
+func (m *merger) expand(value string, secretData bool) (string, error) {
+	var expandErr error
+	expanded := interpolationPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if expandErr != nil {
+			return match
+		}
+		if match == "$${" {
+			if secretData {
+				return match
+			}
+			return "${"
+		}
+
+		sub := interpolationPattern.FindStringSubmatch(match)
+		if strings.HasPrefix(match, "${file:") {
+			if secretData {
+				return match
+			}
+			if sub[1] == "" {
+				expandErr = fmt.Errorf("%s requires a path", match)
+				return match
+			}
+			content, err := os.ReadFile(sub[1])
+			if err != nil {
+				expandErr = fmt.Errorf("%s: %w", match, err)
+				return match
+			}
+			return m.secret(strings.TrimRight(string(content), "\r\n"))
+		}
+
+		env, ok := os.LookupEnv(sub[2])
+		if strings.Contains(match, ":-") && env == "" {
+			return sub[3]
+		}
+		if ok {
+			return m.secret(env)
+		}
+		expandErr = fmt.Errorf("environment variable %s is not set", sub[2])
+		return match
+	})
+
+	return expanded, expandErr
+}
+
+func (m *merger) secret(value string) string {
+	if value != "" {
+		m.secrets = append(m.secrets, value)
+	}
+	return value
+}
+
+// redact hides every expanded value in the messages of problems.
+func (m *merger) redact(problems []Problem) []Problem {
+	if len(m.secrets) == 0 {
+		return problems
+	}
+
+	secrets := append([]string{}, m.secrets...)
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+
+	for i := range problems {
+		for _, s := range secrets {
+			problems[i].Message = strings.ReplaceAll(problems[i].Message, s, "***")
+		}
+	}
+	return problems
+}
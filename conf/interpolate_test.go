@@ -0,0 +1,101 @@
+package conf_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolation(t *testing.T) {
+	passFile := filepath.Join(t.TempDir(), "pass")
+	assert.NoError(t, os.WriteFile(passFile, []byte("from-file\n"), 0600))
+
+	t.Setenv("UNLOCKER_URL", "http://vault:8200")
+	t.Setenv("UNLOCKER_KEYS", "5")
+	t.Setenv("UNLOCKER_EMPTY", "")
+
+	cfg, err := conf.NewConfig([]byte(`
+unlocker:
+  url: ${UNLOCKER_URL}
+  number_keys: ${UNLOCKER_KEYS}
+provisioner:
+  policies:
+    - name: reader
+      rules: path "${UNLOCKER_MOUNT:-kv}/*" { capabilities = ["read"] }
+  auth:
+    - type: userpass
+      path: ${UNLOCKER_EMPTY:-userpass}
+      users:
+        - name: admin
+          pass: ${file:` + passFile + `}
+          policies:
+            - reader
+        - name: literal
+          pass: "$${UNLOCKER_URL}"
+  mounts:
+    - type: kv-v2
+      path: kv
+      secrets:
+        - path: app
+          name: db
+          data:
+            host: ${UNLOCKER_URL}
+            password: ${file:/run/secrets/db}
+            token: ${env:TOKEN}
+            literal: "$${env:TOKEN} $${UNLOCKER_URL}"
+`))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "http://vault:8200", cfg.Unlocker.Url)
+	assert.Equal(t, 5, cfg.Unlocker.NumberKeys)
+
+	p := cfg.Provisioner
+	assert.Equal(t, `path "kv/*" { capabilities = ["read"] }`, p.Policies[0].Rules)
+	assert.Equal(t, "userpass", p.Auth[0].Path)
+	assert.Equal(t, "from-file", p.Auth[0].Users[0].Pass)
+	assert.Equal(t, "${UNLOCKER_URL}", p.Auth[0].Users[1].Pass)
+
+	// secret data keeps its sources for reconcile time
+	data := p.Mount[0].Secrets[0].Data
+	assert.Equal(t, "http://vault:8200", data["host"])
+	assert.Equal(t, "${file:/run/secrets/db}", data["password"])
+	assert.Equal(t, "${env:TOKEN}", data["token"])
+	// and its escapes, a literal ${ once the sources are expanded
+	assert.Equal(t, "$${env:TOKEN} $${UNLOCKER_URL}", data["literal"])
+	literal, err := conf.ExpandSources(data["literal"].(string), func(src conf.Source) (interface{}, error) {
+		return nil, fmt.Errorf("unexpected source: %s", src.Kind)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "${env:TOKEN} ${UNLOCKER_URL}", literal)
+
+	scenarios := []struct {
+		data        string
+		expectedErr string
+	}{
+		{
+			data:        "unlocker:\n  url: ${UNLOCKER_MISSING}\n",
+			expectedErr: "2:8: environment variable UNLOCKER_MISSING is not set",
+		},
+		{
+			data:        "unlocker:\n  url: ${file:/does/not/exist}\n",
+			expectedErr: "2:8: ${file:/does/not/exist}: open /does/not/exist",
+		},
+		{
+			// the expanded value is never part of an error
+			data:        "unlocker:\n  number_keys: ${UNLOCKER_URL}\n",
+			expectedErr: "cannot unmarshal !!str `***` into int",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfig([]byte(scenario.data))
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.data)
+		if err != nil {
+			assert.NotContains(t, err.Error(), "http://vault:8200")
+		}
+	}
+}
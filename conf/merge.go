@@ -0,0 +1,232 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is one source of a config split across files.
+type File struct {
+	Path    string
+	Content []byte
+}
+
+// listRule identifies the items of a named list across files. Items with the
+// same identity are merged when merge is set and reported as duplicates
+// otherwise. Lists without a rule are concatenated.
+type listRule struct {
+	item  string
+	keys  []string
+	merge bool
+}
+
+var listRules = map[string]listRule{
+	"policies":   {item: "policy", keys: []string{"name"}},
+	"auth":       {item: "auth", keys: []string{"path"}, merge: true},
+	"approles":   {item: "approle", keys: []string{"name"}},
+	"users":      {item: "user", keys: []string{"name"}},
+	"mounts":     {item: "mount", keys: []string{"path"}, merge: true},
+	"secrets":    {item: "secret", keys: []string{"path", "name"}},
+	"namespaces": {item: "namespace", keys: []string{"path"}, merge: true},
+	"entities":   {item: "entity", keys: []string{"name"}},
+	"groups":     {item: "group", keys: []string{"name"}},
+	"clusters":   {item: "cluster", keys: []string{"name"}},
+	"files":      {item: "file exporter", keys: []string{"name"}},
+}
+
+// ReadFiles reads the config at path: a file, every *.yaml and *.yml file of
+// a directory, or the files matching a glob, sorted by name. Hidden entries
+// are skipped, which also skips the ..data folders of ConfigMap volumes.
+func ReadFiles(path string) ([]File, error) {
+	var paths []string
+
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no config file matches: %s", path)
+		}
+		paths = matches
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			paths = []string{path}
+		} else {
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				ext := filepath.Ext(entry.Name())
+				if strings.HasPrefix(entry.Name(), ".") || (ext != ".yaml" && ext != ".yml") {
+					continue
+				}
+				paths = append(paths, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	sort.Strings(paths)
+
+	files := make([]File, 0, len(paths))
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		if info.IsDir() {
+			continue
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, File{Path: p, Content: content})
+	}
+
+	return files, nil
+}
+
+// NewConfigFromFiles merges files in order and decodes the result like
+// NewConfig. Every problem is reported with its file, line and column.
+func NewConfigFromFiles(files []File) (*config, error) {
+	c, problems := load(files)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return c, nil
+}
+
+// SameFiles reports whether a and b hold the same paths and content.
+func SameFiles(a []File, b []File) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Path != b[i].Path || !bytes.Equal(a[i].Content, b[i].Content) {
+			return false
+		}
+	}
+	return true
+}
+
+// merger combines the files of a config and collects the problems found,
+// origin remembers the file of every node, expanded the interpolated nodes and
+// secrets their values.
+type merger struct {
+	origin   map[*yaml.Node]string
+	expanded map[*yaml.Node]bool
+	dropped  map[*yaml.Node]bool
+	problems []Problem
+	secrets  []string
+}
+
+func (m *merger) track(node *yaml.Node, path string) {
+	m.origin[node] = path
+	for _, child := range node.Content {
+		m.track(child, path)
+	}
+}
+
+func (m *merger) at(node *yaml.Node) string {
+	return fmt.Sprintf("%s:%d:%d", m.origin[node], node.Line, node.Column)
+}
+
+func (m *merger) mergeMapping(dst *yaml.Node, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		existingKey, existing := mappingEntry(dst, key.Value)
+		if existing == nil {
+			dst.Content = append(dst.Content, key, value)
+			continue
+		}
+
+		switch {
+		case existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+			m.mergeMapping(existing, value)
+		case existing.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+			m.mergeSequence(key.Value, existing, value)
+		case existing.Kind == yaml.ScalarNode && value.Kind == yaml.ScalarNode && existing.Value == value.Value:
+			// the same setting repeated, e.g. the type of a merged auth entry
+		default:
+			m.problem(key, fmt.Sprintf("duplicate key %q, also defined at %s", key.Value, m.at(existingKey)))
+		}
+	}
+}
+
+// mergeSequence merges the items of src into dst by their identity. Items of
+// the same file are only appended, repeats within a file are left to the
+// semantic checks.
+func (m *merger) mergeSequence(name string, dst *yaml.Node, src *yaml.Node) {
+	rule, ok := listRules[name]
+
+	for _, item := range src.Content {
+		id := identity(item, rule.keys)
+		if !ok || id == "" {
+			dst.Content = append(dst.Content, item)
+			continue
+		}
+
+		var existing *yaml.Node
+		for _, candidate := range dst.Content {
+			if m.origin[candidate] != m.origin[item] && identity(candidate, rule.keys) == id {
+				existing = candidate
+				break
+			}
+		}
+
+		switch {
+		case existing == nil:
+			dst.Content = append(dst.Content, item)
+		case rule.merge:
+			m.mergeMapping(existing, item)
+		default:
+			m.problem(item, fmt.Sprintf("duplicate %s %q, also defined at %s", rule.item, id, m.at(existing)))
+		}
+	}
+}
+
+// identity joins the keys of a mapping item, empty for scalars.
+func identity(item *yaml.Node, keys []string) string {
+	if item.Kind != yaml.MappingNode || len(keys) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		value := mappingValue(item, k)
+		if value == nil {
+			parts = append(parts, "")
+			continue
+		}
+		parts = append(parts, value.Value)
+	}
+
+	return strings.Trim(strings.Join(parts, "/"), "/")
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	_, value := mappingEntry(node, key)
+	return value
+}
+
+func mappingEntry(node *yaml.Node, key string) (*yaml.Node, *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
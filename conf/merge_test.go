@@ -0,0 +1,153 @@
+package conf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"20-team-b.yaml": "b",
+		"10-team-a.yml":  "a",
+		"README.md":      "ignored",
+		".hidden.yaml":   "ignored",
+	} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..data"), 0700))
+
+	files, err := conf.ReadFiles(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, []conf.File{
+		{Path: filepath.Join(dir, "10-team-a.yml"), Content: []byte("a")},
+		{Path: filepath.Join(dir, "20-team-b.yaml"), Content: []byte("b")},
+	}, files)
+
+	files, err = conf.ReadFiles(filepath.Join(dir, "*-team-b.yaml"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	_, err = conf.ReadFiles(filepath.Join(dir, "*.json"))
+	assert.ErrorContains(t, err, "no config file matches")
+
+	assert.True(t, conf.SameFiles(files, []conf.File{{Path: filepath.Join(dir, "20-team-b.yaml"), Content: []byte("b")}}))
+	assert.False(t, conf.SameFiles(files, []conf.File{{Path: filepath.Join(dir, "20-team-b.yaml"), Content: []byte("c")}}))
+}
+
+func TestNewConfigFromFiles(t *testing.T) {
+	cfg, err := conf.NewConfigFromFiles([]conf.File{
+		{Path: "base.yaml", Content: []byte(`
+unlocker:
+  url: http://vault:8200
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+`)},
+		{Path: "empty.yaml", Content: []byte("# nothing yet\n")},
+		{Path: "team-a.yaml", Content: []byte(`
+provisioner:
+  policies:
+    - name: team-a
+      rules: path "a/*" {}
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: team-a
+  mounts:
+    - type: kv-v2
+      path: apps
+      secrets:
+        - path: team-a
+          name: db
+          data:
+            password: "*random*"
+`)},
+		{Path: "team-b.yaml", Content: []byte(`
+provisioner:
+  policies:
+    - name: team-b
+      rules: path "b/*" {}
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: team-b
+  mounts:
+    - type: kv-v2
+      path: apps
+      secrets:
+        - path: team-b
+          name: db
+          data:
+            password: "*random*"
+`)},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "http://vault:8200", cfg.Unlocker.Url)
+	assert.Equal(t, 3, cfg.Unlocker.NumberKeys)
+
+	prov := cfg.Provisioner
+	assert.Len(t, prov.Policies, 2)
+	assert.Equal(t, "team-a", prov.Policies[0].Name)
+	assert.Len(t, prov.Auth, 1)
+	assert.Equal(t, "team-a", prov.Auth[0].AppRoles[0].Name)
+	assert.Equal(t, "team-b", prov.Auth[0].AppRoles[1].Name)
+	assert.Len(t, prov.Mount, 1)
+	assert.Len(t, prov.Mount[0].Secrets, 2)
+
+	scenarios := []struct {
+		a           string
+		b           string
+		expectedErr string
+	}{
+		{
+			a:           "provisioner:\n  policies:\n    - name: shared\n      rules: x\n",
+			b:           "\nprovisioner:\n  policies:\n    - name: shared\n      rules: y\n",
+			expectedErr: `b.yaml:4:7: duplicate policy "shared", also defined at a.yaml:3:7`,
+		},
+		{
+			a:           "provisioner:\n  auth:\n    - type: approle\n      path: approle\n      approles:\n        - name: web\n",
+			b:           "provisioner:\n  auth:\n    - type: approle\n      path: approle\n      approles:\n        - name: web\n",
+			expectedErr: `b.yaml:6:11: duplicate approle "web", also defined at a.yaml:6:11`,
+		},
+		{
+			a:           "provisioner:\n  mounts:\n    - type: kv-v2\n      path: apps\n      secrets:\n        - path: web\n          name: db\n",
+			b:           "provisioner:\n  mounts:\n    - type: kv-v2\n      path: apps\n      secrets:\n        - path: web\n          name: db\n",
+			expectedErr: `b.yaml:6:11: duplicate secret "web/db", also defined at a.yaml:6:11`,
+		},
+		{
+			a:           "provisioner:\n  auth:\n    - type: approle\n      path: shared\n",
+			b:           "provisioner:\n  auth:\n    - type: userpass\n      path: shared\n",
+			expectedErr: `b.yaml:3:7: duplicate key "type", also defined at a.yaml:3:7`,
+		},
+		{
+			a:           "unlocker:\n  url: http://a\n",
+			b:           "unlocker:\n  url: http://b\n",
+			expectedErr: `b.yaml:2:3: duplicate key "url", also defined at a.yaml:2:3`,
+		},
+		{
+			a:           "unlocker:\n  url: http://a\n",
+			b:           "- not a mapping\n",
+			expectedErr: "b.yaml:1:1: config must be a mapping",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfigFromFiles([]conf.File{
+			{Path: "a.yaml", Content: []byte(scenario.a)},
+			{Path: "b.yaml", Content: []byte(scenario.b)},
+		})
+		assert.ErrorContains(t, err, scenario.expectedErr)
+	}
+
+	// a single file keeps the behaviour of NewConfig, errors name the file
+	_, err = conf.NewConfigFromFiles([]conf.File{{Path: "only.yaml", Content: []byte("unlocker: [")}})
+	assert.ErrorContains(t, err, "only.yaml:")
+}
@@ -0,0 +1,275 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/token"
+	"gopkg.in/yaml.v3"
+)
+
+var policyVarPattern = regexp.MustCompile(`\$\{var\.([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// policyCapabilities are the capabilities vault accepts in a path block.
+var policyCapabilities = map[string]bool{
+	"create": true, "read": true, "update": true, "patch": true, "delete": true,
+	"list": true, "sudo": true, "deny": true, "subscribe": true, "recover": true,
+}
+
+// policyPathKeys are the settings of a path block.
+var policyPathKeys = map[string]bool{
+	"capabilities": true, "policy": true, "comment": true,
+	"allowed_parameters": true, "denied_parameters": true, "required_parameters": true,
+	"min_wrapping_ttl": true, "max_wrapping_ttl": true,
+	"mfa_methods": true, "control_group": true, "subscribe_event_types": true,
+}
+
+// PolicyError is a syntax or capability error at Line and Column of the
+// rules, 0 when unknown.
+type PolicyError struct {
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *PolicyError) Error() string {
+	if e.Line == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Message)
+}
+
+// Compile replaces the ${var.NAME} references of the rules by Vars and checks
+// the result is a valid HCL or JSON policy.
+func (p *Policy) Compile() error {
+	var missing []string
+	p.Rules = policyVarPattern.ReplaceAllStringFunc(p.Rules, func(match string) string {
+		name := policyVarPattern.FindStringSubmatch(match)[1]
+		value, ok := p.Vars[name]
+		if !ok {
+			missing = append(missing, name)
+			return match
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return &PolicyError{Message: fmt.Sprintf("undefined policy variable: %s", strings.Join(missing, ", "))}
+	}
+
+	return CheckPolicy(p.Rules)
+}
+
+// CheckPolicy parses rules as vault does and reports unknown keys and
+// capabilities, the error is a *PolicyError.
+func CheckPolicy(rules string) error {
+	if trimmed := bytes.TrimSpace([]byte(rules)); len(trimmed) > 0 && trimmed[0] == '{' {
+		var doc interface{}
+		var syntaxErr *json.SyntaxError
+		if err := json.Unmarshal(trimmed, &doc); errors.As(err, &syntaxErr) {
+			line, column := offsetPosition(rules, strings.Index(rules, string(trimmed))+int(syntaxErr.Offset))
+			return &PolicyError{Line: line, Column: column, Message: err.Error()}
+		}
+	}
+
+	file, err := hcl.ParseString(rules)
+	if err != nil {
+		var posErr *parser.PosError
+		if errors.As(err, &posErr) {
+			return &PolicyError{Line: posErr.Pos.Line, Column: posErr.Pos.Column, Message: posErr.Err.Error()}
+		}
+		return &PolicyError{Message: err.Error()}
+	}
+
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return &PolicyError{Message: "policy must be an object"}
+	}
+
+	for _, item := range list.Items {
+		switch key := itemKey(item); key {
+		case "name":
+		case "path":
+			if len(item.Keys) < 2 {
+				return positioned(item.Pos(), "path requires a name")
+			}
+			if err := checkPolicyPath(item); err != nil {
+				return err
+			}
+		default:
+			return positioned(item.Pos(), fmt.Sprintf("unknown policy key %q", key))
+		}
+	}
+
+	return nil
+}
+
+// PolicyPaths returns the paths the rules grant capabilities on, the rules
+// must pass CheckPolicy.
+func PolicyPaths(rules string) ([]string, error) {
+	file, err := hcl.ParseString(rules)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, errors.New("policy must be an object")
+	}
+
+	var paths []string
+	for _, item := range list.Items {
+		if itemKey(item) != "path" || len(item.Keys) < 2 {
+			continue
+		}
+		path, _ := item.Keys[1].Token.Value().(string)
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func checkPolicyPath(item *ast.ObjectItem) error {
+	block, ok := item.Val.(*ast.ObjectType)
+	if !ok {
+		return positioned(item.Pos(), "path must be a block")
+	}
+
+	for _, setting := range block.List.Items {
+		key := itemKey(setting)
+		if !policyPathKeys[key] {
+			return positioned(setting.Pos(), fmt.Sprintf("unknown path setting %q", key))
+		}
+		if key != "capabilities" {
+			continue
+		}
+
+		capabilities, ok := setting.Val.(*ast.ListType)
+		if !ok {
+			return positioned(setting.Pos(), "capabilities must be a list")
+		}
+		for _, c := range capabilities.List {
+			lit, ok := c.(*ast.LiteralType)
+			if !ok || lit.Token.Type != token.STRING {
+				return positioned(c.Pos(), "capabilities must be strings")
+			}
+			if name, _ := lit.Token.Value().(string); !policyCapabilities[name] {
+				return positioned(lit.Pos(), fmt.Sprintf("unknown capability %q", name))
+			}
+		}
+	}
+
+	return nil
+}
+
+func itemKey(item *ast.ObjectItem) string {
+	if len(item.Keys) == 0 {
+		return ""
+	}
+	key, _ := item.Keys[0].Token.Value().(string)
+	return key
+}
+
+func positioned(pos token.Pos, message string) *PolicyError {
+	return &PolicyError{Line: pos.Line, Column: pos.Column, Message: message}
+}
+
+func offsetPosition(content string, offset int) (int, int) {
+	if offset > len(content) {
+		offset = len(content)
+	}
+	before := content[:offset]
+	line := strings.Count(before, "\n") + 1
+	return line, offset - strings.LastIndex(before, "\n")
+}
+
+// loadPolicies reads the policy files and directories of p relative to the
+// config file declaring them, then compiles every policy. Errors of a policy
+// file point into that file.
+func (m *merger) loadPolicies(root *yaml.Node, p *Provisioner, at []interface{}) {
+	var policies []Policy
+	for i, policy := range p.Policies {
+		node := locate(root, append(append([]interface{}{}, at...), "policies", i))
+		base := filepath.Dir(m.origin[node])
+		policy.entry = i
+
+		switch {
+		case policy.Dir != "":
+			dir := resolvePath(base, policy.Dir)
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				m.problem(node, fmt.Sprintf("policy dir: %v", err))
+				continue
+			}
+			var names []string
+			for _, entry := range entries {
+				ext := filepath.Ext(entry.Name())
+				if !entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") && (ext == ".hcl" || ext == ".json") {
+					names = append(names, entry.Name())
+				}
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				file := Policy{Name: strings.TrimSuffix(name, filepath.Ext(name)), File: filepath.Join(dir, name), Vars: policy.Vars, entry: i}
+				if m.loadPolicyFile(node, &file) {
+					policies = append(policies, file)
+				}
+			}
+
+		case policy.File != "":
+			policy.File = resolvePath(base, policy.File)
+			if policy.Name == "" {
+				policy.Name = strings.TrimSuffix(filepath.Base(policy.File), filepath.Ext(policy.File))
+			}
+			if m.loadPolicyFile(node, &policy) {
+				policies = append(policies, policy)
+			}
+
+		default:
+			if err := policy.Compile(); err != nil {
+				if rules := mappingValue(node, "rules"); rules != nil {
+					node = rules
+				}
+				m.problem(node, fmt.Sprintf("policy %s: %v", policy.Name, err))
+				continue
+			}
+			policies = append(policies, policy)
+		}
+	}
+	p.Policies = policies
+
+	for i := range p.Namespaces {
+		m.loadPolicies(root, &p.Namespaces[i].Provisioner, append(append([]interface{}{}, at...), "namespaces", i))
+	}
+}
+
+func (m *merger) loadPolicyFile(node *yaml.Node, policy *Policy) bool {
+	content, err := os.ReadFile(policy.File)
+	if err != nil {
+		m.problem(node, fmt.Sprintf("policy %s: %v", policy.Name, err))
+		return false
+	}
+
+	policy.Rules = string(content)
+	if err := policy.Compile(); err != nil {
+		var policyErr *PolicyError
+		errors.As(err, &policyErr)
+		m.problems = append(m.problems, Problem{File: policy.File, Line: policyErr.Line, Column: policyErr.Column, Message: fmt.Sprintf("policy %s: %s", policy.Name, policyErr.Message)})
+		return false
+	}
+	return true
+}
+
+func resolvePath(base string, path string) string {
+	if filepath.IsAbs(path) || base == "" {
+		return path
+	}
+	return filepath.Join(base, path)
+}
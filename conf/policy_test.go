@@ -0,0 +1,112 @@
+package conf_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"policies/apps.hcl":        "path \"${var.mount}/data/*\" {\n  capabilities = [\"read\", \"list\"]\n}\n",
+		"policies/ops.json":        `{"path": {"${var.mount}/*": {"capabilities": ["read", "update"]}}}`,
+		"policies/README.md":       "ignored",
+		"admin.hcl":                "path \"sys/*\" {\n  capabilities = [\"sudo\"]\n}\n",
+		"config/unlocker.yaml":     "",
+		"broken/syntax.hcl":        "path \"kv/*\" {\n  capabilities = [\"read\"\n",
+		"broken/capability.hcl":    "path \"kv/*\" {\n  capabilities = [\"read\"]\n}\npath \"kv/data\" {\n  capabilities = [\"raed\"]\n}\n",
+		"broken/unknown.hcl":       "path \"kv/*\" {\n  capability = [\"read\"]\n}\n",
+		"broken/syntax.json":       "{\n  \"path\": {\n    \"kv/*\": {\"capabilities\": [\"read\",]}\n  }\n}\n",
+		"broken/capability.json":   `{"path": {"kv/*": {"capabilities": ["write"]}}}`,
+		"broken/key.hcl":           "paths \"kv/*\" {\n  capabilities = [\"read\"]\n}\n",
+		"broken/variable.hcl":      "path \"${var.team}/*\" {\n  capabilities = [\"read\"]\n}\n",
+		"broken/nested/ignore.hcl": "ignored",
+	} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		assert.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	}
+
+	// files are relative to the config file
+	cfg, err := conf.NewConfigFromFiles([]conf.File{{Path: filepath.Join(dir, "config", "unlocker.yaml"), Content: []byte(`
+provisioner:
+  policies:
+    - name: reader
+      rules: path "${var.mount}/*" { capabilities = ["read"] }
+      vars:
+        mount: kv
+    - file: ../admin.hcl
+    - name: operator
+      file: ` + filepath.Join(dir, "admin.hcl") + `
+    - dir: ../policies
+      vars:
+        mount: apps
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: web
+          policies:
+            - apps
+            - ops
+`)}})
+	assert.NoError(t, err)
+
+	policies := map[string]string{}
+	for _, p := range cfg.Provisioner.Policies {
+		policies[p.Name] = p.Rules
+	}
+	assert.Equal(t, map[string]string{
+		"reader":   `path "kv/*" { capabilities = ["read"] }`,
+		"admin":    "path \"sys/*\" {\n  capabilities = [\"sudo\"]\n}\n",
+		"operator": "path \"sys/*\" {\n  capabilities = [\"sudo\"]\n}\n",
+		"apps":     "path \"apps/data/*\" {\n  capabilities = [\"read\", \"list\"]\n}\n",
+		"ops":      `{"path": {"apps/*": {"capabilities": ["read", "update"]}}}`,
+	}, policies)
+
+	scenarios := []struct {
+		policy   string
+		expected string
+	}{
+		{policy: "file: broken/syntax.hcl", expected: "broken/syntax.hcl:3:1: policy syntax: "},
+		{policy: "file: broken/capability.hcl", expected: `broken/capability.hcl:5:19: policy capability: unknown capability "raed"`},
+		{policy: "file: broken/unknown.hcl", expected: `broken/unknown.hcl:2:3: policy unknown: unknown path setting "capability"`},
+		{policy: "file: broken/syntax.json", expected: "broken/syntax.json:3:39: policy syntax: invalid character ']'"},
+		{policy: "file: broken/capability.json", expected: `broken/capability.json: policy capability: unknown capability "write"`},
+		{policy: "file: broken/key.hcl", expected: `broken/key.hcl:1:1: policy key: unknown policy key "paths"`},
+		{policy: "file: broken/variable.hcl", expected: "broken/variable.hcl: policy variable: undefined policy variable: team"},
+		{policy: "file: missing.hcl", expected: "config.yaml:4:7: policy missing: open "},
+		{policy: "dir: missing", expected: "config.yaml:4:7: policy dir: open "},
+		{policy: `{name: inline, rules: "path \"kv\" { capabilities = [\"reed\"] }"}`, expected: `config.yaml:4:29: policy inline: 1:29: unknown capability "reed"`},
+		{policy: "{name: both, rules: x, file: admin.hcl}", expected: "policy both: set exactly one of rules, file or dir"},
+		{policy: "{name: named, dir: policies}", expected: "policy named: dir policies are named after their files"},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := conf.NewConfigFromFiles([]conf.File{{Path: filepath.Join(dir, "config.yaml"), Content: []byte(`
+provisioner:
+  policies:
+    - ` + scenario.policy + `
+`)}})
+		assert.ErrorContains(t, err, scenario.expected, scenario.policy)
+	}
+
+	_, err = conf.NewConfigFromFiles([]conf.File{{Path: filepath.Join(dir, "config.yaml"), Content: []byte(`
+provisioner:
+  policies:
+    - name: apps
+      rules: path "kv/*" { capabilities = ["read"] }
+    - dir: policies
+      vars:
+        mount: apps
+`)}})
+	assert.ErrorContains(t, err, `policies/apps.hcl: duplicate policy "apps"`)
+
+	// every broken file of a directory is reported
+	problems := conf.Validate([]conf.File{{Path: filepath.Join(dir, "config.yaml"), Content: []byte("provisioner:\n  policies:\n    - dir: broken\n")}})
+	assert.Len(t, problems, 7)
+}
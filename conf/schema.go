@@ -0,0 +1,205 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const schemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+// schemaHint carries what UnmarshalYAML checks and defaults but the types
+// can't tell, keyed by type and yaml key.
+type schemaHint struct {
+	enum     []string
+	def      interface{}
+	min      interface{}
+	max      interface{}
+	required bool
+}
+
+var schemaHints = map[string]schemaHint{
+	"Unlocker.number_keys":             {def: defaultAccessKeysNumber, min: 0, max: 5},
+	"Unlocker.url":                     {def: defaultVaultUrl},
+	"Discovery.label_selector":         {required: true},
+	"Discovery.port":                   {def: defaultDiscoveryPort, min: 0, max: 65535},
+	"Discovery.scheme":                 {enum: discoverySchemes, def: defaultDiscoveryScheme},
+	"Discovery.resync_interval":        {def: defaultDiscoveryResyncInterval.String()},
+	"Resources.resync_interval":        {def: defaultResourcesResyncInterval.String()},
+	"Metrics.address":                  {required: true},
+	"Encryption.path":                  {def: defaultEncryptionPath},
+	"Storage.type":                     {enum: storageTypes, def: defaultStorageType},
+	"BoltBD.path":                      {def: defaultBotlDBPath},
+	"FileStore.path":                   {def: defaultFileStorePath},
+	"Backup.path":                      {required: true},
+	"Backup.interval":                  {def: defaultBackupInterval.String()},
+	"Backup.keep":                      {def: defaultBackupKeep, min: 0},
+	"Backup.encryption":                {enum: backupEncryptions, def: defaultBackupEncryption},
+	"Kubernetes.access":                {enum: accessModes, def: defaultAccessKeysMode},
+	"Cluster.name":                     {required: true},
+	"FileExporter.name":                {required: true},
+	"FileExporter.path":                {required: true},
+	"FileExporter.format":              {enum: fileExportFormats, def: defaultFileExportFormat},
+	"Namespace.path":                   {required: true},
+	"AppRole.secret_id_ttl":            {min: 0},
+	"AppRole.token_ttl":                {min: 0},
+	"AppRole.token_max_ttl":            {min: 0},
+	"Auth.type":                        {enum: sortedKeys(authTypes), required: true},
+	"Entity.name":                      {required: true},
+	"Group.name":                       {required: true},
+	"Group.type":                       {enum: groupTypes, def: defaultGroupType},
+	"IdentityAlias.name":               {required: true},
+	"IdentityAlias.mount":              {required: true},
+	"Certificate.role":                 {required: true},
+	"Certificate.common_name":          {required: true},
+	"Certificate.export":               {required: true},
+	"CertificateExport.name":           {required: true},
+	"Secrets.update_policy":            {enum: updatePolicies, def: defaultUpdatePolicy},
+	"SecretExport.type":                {enum: exportSecretTypes, def: defaultExportSecretType},
+	"AppRoleExport.rotation_threshold": {def: defaultRotationThreshold, min: 0, max: 1},
+	"AppRoleExport.grace_period":       {def: defaultGracePeriod.String()},
+	"ExportMetadata.exporter":          {def: defaultExporter},
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Schema returns the JSON Schema of the config, generated from the conf types
+// and schemaHints.
+func Schema() ([]byte, error) {
+	g := &schemaGenerator{defs: map[string]interface{}{}, used: map[string]bool{}}
+
+	root := g.object(reflect.TypeOf(config{}))
+	root["$schema"] = schemaDraft
+	root["title"] = "vault-unlocker config"
+	root["$defs"] = g.defs
+
+	for key, hint := range schemaHints {
+		if !g.used[key] {
+			return nil, fmt.Errorf("schema hint for unknown field: %s", key)
+		}
+		if def, ok := hint.def.(string); ok && hint.enum != nil && !slices.Contains(hint.enum, def) {
+			return nil, fmt.Errorf("schema hint default not in enum: %s", key)
+		}
+	}
+
+	return json.MarshalIndent(root, "", "  ")
+}
+
+type schemaGenerator struct {
+	defs map[string]interface{}
+	used map[string]bool
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == durationType:
+		return map[string]interface{}{
+			"type":        []string{"string", "integer"},
+			"pattern":     `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`,
+			"description": "duration such as 30s or 5m",
+		}
+	case t.Kind() == reflect.Struct:
+		if _, ok := g.defs[t.Name()]; !ok {
+			// reserved first, namespaces reference themselves
+			g.defs[t.Name()] = nil
+			g.defs[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		if t.Elem().Kind() == reflect.Interface {
+			return map[string]interface{}{"type": "object"}
+		}
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// object describes struct t, inlined structs included, hints are looked up
+// under the type declaring the field.
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	g.properties(t, properties, &required)
+
+	object := map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		object["required"] = required
+	}
+	return object
+}
+
+func (g *schemaGenerator) properties(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			g.properties(f.Type, properties, required)
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		property := g.schema(f.Type)
+		key := t.Name() + "." + name
+		if hint, ok := schemaHints[key]; ok {
+			g.used[key] = true
+			if hint.enum != nil {
+				property["enum"] = hint.enum
+			}
+			if hint.def != nil {
+				property["default"] = hint.def
+			}
+			if hint.min != nil {
+				property["minimum"] = hint.min
+			}
+			if hint.max != nil {
+				property["maximum"] = hint.max
+			}
+			if hint.required {
+				*required = append(*required, name)
+			}
+		}
+		properties[name] = property
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
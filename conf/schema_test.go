@@ -0,0 +1,186 @@
+package conf_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestSchema(t *testing.T) {
+	generated, err := conf.Schema()
+	assert.NoError(t, err)
+
+	committed, err := os.ReadFile("../examples/config.schema.json")
+	assert.NoError(t, err)
+	assert.Equal(t, string(committed), string(generated)+"\n", "regenerate with: vault-unlocker schema > examples/config.schema.json")
+
+	var schema map[string]interface{}
+	assert.NoError(t, json.Unmarshal(generated, &schema))
+
+	example, err := os.ReadFile("../examples/config.yaml")
+	assert.NoError(t, err)
+	assert.Empty(t, schemaErrors(t, schema, example))
+
+	assert.Equal(t, []string{
+		"/provisioner/auth/0: unknown property aproles",
+		"/provisioner/auth/1/type: not one of the enum values: magic",
+		"/provisioner/mounts/0/secrets/0/update_policy: not one of the enum values: sometimes",
+		"/storage/type: not one of the enum values: postgres",
+		"/unlocker/number_keys: expected integer",
+	}, schemaErrors(t, schema, []byte(`
+unlocker:
+  number_keys: three
+storage:
+  type: postgres
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      aproles:
+        - name: web
+    - type: magic
+      path: magic
+  mounts:
+    - type: kv-v2
+      path: kv
+      secrets:
+        - path: app
+          name: db
+          update_policy: sometimes
+`)))
+}
+
+func TestSchemaEnums(t *testing.T) {
+	generated, err := conf.Schema()
+	assert.NoError(t, err)
+
+	var schema struct {
+		Defs map[string]struct {
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"$defs"`
+	}
+	assert.NoError(t, json.Unmarshal(generated, &schema))
+
+	// configs setting each enum, the second verb takes what a value requires
+	configs := map[string]string{
+		"Discovery.scheme":      "unlocker:\n  discovery:\n    label_selector: app=vault\n    scheme: %s\n%s",
+		"Storage.type":          "storage:\n  type: %s\n%s",
+		"Backup.encryption":     "storage:\n  backup:\n    path: /backups\n    encryption: %s\n%s",
+		"Kubernetes.access":     "exporter:\n  kubernetes:\n    access: %s\n%s",
+		"Cluster.access":        "exporter:\n  clusters:\n    - name: edge\n      access: %s\n%s",
+		"FileExporter.format":   "exporter:\n  files:\n    - name: local\n      path: /exports\n      format: %s\n%s",
+		"Auth.type":             "provisioner:\n  auth:\n    - path: auth\n      type: %s\n%s",
+		"Group.type":            "provisioner:\n  identity:\n    groups:\n      - name: sre\n        type: %s\n%s",
+		"Secrets.update_policy": "provisioner:\n  mounts:\n    - type: kv-v2\n      path: kv\n      secrets:\n        - path: app\n          name: db\n          update_policy: %s\n%s",
+		"SecretExport.type":     "provisioner:\n  mounts:\n    - type: kv-v2\n      path: kv\n      secrets:\n        - path: app\n          name: db\n          export:\n            namespace: apps\n            type: %s\n%s",
+	}
+	requires := map[string]string{
+		"Backup.encryption=passphrase":                     "    passphrase: s3cret\n",
+		"FileExporter.format=template":                     "      template: /etc/unlocker/env.tmpl\n",
+		"Secrets.update_policy=rotate":                     "          rotation_period: 24h\n",
+		"SecretExport.type=kubernetes.io/dockerconfigjson": "            registry: registry.example.com\n",
+	}
+
+	for def, object := range schema.Defs {
+		for property, s := range object.Properties {
+			if s.Enum == nil {
+				continue
+			}
+			key := def + "." + property
+			config, ok := configs[key]
+			if !assert.True(t, ok, "no config for enum %s", key) {
+				continue
+			}
+			for _, value := range s.Enum {
+				data := fmt.Sprintf(config, value, requires[key+"="+value])
+				_, err := conf.NewConfig([]byte(data))
+				assert.NoError(t, err, "%s=%s", key, value)
+			}
+		}
+	}
+}
+
+// schemaErrors checks content against the subset of JSON Schema generated by
+// conf.Schema.
+func schemaErrors(t *testing.T, schema map[string]interface{}, content []byte) []string {
+	var doc interface{}
+	assert.NoError(t, yaml.Unmarshal(content, &doc))
+
+	defs := schema["$defs"].(map[string]interface{})
+	var errs []string
+
+	var check func(s map[string]interface{}, value interface{}, at string)
+	check = func(s map[string]interface{}, value interface{}, at string) {
+		if ref, ok := s["$ref"].(string); ok {
+			s = defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{})
+		}
+
+		if enum, ok := s["enum"].([]interface{}); ok {
+			found := false
+			for _, e := range enum {
+				found = found || e == value
+			}
+			if !found {
+				errs = append(errs, fmt.Sprintf("%s: not one of the enum values: %v", at, value))
+			}
+		}
+
+		switch s["type"] {
+		case "object":
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				errs = append(errs, at+": expected object")
+				return
+			}
+			properties, _ := s["properties"].(map[string]interface{})
+			keys := make([]string, 0, len(m))
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				switch additional := s["additionalProperties"].(type) {
+				case bool:
+					property, known := properties[k]
+					if !known {
+						errs = append(errs, fmt.Sprintf("%s: unknown property %s", at, k))
+						continue
+					}
+					check(property.(map[string]interface{}), m[k], at+"/"+k)
+				case map[string]interface{}:
+					check(additional, m[k], at+"/"+k)
+				}
+			}
+		case "array":
+			items, ok := value.([]interface{})
+			if !ok {
+				errs = append(errs, at+": expected array")
+				return
+			}
+			for i, item := range items {
+				check(s["items"].(map[string]interface{}), item, fmt.Sprintf("%s/%d", at, i))
+			}
+		case "string":
+			if _, ok := value.(string); !ok {
+				errs = append(errs, at+": expected string")
+			}
+		case "integer":
+			if _, ok := value.(int); !ok {
+				errs = append(errs, at+": expected integer")
+			}
+		}
+	}
+
+	check(schema, doc, "")
+	sort.Strings(errs)
+	return errs
+}
@@ -0,0 +1,104 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sourcePattern matches an escaped $${, a literal ${, before the sources.
+var sourcePattern = regexp.MustCompile(`\$\$\{|\$\{(env|file|ref):([^}]*)\}`)
+
+// Source is a secret value resolved at reconcile time:
+//
+//	${env:NAME}                   environment variable of the unlocker
+//	${file:/path}                 file content, trailing new lines removed
+//	${ref:mount/path/name#key}    key of another secret stored in vault
+//
+// Sources can be the whole value or be embedded in a longer string, $${ is
+// a literal ${ and never starts a source.
+type Source struct {
+	Kind string
+	Arg  string
+	// ref only
+	Path string
+	Key  string
+}
+
+// ParseSources returns every source found in value.
+func ParseSources(value string) ([]Source, error) {
+	var sources []Source
+	for _, match := range sourcePattern.FindAllStringSubmatch(value, -1) {
+		if match[0] == "$${" {
+			continue
+		}
+		src, err := parseSource(match[1], match[2])
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", match[0], err)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// ExpandSources replaces every source of value with its resolved content.
+// A value made of a single source keeps the type returned by resolve.
+func ExpandSources(value string, resolve func(Source) (interface{}, error)) (interface{}, error) {
+	matches := sourcePattern.FindAllStringSubmatchIndex(value, -1)
+	if len(matches) == 0 {
+		return value, nil
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		if value[m[0]:m[1]] == "$${" {
+			b.WriteString(value[last:m[0]])
+			b.WriteString("${")
+			last = m[1]
+			continue
+		}
+
+		src, err := parseSource(value[m[2]:m[3]], value[m[4]:m[5]])
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", value[m[0]:m[1]], err)
+		}
+
+		resolved, err := resolve(src)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", value[m[0]:m[1]], err)
+		}
+
+		if len(matches) == 1 && m[0] == 0 && m[1] == len(value) {
+			return resolved, nil
+		}
+
+		b.WriteString(value[last:m[0]])
+		b.WriteString(fmt.Sprint(resolved))
+		last = m[1]
+	}
+	b.WriteString(value[last:])
+
+	return b.String(), nil
+}
+
+func parseSource(kind string, arg string) (Source, error) {
+	src := Source{Kind: kind, Arg: arg}
+	if arg == "" {
+		return src, fmt.Errorf("%s requires an argument", kind)
+	}
+
+	if kind != "ref" {
+		return src, nil
+	}
+
+	secretPath, key, ok := strings.Cut(arg, "#")
+	secretPath = strings.Trim(secretPath, "/")
+	if !ok || secretPath == "" || key == "" {
+		return src, fmt.Errorf("ref must be in the form mount/path#key. ref=%v", arg)
+	}
+	src.Path = secretPath
+	src.Key = key
+
+	return src, nil
+}
@@ -0,0 +1,464 @@
+package conf
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// builtinPolicies exist in every vault namespace.
+var builtinPolicies = map[string]bool{"default": true, "root": true}
+
+// authTypes are the auth methods vault can enable.
+var authTypes = map[string]bool{
+	"approle": true, "userpass": true, "kubernetes": true, "jwt": true, "oidc": true,
+	"ldap": true, "cert": true, "github": true, "aws": true, "gcp": true,
+	"azure": true, "okta": true, "radius": true,
+}
+
+var (
+	yamlLinePattern  = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+	yamlValuePattern = regexp.MustCompile("`[^`]*`")
+	obsoleteType     = reflect.TypeOf((*interface {
+		UnmarshalYAML(func(interface{}) error) error
+	})(nil)).Elem()
+)
+
+// Problem is a config error located in its source file, Line and Column are
+// 0 when unknown.
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p Problem) String() string {
+	var pos []string
+	if p.File != "" {
+		pos = append(pos, p.File)
+	}
+	if p.Line > 0 {
+		pos = append(pos, strconv.Itoa(p.Line), strconv.Itoa(p.Column))
+	}
+	if len(pos) == 0 {
+		return p.Message
+	}
+	return strings.Join(pos, ":") + ": " + p.Message
+}
+
+// ValidationError holds every problem found in a config.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		messages = append(messages, p.String())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Validate returns every problem of the config made of files: syntax errors,
+// duplicates between files, unknown keys, invalid values and semantic errors
+// such as approles referencing undefined policies.
+func Validate(files []File) []Problem {
+	_, problems := load(files)
+	return problems
+}
+
+func load(files []File) (*config, []Problem) {
+	m := &merger{origin: map[*yaml.Node]string{}, expanded: map[*yaml.Node]bool{}, dropped: map[*yaml.Node]bool{}}
+
+	var docs []*yaml.Node
+	var sources []File
+	for _, f := range files {
+		doc := &yaml.Node{}
+		err := yaml.Unmarshal(f.Content, doc)
+		if errors.Is(err, io.EOF) || (err == nil && len(doc.Content) == 0) {
+			continue
+		}
+		if err != nil {
+			m.problems = append(m.problems, yamlProblem(f.Path, err))
+			continue
+		}
+
+		node := doc.Content[0]
+		if node.Kind != yaml.MappingNode {
+			m.problems = append(m.problems, Problem{File: f.Path, Line: node.Line, Column: node.Column, Message: "config must be a mapping"})
+			continue
+		}
+		m.track(node, f.Path)
+		m.interpolate(node, "", false)
+		docs = append(docs, node)
+		sources = append(sources, f)
+	}
+
+	if len(m.problems) > 0 {
+		return nil, m.redact(m.problems)
+	}
+
+	if len(docs) == 0 {
+		return (&config{}).withDefaults(), nil
+	}
+
+	root := docs[0]
+	content := sources[0].Content
+	if len(docs) > 1 {
+		root = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, doc := range docs {
+			m.mergeMapping(root, doc)
+		}
+		if len(m.problems) > 0 {
+			return nil, m.redact(m.problems)
+		}
+	}
+
+	if len(docs) > 1 || len(m.expanded) > 0 {
+		var err error
+		content, err = yaml.Marshal(root)
+		if err != nil {
+			return nil, []Problem{{Message: err.Error()}}
+		}
+	}
+
+	// invalid values are dropped and unknown keys removed until the rest
+	// decodes, so the checks below still run and every problem is reported
+	for !m.check(root, reflect.TypeOf(config{})) {
+	}
+
+	c := &config{}
+	if len(m.problems) == 0 {
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil {
+			return nil, m.redact([]Problem{yamlProblem(sources[0].Path, err)})
+		}
+	} else if err := root.Decode(c); err != nil {
+		m.problem(root, yamlProblem("", err).Message)
+		return nil, m.redact(m.problems)
+	}
+
+	if c.Provisioner != nil {
+		m.loadPolicies(root, c.Provisioner, []interface{}{"provisioner"})
+	}
+
+	for _, p := range c.semanticProblems() {
+		if p.file != "" {
+			m.problems = append(m.problems, Problem{File: p.file, Message: p.message})
+			continue
+		}
+		m.problem(locate(root, p.path), p.message)
+	}
+	if len(m.problems) > 0 {
+		return nil, m.redact(m.problems)
+	}
+
+	return c.withDefaults(), nil
+}
+
+func yamlProblem(file string, err error) Problem {
+	message := strings.TrimPrefix(err.Error(), "yaml: ")
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		message = typeErr.Errors[0]
+	}
+
+	p := Problem{File: file, Message: message}
+	if match := yamlLinePattern.FindStringSubmatch(message); match != nil {
+		p.Line, _ = strconv.Atoi(match[1])
+		p.Message = message[len(match[0]):]
+	}
+	return p
+}
+
+// check reports unknown keys and decodes every subtree whose children are
+// valid, so each invalid value is reported at its own line and column.
+// Unknown keys are removed and invalid values dropped, check returns false
+// until a pass finds nothing left to remove.
+func (m *merger) check(node *yaml.Node, t reflect.Type) bool {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if node.Tag == "!!null" {
+		return true
+	}
+
+	ok := true
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return m.decode(node, t)
+		}
+		fields := yamlFields(t)
+		content := node.Content[:0:0]
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, known := fields[key.Value]
+			if !known {
+				m.problem(key, fmt.Sprintf("unknown field %q", key.Value))
+				ok = false
+				continue
+			}
+			content = append(content, key, value)
+			ok = m.check(value, field) && ok
+		}
+		node.Content = content
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return m.decode(node, t)
+		}
+		for _, item := range node.Content {
+			ok = m.check(item, t.Elem()) && ok
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return m.decode(node, t)
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			ok = m.check(node.Content[i+1], t.Elem()) && ok
+		}
+
+	case reflect.Interface:
+		return true
+
+	default:
+		return m.decode(node, t)
+	}
+
+	if !ok {
+		return false
+	}
+
+	if reflect.PointerTo(t).Implements(obsoleteType) {
+		return m.decode(node, t)
+	}
+
+	return true
+}
+
+func (m *merger) decode(node *yaml.Node, t reflect.Type) bool {
+	err := node.Decode(reflect.New(t).Interface())
+	if err == nil {
+		return true
+	}
+
+	// a value missing a dropped child fails because of it, already reported
+	if !m.holdsDropped(node) {
+		p := yamlProblem("", err)
+		if m.expanded[node] {
+			// yaml quotes the start of the value, which redact would miss
+			p.Message = yamlValuePattern.ReplaceAllString(p.Message, "`***`")
+		}
+		m.problem(node, p.Message)
+	}
+	m.drop(node)
+	return false
+}
+
+// drop replaces an invalid value by null, it decodes to the zero value.
+func (m *merger) drop(node *yaml.Node) {
+	node.Kind = yaml.ScalarNode
+	node.Tag = "!!null"
+	node.Value = ""
+	node.Style = 0
+	node.Content = nil
+	m.dropped[node] = true
+}
+
+func (m *merger) holdsDropped(node *yaml.Node) bool {
+	if m.dropped[node] {
+		return true
+	}
+	for _, child := range node.Content {
+		if m.holdsDropped(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// problem reports message at node, problems of dropped values follow from
+// the one that dropped them and are left out.
+func (m *merger) problem(node *yaml.Node, message string) {
+	if m.dropped[node] {
+		return
+	}
+	m.problems = append(m.problems, Problem{File: m.origin[node], Line: node.Line, Column: node.Column, Message: message})
+}
+
+// yamlFields maps the keys of struct t to their types, inlined structs
+// included.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		tag := f.Tag.Get("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if strings.Contains(opts, "inline") {
+			for k, v := range yamlFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// locate follows path (mapping keys and sequence indexes) from root, the
+// deepest node found is returned.
+func locate(root *yaml.Node, path []interface{}) *yaml.Node {
+	node := root
+	for _, step := range path {
+		var next *yaml.Node
+		switch s := step.(type) {
+		case string:
+			if node.Kind == yaml.MappingNode {
+				next = mappingValue(node, s)
+			}
+		case int:
+			if node.Kind == yaml.SequenceNode && s < len(node.Content) {
+				next = node.Content[s]
+			}
+		}
+		if next == nil {
+			return node
+		}
+		node = next
+	}
+	return node
+}
+
+// semanticProblem is located by its path in the config, or in file for
+// policies read from files.
+type semanticProblem struct {
+	path    []interface{}
+	file    string
+	message string
+}
+
+func (c *config) semanticProblems() []semanticProblem {
+	if c.Provisioner == nil {
+		return nil
+	}
+	return c.Provisioner.semanticProblems([]interface{}{"provisioner"})
+}
+
+func (p *Provisioner) semanticProblems(at []interface{}) []semanticProblem {
+	var problems []semanticProblem
+	add := func(message string, path ...interface{}) {
+		full := append(append([]interface{}{}, at...), path...)
+		problems = append(problems, semanticProblem{path: full, message: message})
+	}
+
+	policies := map[string]bool{}
+	for _, policy := range p.Policies {
+		switch {
+		case policies[policy.Name] && policy.File != "":
+			problems = append(problems, semanticProblem{file: policy.File, message: fmt.Sprintf("duplicate policy %q", policy.Name)})
+		case policies[policy.Name]:
+			add(fmt.Sprintf("duplicate policy %q", policy.Name), "policies", policy.entry, "name")
+		}
+		policies[policy.Name] = true
+	}
+	knownPolicy := func(name string) bool { return policies[name] || builtinPolicies[name] }
+
+	authPaths := map[string]bool{}
+	for i, auth := range p.Auth {
+		if !authTypes[auth.AuthType] {
+			add(fmt.Sprintf("unsupported auth type %q", auth.AuthType), "auth", i, "type")
+		}
+
+		authPath := strings.Trim(auth.Path, "/")
+		if authPaths[authPath] {
+			add(fmt.Sprintf("duplicate auth path %q", auth.Path), "auth", i, "path")
+		}
+		authPaths[authPath] = true
+
+		roles := map[string]bool{}
+		for j, role := range auth.AppRoles {
+			if roles[role.Name] {
+				add(fmt.Sprintf("duplicate approle %q", role.Name), "auth", i, "approles", j, "name")
+			}
+			roles[role.Name] = true
+
+			for k, policy := range role.PolicyNames {
+				if !knownPolicy(policy) {
+					add(fmt.Sprintf("approle %s references undefined policy %q", role.Name, policy), "auth", i, "approles", j, "policies", k)
+				}
+			}
+
+			ttls := []struct {
+				key   string
+				value int
+			}{{"secret_id_ttl", role.SecretIdTTL}, {"token_ttl", role.TokenTTL}, {"token_max_ttl", role.TokenMaxTTL}}
+			for _, ttl := range ttls {
+				if ttl.value < 0 {
+					add(fmt.Sprintf("approle %s: %s can not be negative: %d", role.Name, ttl.key, ttl.value), "auth", i, "approles", j, ttl.key)
+				}
+			}
+			if role.TokenMaxTTL > 0 && role.TokenTTL > role.TokenMaxTTL {
+				add(fmt.Sprintf("approle %s: token_ttl %d exceeds token_max_ttl %d", role.Name, role.TokenTTL, role.TokenMaxTTL), "auth", i, "approles", j, "token_ttl")
+			}
+		}
+
+		users := map[string]bool{}
+		for j, user := range auth.Users {
+			if users[user.Name] {
+				add(fmt.Sprintf("duplicate user %q", user.Name), "auth", i, "users", j, "name")
+			}
+			users[user.Name] = true
+
+			for k, policy := range user.Policies {
+				if !knownPolicy(policy) {
+					add(fmt.Sprintf("user %s references undefined policy %q", user.Name, policy), "auth", i, "users", j, "policies", k)
+				}
+			}
+		}
+	}
+
+	mountPaths := map[string]bool{}
+	for i, mount := range p.Mount {
+		mountPath := strings.Trim(mount.Path, "/")
+		if mountPaths[mountPath] {
+			add(fmt.Sprintf("duplicate mount path %q", mount.Path), "mounts", i, "path")
+		}
+		mountPaths[mountPath] = true
+
+		for j, secret := range mount.Secrets {
+			if secret.RotationPeriod < 0 {
+				add(fmt.Sprintf("secret %s: rotation_period can not be negative: %v", secret.Name, secret.RotationPeriod), "mounts", i, "secrets", j, "rotation_period")
+			}
+		}
+	}
+
+	for i, ns := range p.Namespaces {
+		problems = append(problems, ns.Provisioner.semanticProblems(append(append([]interface{}{}, at...), "namespaces", i))...)
+	}
+
+	return problems
+}
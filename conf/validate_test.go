@@ -0,0 +1,121 @@
+package conf_test
+
+import (
+	"os"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	problems := conf.Validate([]conf.File{{Path: "config.yaml", Content: []byte(`
+unlocker:
+  url: http://vault:8200
+  number_keys: 3
+  request_timeout: 5
+storage:
+  boltdb:
+    path: /tmp/db
+    timeout: 1
+provisioner:
+  policies:
+    - name: reader
+      rules: path "kv/*" { capabilities = ["read"] }
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: web
+          policies:
+            - reader
+            - writer
+          token_ttl: 3600
+          token_max_ttl: 60
+        - name: job
+          secret_id_ttl: -1
+    - type: magic
+      path: magic
+  mounts:
+    - type: kv-v2
+      path: kv
+    - type: kv-v2
+      path: kv/
+`)}})
+
+	messages := make([]string, 0, len(problems))
+	for _, p := range problems {
+		messages = append(messages, p.String())
+	}
+
+	// unknown keys, invalid values and semantic errors are reported in one run
+	assert.Equal(t, []string{
+		`config.yaml:5:3: unknown field "request_timeout"`,
+		`config.yaml:9:5: unknown field "timeout"`,
+		`config.yaml:21:15: approle web references undefined policy "writer"`,
+		`config.yaml:22:22: approle web: token_ttl 3600 exceeds token_max_ttl 60`,
+		`config.yaml:25:26: approle job: secret_id_ttl can not be negative: -1`,
+		`config.yaml:26:13: unsupported auth type "magic"`,
+		`config.yaml:32:13: duplicate mount path "kv/"`,
+	}, messages)
+
+	problems = conf.Validate([]conf.File{{Path: "config.yaml", Content: []byte(`
+unlocker:
+  number_keys: -1
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: web
+          token_ttl: [1]
+        - name: job
+          policies:
+            - writer
+`)}})
+
+	messages = messages[:0]
+	for _, p := range problems {
+		messages = append(messages, p.String())
+	}
+
+	// an invalid value drops its entry, the rest of the config is still checked
+	assert.Equal(t, []string{
+		`config.yaml:3:3: invalid number of unlock keys: -1`,
+		`config.yaml:10:22: cannot unmarshal !!seq into int`,
+		`config.yaml:13:15: approle job references undefined policy "writer"`,
+	}, messages)
+}
+
+func TestValidateValues(t *testing.T) {
+	scenarios := []struct {
+		data     string
+		expected string
+	}{
+		{
+			data:     "unlocker:\n  number_keys: -1\n",
+			expected: "config.yaml:2:3: invalid number of unlock keys: -1",
+		},
+		{
+			data:     "storage:\n  boltdb:\n    path: [a]\n",
+			expected: "config.yaml:3:11: cannot unmarshal !!seq into string",
+		},
+		{
+			data:     "unlocker:\n  url: [",
+			expected: "config.yaml:",
+		},
+	}
+
+	for _, scenario := range scenarios {
+		problems := conf.Validate([]conf.File{{Path: "config.yaml", Content: []byte(scenario.data)}})
+		if assert.Len(t, problems, 1, scenario.data) {
+			assert.Contains(t, problems[0].String(), scenario.expected)
+		}
+	}
+}
+
+func TestValidateExample(t *testing.T) {
+	content, err := os.ReadFile("../examples/config.yaml")
+	assert.NoError(t, err)
+	assert.Empty(t, conf.Validate([]conf.File{{Path: "config.yaml", Content: content}}))
+}
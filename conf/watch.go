@@ -0,0 +1,79 @@
+package conf
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce groups the burst of events a single save produces.
+const watchDebounce = 200 * time.Millisecond
+
+// WatchFile calls onChange after a config file of path (a file, directory or
+// glob as for ReadFiles) was written, replaced or renamed. The directory is
+// watched instead of the files: editors replace files, and kubernetes updates
+// ConfigMap volumes by swapping the ..data symlink. It blocks until ctx is
+// done.
+func WatchFile(ctx context.Context, path string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	path = filepath.Clean(path)
+	dir, matches := filepath.Dir(path), func(name string) bool { return name == path }
+	if strings.ContainsAny(path, "*?[") {
+		matches = func(name string) bool {
+			ok, _ := filepath.Match(path, name)
+			return ok
+		}
+	} else if info, err := os.Stat(path); err == nil && info.IsDir() {
+		dir = path
+		matches = func(name string) bool {
+			ext := filepath.Ext(name)
+			return !strings.HasPrefix(filepath.Base(name), ".") && (ext == ".yaml" || ext == ".yml")
+		}
+	}
+
+	if err := watcher.Add(dir); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(watchDebounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if !matches(filepath.Clean(event.Name)) && !strings.HasPrefix(filepath.Base(event.Name), "..data") {
+				continue
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			timer.Reset(watchDebounce)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("config watcher error, continuing...", "path", path, "err", err)
+
+		case <-timer.C:
+			onChange()
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package conf_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchFile(t *testing.T) {
+	// ConfigMap volume layout: config.yaml -> ..data/config.yaml,
+	// ..data -> ..2024_01_01
+	dir := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..2024_01_01"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "..2024_01_01", "config.yaml"), []byte("a"), 0600))
+	assert.NoError(t, os.Symlink("..2024_01_01", filepath.Join(dir, "..data")))
+	assert.NoError(t, os.Symlink(filepath.Join("..data", "config.yaml"), filepath.Join(dir, "config.yaml")))
+
+	var changes atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- conf.WatchFile(ctx, filepath.Join(dir, "config.yaml"), func() { changes.Add(1) })
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// unrelated files are ignored
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "other.yaml"), []byte("x"), 0600))
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, int32(0), changes.Load())
+
+	// kubernetes swaps the ..data symlink atomically
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "..2024_01_02"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "..2024_01_02", "config.yaml"), []byte("b"), 0600))
+	assert.NoError(t, os.Symlink("..2024_01_02", filepath.Join(dir, "..data_tmp")))
+	assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "..2024_01_01")))
+	assert.Eventually(t, func() bool { return changes.Load() == 1 }, 2*time.Second, 20*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
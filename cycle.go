@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// cycles runs one manager cycle at a time. A cycle reads, rotates and saves
+// secret-id and rotation state, two of them at once would lose rotations and
+// orphan secret-ids. Triggers arriving while a cycle runs are coalesced into
+// a single follow-up cycle, which picks up the latest config.
+//
+// cycles is also the sync.Locker held by everything else writing that state,
+// custom resources wait for the running cycle and the other way around.
+type cycles struct {
+	run func(ctx context.Context)
+
+	exclusive sync.Mutex
+	mu        sync.Mutex
+	running   bool
+	pending   bool
+	wg        sync.WaitGroup
+}
+
+var _ sync.Locker = (*cycles)(nil)
+
+// Lock waits for the running cycle, no cycle starts until Unlock.
+func (c *cycles) Lock() {
+	c.exclusive.Lock()
+}
+
+func (c *cycles) Unlock() {
+	c.exclusive.Unlock()
+}
+
+// trigger starts a cycle, or schedules one after the running cycle. Nothing
+// starts once ctx is done.
+func (c *cycles) trigger(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ctx.Err() != nil {
+		return
+	}
+	if c.running {
+		c.pending = true
+		return
+	}
+	c.running = true
+	c.wg.Add(1)
+	go c.loop(ctx)
+}
+
+func (c *cycles) loop(ctx context.Context) {
+	defer c.wg.Done()
+	for {
+		c.Lock()
+		c.run(ctx)
+		c.Unlock()
+
+		c.mu.Lock()
+		if !c.pending || ctx.Err() != nil {
+			c.running = false
+			c.mu.Unlock()
+			return
+		}
+		c.pending = false
+		c.mu.Unlock()
+	}
+}
+
+// wait blocks until the running cycle, and the one scheduled after it, are
+// done.
+func (c *cycles) wait() {
+	c.wg.Wait()
+}
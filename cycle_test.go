@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCyclesSerialized(t *testing.T) {
+	var active, maxActive, runs atomic.Int32
+	release := make(chan struct{})
+
+	c := &cycles{run: func(ctx context.Context) {
+		n := active.Add(1)
+		defer active.Add(-1)
+		for {
+			m := maxActive.Load()
+			if n <= m || maxActive.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		runs.Add(1)
+		<-release
+	}}
+
+	ctx := context.Background()
+	c.trigger(ctx)
+	assert.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, time.Millisecond)
+
+	// reloads, SIGHUP and ticks firing together while a cycle runs
+	wg := sync.WaitGroup{}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.trigger(ctx)
+		}()
+	}
+	wg.Wait()
+
+	close(release)
+	c.wait()
+
+	// they are coalesced into one follow-up cycle
+	assert.Equal(t, int32(1), maxActive.Load())
+	assert.Equal(t, int32(2), runs.Load())
+
+	// once idle, a trigger starts a cycle again
+	c.trigger(ctx)
+	c.wait()
+	assert.Equal(t, int32(3), runs.Load())
+}
+
+func TestCyclesStopWithContext(t *testing.T) {
+	var runs atomic.Int32
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &cycles{run: func(ctx context.Context) {
+		runs.Add(1)
+		cancel()
+	}}
+
+	c.trigger(ctx)
+	c.trigger(ctx)
+	c.wait()
+
+	// the follow-up is dropped once shutting down
+	assert.Equal(t, int32(1), runs.Load())
+}
+
+func TestCyclesLock(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	c := &cycles{run: func(ctx context.Context) {
+		runs.Add(1)
+		<-release
+	}}
+
+	// a custom resource reconcile holds the lock, the cycle waits for it
+	c.Lock()
+	c.trigger(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), runs.Load())
+	c.Unlock()
+	assert.Eventually(t, func() bool { return runs.Load() == 1 }, time.Second, time.Millisecond)
+
+	// and waits for the running cycle
+	locked := make(chan struct{})
+	go func() {
+		c.Lock()
+		close(locked)
+		c.Unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("lock taken while a cycle runs")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	<-locked
+	c.wait()
+}
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -28,6 +29,24 @@ func NewCrypto(path string) (*Crypto, error) {
 	return c, nil
 }
 
+// LoadCrypto loads the existing key pair at path, unlike NewCrypto it never
+// generates one. Data encrypted with a lost pair can't be read by a new one.
+func LoadCrypto(path string) (*Crypto, error) {
+	privateKeypath := filepath.Join(path, "private.pem")
+	publicKeypath := filepath.Join(path, "public.pem")
+
+	if !fileExists(privateKeypath) || !fileExists(publicKeypath) {
+		return nil, fmt.Errorf("no key pair in %s", path)
+	}
+
+	c := &Crypto{path: path}
+	if err := c.loadKeys(privateKeypath, publicKeypath); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
 func (c *Crypto) Encrypt(text string) (string, error) {
 	if c.publicKey == nil {
 		return "", errors.New("public key is not loaded")
@@ -611,4 +611,37 @@ func BenchmarkCrypto_Decrypt(b *testing.B) {
 			b.Fatalf("Decrypt failed: %v", err)
 		}
 	}
-}
\ No newline at end of file
+}
+
+// Test LoadCrypto function
+func TestLoadCrypto(t *testing.T) {
+	t.Run("LoadCrypto with existing keys", func(t *testing.T) {
+		dir := createTempDir(t)
+		defer cleanupTempDir(t, dir)
+
+		expectedPrivateKey, _ := createTestKeys(t, dir)
+
+		crypto, err := LoadCrypto(dir)
+		if err != nil {
+			t.Fatalf("LoadCrypto failed: %v", err)
+		}
+		if !crypto.privateKey.Equal(expectedPrivateKey) {
+			t.Error("Private key doesn't match expected key")
+		}
+	})
+
+	t.Run("LoadCrypto without keys", func(t *testing.T) {
+		dir := createTempDir(t)
+		defer cleanupTempDir(t, dir)
+
+		_, err := LoadCrypto(dir)
+		if err == nil {
+			t.Fatal("Expected error for missing keys, got nil")
+		}
+
+		// No key pair is generated
+		if fileExists(filepath.Join(dir, "private.pem")) || fileExists(filepath.Join(dir, "public.pem")) {
+			t.Error("LoadCrypto should not create key files")
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"context"
+	"log/slog"
+	"vault-unlocker/conf"
+)
+
+const (
+	// DefaultExporter is used by export blocks that do not name one.
+	DefaultExporter = "kubernetes"
+)
+
+// Exporter publishes secrets outside of vault.
+type Exporter interface {
+	// Read returns the exported secret, or nil when it does not exist. Data
+	// is only filled by exporters that can read it back.
+	Read(ctx context.Context, namespace string, name string) (*Secret, error)
+	Write(ctx context.Context, secret Secret) error
+	// Delete removes the exported secret, missing secrets are not an error.
+	Delete(ctx context.Context, namespace string, name string) error
+}
+
+// NewExporters builds every configured exporter by name. A kubernetes client
+// that can not be created is left out so exports using it fail on their own.
+func NewExporters(cfg *conf.Exporter) (map[string]Exporter, error) {
+	exporters := map[string]Exporter{}
+	if cfg == nil {
+		return exporters, nil
+	}
+
+	k8sClient, err := NewKubernetesClient(cfg)
+	if err != nil {
+		slog.Warn("init kubernetes client, continuing...", "err", err)
+	}
+	if k8sClient != nil {
+		exporters[DefaultExporter] = k8sClient
+	}
+
+	for _, cluster := range cfg.Clusters {
+		client, err := newKubernetesClient(&cluster.Kubernetes)
+		if err != nil {
+			slog.Warn("init kubernetes client, continuing...", "cluster", cluster.Name, "err", err)
+			continue
+		}
+		exporters[cluster.Name] = client
+	}
+
+	for _, fileCfg := range cfg.Files {
+		fileExporter, err := NewFileExporter(fileCfg)
+		if err != nil {
+			return nil, err
+		}
+		exporters[fileCfg.Name] = fileExporter
+	}
+
+	return exporters, nil
+}
@@ -0,0 +1,261 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"vault-unlocker/conf"
+)
+
+var envKeyPattern = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// FileExporter writes secrets below a directory for hosts without
+// kubernetes. Depending on the format a secret becomes:
+//
+//	files      <path>/<namespace>/<name>/<key>, one file per key
+//	env        <path>/<namespace>/<name>.env
+//	template   <path>/<namespace>/<name>, rendered with text/template
+//
+// Everything is written with 0600 permissions through an atomic rename. The
+// labels, annotations and content hash live next to it in .<name>.meta.json.
+type FileExporter struct {
+	Path     string
+	Format   string
+	Template *template.Template
+}
+
+// fileMeta is what the unlocker remembers about a written secret.
+type fileMeta struct {
+	Type        string            `json:"type,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// templateData is available to templates as the dot.
+type templateData struct {
+	Namespace   string
+	Name        string
+	Type        string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string]string
+}
+
+func NewFileExporter(cfg conf.FileExporter) (*FileExporter, error) {
+	f := &FileExporter{Path: cfg.Path, Format: cfg.Format}
+
+	if cfg.Format == "template" {
+		tpl, err := template.New(filepath.Base(cfg.Template)).Option("missingkey=error").ParseFiles(cfg.Template)
+		if err != nil {
+			return nil, fmt.Errorf("exporter %s: parse template: [%w]", cfg.Name, err)
+		}
+		f.Template = tpl
+	}
+
+	return f, nil
+}
+
+func (f *FileExporter) Read(ctx context.Context, namespace string, name string) (*Secret, error) {
+	dir := filepath.Join(f.Path, namespace)
+	meta, err := readFileMeta(dir, name)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(f.target(dir, name)); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	secret := &Secret{
+		Namespace:   namespace,
+		Name:        name,
+		Type:        meta.Type,
+		Labels:      meta.Labels,
+		Annotations: meta.Annotations,
+	}
+
+	if f.Format == "files" {
+		secret.Data = map[string][]byte{}
+		entries, err := os.ReadDir(f.target(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				content, err := os.ReadFile(filepath.Join(f.target(dir, name), entry.Name()))
+				if err != nil {
+					return nil, err
+				}
+				secret.Data[entry.Name()] = content
+			}
+		}
+	}
+
+	return secret, nil
+}
+
+// Write follows the rules of the kubernetes exporter: unchanged content is
+// skipped and files the unlocker did not write are only replaced with Force.
+func (f *FileExporter) Write(ctx context.Context, secret Secret) error {
+	dir := filepath.Join(f.Path, secret.Namespace)
+	target := f.target(dir, secret.Name)
+	hash := contentHash(secret)
+
+	meta, err := readFileMeta(dir, secret.Name)
+	if err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(target)
+	exists := statErr == nil
+
+	if exists && meta == nil && !secret.Force {
+		return fmt.Errorf("%s is not managed by %s, set force to take it over", target, ManagedByValue)
+	}
+
+	if exists && meta != nil && meta.Annotations[AnnotationContentID] == hash {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	switch f.Format {
+	case "env":
+		err = conf.WriteFileAtomic(target, renderEnv(secret.Data), 0o600)
+	case "template":
+		var buf bytes.Buffer
+		err = f.Template.Execute(&buf, templateData{
+			Namespace:   secret.Namespace,
+			Name:        secret.Name,
+			Type:        secret.Type,
+			Labels:      secret.Labels,
+			Annotations: secret.Annotations,
+			Data:        stringData(secret.Data),
+		})
+		if err != nil {
+			return fmt.Errorf("render template: [%w]", err)
+		}
+		err = conf.WriteFileAtomic(target, buf.Bytes(), 0o600)
+	default:
+		err = writeFilesAtomic(target, secret.Data)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeFileMeta(dir, secret.Name, fileMeta{
+		Type:        secret.Type,
+		Labels:      merge(secret.Labels, map[string]string{LabelManagedBy: ManagedByValue}),
+		Annotations: merge(secret.Annotations, map[string]string{AnnotationContentID: hash}),
+	})
+}
+
+func (f *FileExporter) Delete(ctx context.Context, namespace string, name string) error {
+	dir := filepath.Join(f.Path, namespace)
+	if err := os.RemoveAll(f.target(dir, name)); err != nil {
+		return err
+	}
+
+	err := os.Remove(filepath.Join(dir, "."+name+".meta.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (f *FileExporter) target(dir string, name string) string {
+	if f.Format == "env" {
+		return filepath.Join(dir, name+".env")
+	}
+	return filepath.Join(dir, name)
+}
+
+func readFileMeta(dir string, name string) (*fileMeta, error) {
+	raw, err := os.ReadFile(filepath.Join(dir, "."+name+".meta.json"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &fileMeta{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, fmt.Errorf("decode %s metadata: [%w]", name, err)
+	}
+	return meta, nil
+}
+
+func writeFileMeta(dir string, name string, meta fileMeta) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return conf.WriteFileAtomic(filepath.Join(dir, "."+name+".meta.json"), raw, 0o600)
+}
+
+// writeFilesAtomic writes one file per key and removes keys that are gone.
+func writeFilesAtomic(dir string, data map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	for key, value := range data {
+		if strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+			return fmt.Errorf("invalid file name for key: %s", key)
+		}
+		if err := conf.WriteFileAtomic(filepath.Join(dir, key), value, 0o600); err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if _, ok := data[entry.Name()]; !ok && entry.Type().IsRegular() {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renderEnv writes KEY="value" lines, keys are upper cased and every other
+// character becomes an underscore.
+func renderEnv(data map[string][]byte) []byte {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "\n", `\n`)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		envKey := envKeyPattern.ReplaceAllString(strings.ToUpper(k), "_")
+		fmt.Fprintf(&buf, "%s=\"%s\"\n", envKey, escaper.Replace(string(data[k])))
+	}
+	return buf.Bytes()
+}
+
+func stringData(data map[string][]byte) map[string]string {
+	result := make(map[string]string, len(data))
+	for k, value := range data {
+		result[k] = string(value)
+	}
+	return result
+}
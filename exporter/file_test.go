@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileExporterFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f, err := NewFileExporter(conf.FileExporter{Name: "local", Format: "files", Path: dir})
+	assert.NoError(t, err)
+
+	secret := Secret{Namespace: "apps", Name: "db", Data: map[string][]byte{"user": []byte("web"), "password": []byte("s3cret")}}
+	assert.NoError(t, f.Write(ctx, secret))
+
+	content, err := os.ReadFile(filepath.Join(dir, "apps", "db", "password"))
+	assert.NoError(t, err)
+	assert.Equal(t, "s3cret", string(content))
+
+	info, err := os.Stat(filepath.Join(dir, "apps", "db", "password"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// removed keys disappear
+	secret.Data = map[string][]byte{"password": []byte("rotated")}
+	assert.NoError(t, f.Write(ctx, secret))
+	_, err = os.Stat(filepath.Join(dir, "apps", "db", "user"))
+	assert.True(t, os.IsNotExist(err))
+
+	read, err := f.Read(ctx, "apps", "db")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"password": []byte("rotated")}, read.Data)
+	assert.Equal(t, ManagedByValue, read.Labels[LabelManagedBy])
+	assert.NotEmpty(t, read.Annotations[AnnotationContentID])
+
+	missing, err := f.Read(ctx, "apps", "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	assert.NoError(t, f.Delete(ctx, "apps", "db"))
+	read, err = f.Read(ctx, "apps", "db")
+	assert.NoError(t, err)
+	assert.Nil(t, read)
+	_, err = os.Stat(filepath.Join(dir, "apps", ".db.meta.json"))
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, f.Delete(ctx, "apps", "db"))
+}
+
+func TestFileExporterEnv(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f, err := NewFileExporter(conf.FileExporter{Name: "dotenv", Format: "env", Path: dir})
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Write(ctx, Secret{Name: "app", Data: map[string][]byte{
+		"db-password": []byte(`p"a$s`),
+		"role_id":     []byte("role"),
+	}}))
+
+	content, err := os.ReadFile(filepath.Join(dir, "app.env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "DB_PASSWORD=\"p\\\"a\\$s\"\nROLE_ID=\"role\"\n", string(content))
+}
+
+func TestFileExporterTemplate(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	tpl := filepath.Join(dir, "app.tpl")
+	assert.NoError(t, os.WriteFile(tpl, []byte(`url: postgres://{{ .Data.user }}:{{ .Data.password }}@db/{{ .Name }}`), 0o600))
+
+	f, err := NewFileExporter(conf.FileExporter{Name: "rendered", Format: "template", Path: filepath.Join(dir, "out"), Template: tpl})
+	assert.NoError(t, err)
+
+	assert.NoError(t, f.Write(ctx, Secret{Name: "app", Data: map[string][]byte{"user": []byte("web"), "password": []byte("s3cret")}}))
+
+	content, err := os.ReadFile(filepath.Join(dir, "out", "app"))
+	assert.NoError(t, err)
+	assert.Equal(t, "url: postgres://web:s3cret@db/app", string(content))
+
+	// keys missing in the data are an error, nothing is written
+	err = f.Write(ctx, Secret{Name: "other", Data: map[string][]byte{"user": []byte("web")}})
+	assert.ErrorContains(t, err, "render template")
+	_, err = os.Stat(filepath.Join(dir, "out", "other"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileExporterOwnership(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f, err := NewFileExporter(conf.FileExporter{Name: "dotenv", Format: "env", Path: dir})
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "app.env"), []byte("MINE=1\n"), 0o600))
+
+	secret := Secret{Name: "app", Data: map[string][]byte{"k": []byte("v")}}
+	assert.ErrorContains(t, f.Write(ctx, secret), "not managed by vault-unlocker")
+
+	content, err := os.ReadFile(filepath.Join(dir, "app.env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "MINE=1\n", string(content))
+
+	secret.Force = true
+	assert.NoError(t, f.Write(ctx, secret))
+	content, err = os.ReadFile(filepath.Join(dir, "app.env"))
+	assert.NoError(t, err)
+	assert.Equal(t, "K=\"v\"\n", string(content))
+}
@@ -2,13 +2,19 @@ package exporter
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"log/slog"
 	"path/filepath"
+	"strings"
 	"vault-unlocker/conf"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -16,7 +22,8 @@ import (
 )
 
 type KubernetesClient struct {
-	Client     *kubernetes.Clientset
+	Client     kubernetes.Interface
+	Dynamic    dynamic.Interface
 	AccessMode string
 }
 
@@ -26,35 +33,59 @@ func NewKubernetesClient(exporter *conf.Exporter) (*KubernetesClient, error) {
 		return nil, nil
 	}
 
-	storage := &KubernetesClient{
-		AccessMode: exporter.Kubernetes.Access,
+	return newKubernetesClient(exporter.Kubernetes)
+}
+
+func newKubernetesClient(k8sCfg *conf.Kubernetes) (*KubernetesClient, error) {
+	cfg, err := restConfig(k8sCfg)
+	if err != nil {
+		return nil, err
 	}
 
-	var cfg *rest.Config
-	var err error
+	client, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
 
-	if storage.AccessMode == "out-cluster" {
-		path := filepath.Join(homedir.HomeDir(), ".kube", "config")
-		cfg, err = clientcmd.BuildConfigFromFlags("", path)
-		if err != nil {
-			return nil, err
-		}
+	dynamicClient, err := dynamic.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	if storage.AccessMode == "in-cluster" {
-		cfg, err = rest.InClusterConfig()
-		if err != nil {
-			return nil, err
+	return &KubernetesClient{
+		Client:     client,
+		Dynamic:    dynamicClient,
+		AccessMode: k8sCfg.Access,
+	}, nil
+}
+
+func restConfig(k8sCfg *conf.Kubernetes) (*rest.Config, error) {
+	if k8sCfg.Access == "in-cluster" {
+		return rest.InClusterConfig()
+	}
+
+	if k8sCfg.Host != "" {
+		cfg := &rest.Config{
+			Host:        k8sCfg.Host,
+			BearerToken: k8sCfg.Token,
+		}
+		if strings.Contains(k8sCfg.CA, "-----BEGIN") {
+			cfg.TLSClientConfig.CAData = []byte(k8sCfg.CA)
+		} else {
+			cfg.TLSClientConfig.CAFile = k8sCfg.CA
 		}
+		return cfg, nil
 	}
 
-	client, err := kubernetes.NewForConfig(cfg)
-	if err != nil {
-		return nil, err
+	path := k8sCfg.Kubeconfig
+	if path == "" {
+		path = filepath.Join(homedir.HomeDir(), ".kube", "config")
 	}
 
-	storage.Client = client
-	return storage, nil
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: path},
+		&clientcmd.ConfigOverrides{CurrentContext: k8sCfg.Context},
+	).ClientConfig()
 }
 
 // RetrieveKeys implements storage.
@@ -74,24 +105,127 @@ func (h *KubernetesClient) ReadSecret(ctx context.Context, namespace string, nam
 	return nil
 }
 
-func (h *KubernetesClient) CreateOrUpdateSecret(ctx context.Context, namespace string, name string, data map[string][]byte) (*corev1.Secret, error) {
-	secret := &corev1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      name,
-			Namespace: namespace,
-		},
-		Data: data,
+func (h *KubernetesClient) GetSecret(ctx context.Context, namespace string, name string) (*corev1.Secret, error) {
+	return h.Client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+const (
+	LabelManagedBy      = "app.kubernetes.io/managed-by"
+	ManagedByValue      = "vault-unlocker"
+	AnnotationContentID = "vault-unlocker/content-hash"
+)
+
+// Secret is the desired state of an exported kubernetes secret, an empty
+// Type is Opaque. Force takes over secrets the unlocker did not create.
+type Secret struct {
+	Namespace   string
+	Name        string
+	Type        string
+	Labels      map[string]string
+	Annotations map[string]string
+	Data        map[string][]byte
+	Force       bool
+}
+
+// CreateOrUpdateSecret writes the secret. Labels and annotations set by other
+// tools are kept, updates whose content hash did not change are skipped and
+// secrets without the managed-by label are refused unless Force is set.
+func (h *KubernetesClient) CreateOrUpdateSecret(ctx context.Context, desired Secret) (*corev1.Secret, error) {
+	secrets := h.Client.CoreV1().Secrets(desired.Namespace)
+	hash := contentHash(desired)
+
+	existing, err := secrets.Get(ctx, desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        desired.Name,
+				Namespace:   desired.Namespace,
+				Labels:      merge(nil, desired.Labels, map[string]string{LabelManagedBy: ManagedByValue}),
+				Annotations: merge(nil, desired.Annotations, map[string]string{AnnotationContentID: hash}),
+			},
+			Type: corev1.SecretType(desired.Type),
+			Data: desired.Data,
+		}
+		return secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if existing.Labels[LabelManagedBy] != ManagedByValue && !desired.Force {
+		return nil, fmt.Errorf("secret %s/%s is not managed by %s, set force to take it over", desired.Namespace, desired.Name, ManagedByValue)
+	}
+
+	if existing.Annotations[AnnotationContentID] == hash && existing.Labels[LabelManagedBy] == ManagedByValue {
+		slog.Debug("secret up to date, skipping update", "namespace", desired.Namespace, "name", desired.Name)
+		return existing, nil
+	}
+
+	desiredType := corev1.SecretType(desired.Type)
+	if desiredType == "" {
+		desiredType = corev1.SecretTypeOpaque
+	}
+	if existing.Type != "" && existing.Type != desiredType {
+		return nil, fmt.Errorf("secret %s/%s has type %s, can not change it to %s", desired.Namespace, desired.Name, existing.Type, desiredType)
 	}
 
-	updated, err := h.Client.CoreV1().Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	existing.Labels = merge(existing.Labels, desired.Labels, map[string]string{LabelManagedBy: ManagedByValue})
+	existing.Annotations = merge(existing.Annotations, desired.Annotations, map[string]string{AnnotationContentID: hash})
+	existing.Data = desired.Data
+
+	return secrets.Update(ctx, existing, metav1.UpdateOptions{})
+}
+
+// Read implements Exporter.
+func (h *KubernetesClient) Read(ctx context.Context, namespace string, name string) (*Secret, error) {
+	secret, err := h.GetSecret(ctx, namespace, name)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
 	if err != nil {
-		if apierrors.IsNotFound(err) {
-			// Secret doesn't exist → create it
-			return h.Client.CoreV1().Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
-		}
 		return nil, err
 	}
-	return updated, nil
+
+	return &Secret{
+		Namespace:   secret.Namespace,
+		Name:        secret.Name,
+		Type:        string(secret.Type),
+		Labels:      secret.Labels,
+		Annotations: secret.Annotations,
+		Data:        secret.Data,
+	}, nil
+}
+
+// Write implements Exporter.
+func (h *KubernetesClient) Write(ctx context.Context, secret Secret) error {
+	_, err := h.CreateOrUpdateSecret(ctx, secret)
+	return err
+}
+
+// Delete implements Exporter.
+func (h *KubernetesClient) Delete(ctx context.Context, namespace string, name string) error {
+	err := h.Client.CoreV1().Secrets(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// contentHash covers everything the unlocker writes to a secret.
+func contentHash(desired Secret) string {
+	raw, _ := json.Marshal([]interface{}{desired.Type, desired.Labels, desired.Annotations, desired.Data})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func merge(maps ...map[string]string) map[string]string {
+	result := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			result[k] = v
+		}
+	}
+	return result
 }
 
 // func convertToByteMap(input map[string]interface{}) (map[string][]byte, error) {
@@ -1,5 +1,86 @@
 package exporter
 
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateOrUpdateSecretMetadata(t *testing.T) {
+	ctx := context.Background()
+	client := &KubernetesClient{Client: fake.NewSimpleClientset()}
+
+	desired := Secret{
+		Namespace:   "apps",
+		Name:        "db",
+		Labels:      map[string]string{"team": "web"},
+		Annotations: map[string]string{"reloader.stakater.com/match": "true"},
+		Data:        map[string][]byte{"password": []byte("v1")},
+	}
+
+	created, err := client.CreateOrUpdateSecret(ctx, desired)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"team": "web", LabelManagedBy: ManagedByValue}, created.Labels)
+	assert.Equal(t, "true", created.Annotations["reloader.stakater.com/match"])
+	assert.NotEmpty(t, created.Annotations[AnnotationContentID])
+
+	// metadata set by other tools survives updates
+	created.Labels["argocd.argoproj.io/instance"] = "web"
+	created.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}"
+	_, err = client.Client.CoreV1().Secrets("apps").Update(ctx, created, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	desired.Data = map[string][]byte{"password": []byte("v2")}
+	updated, err := client.CreateOrUpdateSecret(ctx, desired)
+	assert.NoError(t, err)
+	assert.Equal(t, "web", updated.Labels["argocd.argoproj.io/instance"])
+	assert.Equal(t, "{}", updated.Annotations["kubectl.kubernetes.io/last-applied-configuration"])
+	assert.Equal(t, []byte("v2"), updated.Data["password"])
+	assert.NotEqual(t, created.Annotations[AnnotationContentID], updated.Annotations[AnnotationContentID])
+
+	// same content, no update is sent
+	client.Client.(*fake.Clientset).ClearActions()
+	_, err = client.CreateOrUpdateSecret(ctx, desired)
+	assert.NoError(t, err)
+	for _, action := range client.Client.(*fake.Clientset).Actions() {
+		assert.NotEqual(t, "update", action.GetVerb())
+	}
+}
+
+func TestCreateOrUpdateSecretOwnership(t *testing.T) {
+	ctx := context.Background()
+	client := &KubernetesClient{Client: fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "foreign", Labels: map[string]string{"owner": "someone"}},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"k": []byte("original")},
+	})}
+
+	desired := Secret{Namespace: "apps", Name: "foreign", Data: map[string][]byte{"k": []byte("new")}}
+	_, err := client.CreateOrUpdateSecret(ctx, desired)
+	assert.ErrorContains(t, err, "not managed by vault-unlocker")
+
+	secret, err := client.GetSecret(ctx, "apps", "foreign")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("original"), secret.Data["k"])
+
+	desired.Force = true
+	secret, err = client.CreateOrUpdateSecret(ctx, desired)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), secret.Data["k"])
+	assert.Equal(t, ManagedByValue, secret.Labels[LabelManagedBy])
+	assert.Equal(t, "someone", secret.Labels["owner"])
+
+	_, err = client.CreateOrUpdateSecret(ctx, Secret{Namespace: "apps", Name: "foreign", Type: "kubernetes.io/tls", Data: desired.Data})
+	assert.ErrorContains(t, err, "can not change it")
+}
+
 // import (
 // 	"context"
 // 	"testing"
@@ -56,3 +137,48 @@ package exporter
 // 	t.Logf("Created secret: %v", sec)
 
 // }
+
+func TestRestConfig(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "config")
+	err := os.WriteFile(kubeconfig, []byte(`
+apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+  - name: dev
+    cluster: {server: https://dev.example.com}
+  - name: prod
+    cluster: {server: https://prod.example.com}
+users:
+  - name: admin
+    user: {token: abc}
+contexts:
+  - name: dev
+    context: {cluster: dev, user: admin}
+  - name: prod
+    context: {cluster: prod, user: admin}
+`), 0o600)
+	assert.NoError(t, err)
+
+	cfg, err := restConfig(&conf.Kubernetes{Access: "out-cluster", Kubeconfig: kubeconfig})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://dev.example.com", cfg.Host)
+
+	cfg, err = restConfig(&conf.Kubernetes{Access: "out-cluster", Kubeconfig: kubeconfig, Context: "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://prod.example.com", cfg.Host)
+	assert.Equal(t, "abc", cfg.BearerToken)
+
+	_, err = restConfig(&conf.Kubernetes{Access: "out-cluster", Kubeconfig: kubeconfig, Context: "missing"})
+	assert.Error(t, err)
+
+	cfg, err = restConfig(&conf.Kubernetes{Access: "out-cluster", Host: "https://edge:6443", Token: "t", CA: "-----BEGIN CERTIFICATE-----\n"})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://edge:6443", cfg.Host)
+	assert.Equal(t, "t", cfg.BearerToken)
+	assert.Equal(t, []byte("-----BEGIN CERTIFICATE-----\n"), cfg.TLSClientConfig.CAData)
+
+	cfg, err = restConfig(&conf.Kubernetes{Access: "out-cluster", Host: "https://edge:6443", CA: "/etc/edge/ca.crt"})
+	assert.NoError(t, err)
+	assert.Equal(t, "/etc/edge/ca.crt", cfg.TLSClientConfig.CAFile)
+}
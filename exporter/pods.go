@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// WatchPods calls handler with the name and IP of every running pod matching
+// selector: once when it starts, on every change and every resync interval.
+// It blocks until ctx is done.
+func (h *KubernetesClient) WatchPods(ctx context.Context, namespace string, selector string, resync time.Duration, handler func(name string, ip string)) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(h.Client, resync,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = selector
+		}),
+	)
+
+	notify := func(obj interface{}) {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+			return
+		}
+		handler(pod.Name, pod.Status.PodIP)
+	}
+
+	informer := factory.Core().V1().Pods().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    notify,
+		UpdateFunc: func(_, obj interface{}) { notify(obj) },
+	})
+	if err != nil {
+		return err
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) && ctx.Err() == nil {
+		return fmt.Errorf("pods informer did not sync: namespace=%s selector=%s", namespace, selector)
+	}
+	slog.Info("watching vault pods", "namespace", namespace, "selector", selector)
+
+	<-ctx.Done()
+	return nil
+}
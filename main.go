@@ -2,74 +2,232 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"vault-unlocker/conf"
+	"vault-unlocker/encryption"
 	"vault-unlocker/exporter"
+	"vault-unlocker/metrics"
 	"vault-unlocker/storage"
 	vault_manager "vault-unlocker/vault"
 )
 
 const (
 	defaultConfPath = "./examples/config.yaml"
+	// backupLockTimeout bounds the wait of backup and restore for a storage
+	// locked by a running unlocker.
+	backupLockTimeout = 5 * time.Second
 )
 
+// instance is the manager built from one config, cancel stops its watchers
+// once a newer config replaces it.
+type instance struct {
+	run    func(ctx context.Context) error
+	cancel context.CancelFunc
+}
+
 func main() {
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(validate(os.Args[2:]))
+		case "schema":
+			os.Exit(schema())
+		case "backup":
+			os.Exit(backup(os.Args[2:]))
+		case "restore":
+			os.Exit(restore(os.Args[2:]))
+		}
+	}
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelDebug,
 	}))
 
 	slog.SetDefault(logger)
 
-	var content []byte
+	var files []conf.File
 	var err error
 
-	confPath := os.Getenv("CONF_PATH")
-	if confPath == "" {
-		confPath = defaultConfPath
-	}
+	confPath := configPath()
 
-	content, err = conf.ReadFile(confPath)
+	files, err = conf.ReadFiles(confPath)
 	if err != nil {
 		slog.Warn("load config, using defaults", "err", err)
 	}
 
-	c, err := conf.NewConfig(content)
+	c, err := conf.NewConfigFromFiles(files)
 	if err != nil {
 		slog.Error("config", "err", err)
 		os.Exit(1)
 	}
 
-	store, err := storage.NewBoltDBStorage(c.Storage.BoltDB)
+	store, err := newStorage(c.Storage, c.Encryption, encryption.NewCrypto, 0)
 	if err != nil {
 		slog.Error("storage config", "err", err)
 		os.Exit(1)
 	}
+	storageConf := c.Storage
+	backupConf := c.Storage.Backup
 
-	vClient, err := vault_manager.NewVaultClient(c.Unlocker)
-	if err != nil {
-		slog.Error("init vault client", "err", err)
-		os.Exit(1)
+	var backupKey storage.BackupKey
+	var backupChan <-chan time.Time
+	if backupConf != nil {
+		backupKey, err = newBackupKey(backupConf, c.Encryption, encryption.NewCrypto)
+		if err != nil {
+			slog.Error("backup config", "err", err)
+			os.Exit(1)
+		}
+		backupTicker := time.NewTicker(backupConf.Interval)
+		defer backupTicker.Stop()
+		backupChan = backupTicker.C
 	}
 
-	k8sClient, err := exporter.NewKubernetesClient(c.Exporter)
-	if err != nil {
-		slog.Warn("init kubernetes client, continuing...", "err", err)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	var current atomic.Pointer[instance]
+
+	// ticks, reloads and SIGHUP never run two cycles at once, custom
+	// resources wait for the running cycle
+	cycle := &cycles{run: func(ctx context.Context) {
+		opCtx, cancel := context.WithTimeout(ctx, 50*time.Second)
+		defer cancel()
+		if err := current.Load().run(opCtx); err != nil {
+			slog.Error("vault manager", "err", err)
+		}
+	}}
+
+	// apply validates files and builds a new manager before swapping it in, a
+	// rejected config leaves the running one untouched.
+	apply := func(files []conf.File) error {
+		c, err := conf.NewConfigFromFiles(files)
+		if err != nil {
+			return err
+		}
+
+		if c.Storage.StorageType != storageConf.StorageType || c.Storage.BoltDB.Path != storageConf.BoltDB.Path || !reflect.DeepEqual(c.Storage.File, storageConf.File) {
+			return fmt.Errorf("storage changes require a restart: %s", c.Storage.StorageType)
+		}
+
+		if !reflect.DeepEqual(c.Storage.Backup, backupConf) {
+			return errors.New("backup changes require a restart")
+		}
+
+		vClient, err := vault_manager.NewVaultClient(c.Unlocker)
+		if err != nil {
+			return fmt.Errorf("init vault client: [%w]", err)
+		}
+
+		exporters, err := exporter.NewExporters(c.Exporter)
+		if err != nil {
+			return fmt.Errorf("exporter config: [%w]", err)
+		}
+
+		vm, err := vault_manager.NewVaultManager(c.Unlocker, c.Provisioner, vClient, store, exporters)
+		if err != nil {
+			return fmt.Errorf("unlocker config: [%w]", err)
+		}
+
+		var k8sClient *exporter.KubernetesClient
+		if c.Unlocker.Discovery != nil || c.Resources != nil {
+			var ok bool
+			k8sClient, ok = exporters[exporter.DefaultExporter].(*exporter.KubernetesClient)
+			if !ok {
+				return errors.New("discovery and custom resources require a kubernetes client")
+			}
+		}
+
+		watchCtx, cancel := context.WithCancel(ctx)
+
+		if c.Unlocker.Discovery != nil {
+			go func() {
+				if err := vm.WatchVaultPods(watchCtx, k8sClient, c.Unlocker.Discovery); err != nil {
+					slog.Error("vault pods discovery", "err", err)
+				}
+			}()
+		}
+
+		if c.Resources != nil {
+			go func() {
+				if err := vm.WatchResources(watchCtx, k8sClient.Dynamic, c.Resources, cycle); err != nil {
+					slog.Error("vault custom resources", "err", err)
+				}
+			}()
+		}
+
+		if old := current.Swap(&instance{run: vm.Run, cancel: cancel}); old != nil {
+			old.cancel()
+		}
+
+		return nil
 	}
 
-	vm, err := vault_manager.NewVaultManager(c.Unlocker, c.Provisioner, vClient, store, k8sClient)
-	if err != nil {
-		slog.Error("unlocker config", "err", err)
+	if err := apply(files); err != nil {
+		slog.Error("config", "err", err)
 		os.Exit(1)
 	}
+	metrics.ConfigLastReloadSuccess.Set("", 1)
+	metrics.ConfigLastReloadSuccessTime.Set("", float64(time.Now().Unix()))
 
-	ctx, stop := context.WithCancel(context.Background())
-	defer stop()
+	if c.Metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go func() {
+			if err := http.ListenAndServe(c.Metrics.Address, mux); err != nil {
+				slog.Error("metrics server", "address", c.Metrics.Address, "err", err)
+			}
+		}()
+	}
+
+	// reload re-reads the config files, unchanged content is only applied
+	// again when forced through SIGHUP.
+	reload := func(force bool) bool {
+		next, err := conf.ReadFiles(confPath)
+		if err == nil && !force && conf.SameFiles(next, files) {
+			slog.Debug("config unchanged, skipping reload", "path", confPath)
+			return false
+		}
+		if err == nil {
+			err = apply(next)
+		}
+		if err != nil {
+			slog.Error("config reload rejected, keeping the current config", "path", confPath, "err", err)
+			metrics.ConfigReloads.Inc("failure")
+			metrics.ConfigLastReloadSuccess.Set("", 0)
+			return false
+		}
+
+		files = next
+		slog.Info("config reloaded", "path", confPath)
+		metrics.ConfigReloads.Inc("success")
+		metrics.ConfigLastReloadSuccess.Set("", 1)
+		metrics.ConfigLastReloadSuccessTime.Set("", float64(time.Now().Unix()))
+		return true
+	}
+
+	changeChan := make(chan struct{}, 1)
+	go func() {
+		err := conf.WatchFile(ctx, confPath, func() {
+			select {
+			case changeChan <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			slog.Warn("not possible to watch config file, reload with SIGHUP, continuing...", "path", confPath, "err", err)
+		}
+	}()
 
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
@@ -77,27 +235,56 @@ func main() {
 	endChan := make(chan os.Signal, 1)
 	signal.Notify(endChan, syscall.SIGINT, syscall.SIGTERM)
 
-	if err := vm.Run(ctx); err != nil {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	cycle.Lock()
+	if err := current.Load().run(ctx); err != nil {
 		slog.Error("vault manager", "err", err)
 	}
+	cycle.Unlock()
 
 	wg := &sync.WaitGroup{}
 
+	runCycle := func() {
+		cycle.trigger(ctx)
+	}
+
+	runBackup := func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, err := storage.BackupToDir(store, backupConf.Path, backupConf.Keep, backupKey)
+			if err != nil {
+				slog.Error("storage backup", "path", backupConf.Path, "err", err)
+				metrics.Backups.Inc("failure")
+				return
+			}
+			slog.Info("storage backup written", "path", path)
+			metrics.Backups.Inc("success")
+			metrics.BackupLastSuccessTime.Set("", float64(time.Now().Unix()))
+		}()
+	}
+
 	for {
 		select {
 		case <-ticker.C:
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				opCtx, cancel := context.WithTimeout(ctx, 50*time.Second)
-				defer cancel()
-				if err := vm.Run(opCtx); err != nil {
-					slog.Error("vault manager", "err", err)
-				}
-			}()
+			runCycle()
+		case <-backupChan:
+			runBackup()
+		case <-changeChan:
+			if reload(false) {
+				runCycle()
+			}
+		case <-hupChan:
+			slog.Info("received SIGHUP, reloading config")
+			if reload(true) {
+				runCycle()
+			}
 		case <-endChan:
 			slog.Warn("received interruption signal")
 			stop()
+			cycle.wait()
 			wg.Wait()
 			return
 		case <-ctx.Done():
@@ -106,3 +293,182 @@ func main() {
 		}
 	}
 }
+
+func configPath() string {
+	if confPath := os.Getenv("CONF_PATH"); confPath != "" {
+		return confPath
+	}
+	return defaultConfPath
+}
+
+// validate prints every problem of the config at args[0], CONF_PATH by
+// default, and returns the exit code.
+func validate(args []string) int {
+	confPath := configPath()
+	if len(args) > 0 {
+		confPath = args[0]
+	}
+
+	files, err := conf.ReadFiles(confPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	problems := conf.Validate(files)
+	for _, p := range problems {
+		fmt.Println(p.String())
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+
+	fmt.Println("config is valid")
+	return 0
+}
+
+// schema prints the JSON Schema of the config.
+func schema() int {
+	content, err := conf.Schema()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println(string(content))
+	return 0
+}
+
+// backup writes an archive of the storage to args[0], or to the backup
+// directory of the config when no path is given.
+func backup(args []string) int {
+	backupConf, store, key, err := openBackupStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	var path string
+	switch {
+	case len(args) > 0:
+		path = args[0]
+		err = func() error {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return err
+			}
+			if err := storage.Backup(store, f, key); err != nil {
+				f.Close()
+				os.Remove(path)
+				return err
+			}
+			return f.Close()
+		}()
+	case backupConf != nil:
+		path, err = storage.BackupToDir(store, backupConf.Path, backupConf.Keep, key)
+	default:
+		err = errors.New("usage: backup <archive>, or set storage.backup.path")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("backup written to", path)
+	return 0
+}
+
+// restore replaces the content of the storage by the archive at args[0].
+func restore(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: restore <archive>")
+		return 1
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	_, store, key, err := openBackupStorage()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer store.Close()
+
+	created, err := storage.Restore(store, f, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	fmt.Println("storage restored from backup of", created.Format(time.RFC3339))
+	return 0
+}
+
+// openBackupStorage opens the storage of the config at CONF_PATH. A BoltDB
+// storage is locked by a running unlocker, it fails with storage.ErrInUse
+// after backupLockTimeout instead of waiting for it. The encryption key pair
+// must exist, a new one could not read the storage or the archives.
+func openBackupStorage() (*conf.Backup, storage.Storage, storage.BackupKey, error) {
+	files, err := conf.ReadFiles(configPath())
+	if err != nil {
+		return nil, nil, storage.BackupKey{}, err
+	}
+
+	c, err := conf.NewConfigFromFiles(files)
+	if err != nil {
+		return nil, nil, storage.BackupKey{}, err
+	}
+
+	key, err := newBackupKey(c.Storage.Backup, c.Encryption, encryption.LoadCrypto)
+	if err != nil {
+		return nil, nil, storage.BackupKey{}, err
+	}
+
+	store, err := newStorage(c.Storage, c.Encryption, encryption.LoadCrypto, backupLockTimeout)
+	if errors.Is(err, storage.ErrInUse) {
+		return nil, nil, storage.BackupKey{}, fmt.Errorf("%w, stop the unlocker first: %s", storage.ErrInUse, c.Storage.BoltDB.Path)
+	}
+	if err != nil {
+		return nil, nil, storage.BackupKey{}, fmt.Errorf("storage config: [%w]", err)
+	}
+
+	return c.Storage.Backup, store, key, nil
+}
+
+// newStorage opens the configured storage, an encrypted file storage wraps
+// its data key with the encryption key pair returned by newCrypto.
+func newStorage(storageConf *conf.Storage, encryptionConf *conf.Encryption, newCrypto func(string) (*encryption.Crypto, error), lockTimeout time.Duration) (storage.Storage, error) {
+	var keys storage.KeyWrapper
+	if storageConf.File != nil && storageConf.File.Encrypt {
+		crypto, err := newCrypto(encryptionConf.Path)
+		if err != nil {
+			return nil, fmt.Errorf("encryption keys: [%w]", err)
+		}
+		keys = crypto
+	}
+	return storage.NewStorage(storageConf, keys, lockTimeout)
+}
+
+// newBackupKey encrypts archives with BACKUP_PASSPHRASE when set, otherwise
+// as configured by backupConf, the key pair returned by newCrypto by default.
+func newBackupKey(backupConf *conf.Backup, encryptionConf *conf.Encryption, newCrypto func(string) (*encryption.Crypto, error)) (storage.BackupKey, error) {
+	if passphrase := os.Getenv("BACKUP_PASSPHRASE"); passphrase != "" {
+		return storage.BackupKey{Passphrase: passphrase}, nil
+	}
+
+	if backupConf != nil && backupConf.Encryption == "passphrase" {
+		return storage.BackupKey{Passphrase: backupConf.Passphrase}, nil
+	}
+
+	crypto, err := newCrypto(encryptionConf.Path)
+	if err != nil {
+		return storage.BackupKey{}, fmt.Errorf("encryption keys: [%w]", err)
+	}
+	return storage.BackupKey{Keys: crypto}, nil
+}
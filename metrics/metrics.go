@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	mu       sync.Mutex
+	registry = map[string]*Metric{}
+)
+
+var (
+	ConfigReloads = New("vault_unlocker_config_reloads_total", "Configuration reloads by result.", "counter", "result")
+
+	ConfigLastReloadSuccess = New("vault_unlocker_config_last_reload_successful", "Whether the last configuration reload was applied.", "gauge", "")
+
+	ConfigLastReloadSuccessTime = New("vault_unlocker_config_last_reload_success_timestamp_seconds", "Time of the last applied configuration.", "gauge", "")
+
+	Backups = New("vault_unlocker_backups_total", "Scheduled storage backups by result.", "counter", "result")
+
+	BackupLastSuccessTime = New("vault_unlocker_backup_last_success_timestamp_seconds", "Time of the last successful storage backup.", "gauge", "")
+)
+
+// Metric is a counter or gauge, optionally split by a single label.
+type Metric struct {
+	name   string
+	help   string
+	kind   string
+	label  string
+	values map[string]float64
+}
+
+// New registers a metric served by Handler.
+func New(name string, help string, kind string, label string) *Metric {
+	m := &Metric{name: name, help: help, kind: kind, label: label, values: map[string]float64{}}
+
+	mu.Lock()
+	defer mu.Unlock()
+	registry[name] = m
+
+	return m
+}
+
+// Inc adds one to the series of labelValue, empty without label.
+func (m *Metric) Inc(labelValue string) {
+	mu.Lock()
+	defer mu.Unlock()
+	m.values[labelValue]++
+}
+
+// Set replaces the value of the series of labelValue, empty without label.
+func (m *Metric) Set(labelValue string, value float64) {
+	mu.Lock()
+	defer mu.Unlock()
+	m.values[labelValue] = value
+}
+
+// Value returns the current value of the series of labelValue.
+func (m *Metric) Value(labelValue string) float64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return m.values[labelValue]
+}
+
+// Handler serves every registered metric in the prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(render()))
+	})
+}
+
+func render() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		m := registry[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		labels := make([]string, 0, len(m.values))
+		for l := range m.values {
+			labels = append(labels, l)
+		}
+		sort.Strings(labels)
+
+		for _, l := range labels {
+			if m.label == "" {
+				fmt.Fprintf(&b, "%s %v\n", m.name, m.values[l])
+				continue
+			}
+			fmt.Fprintf(&b, "%s{%s=%q} %v\n", m.name, m.label, l, m.values[l])
+		}
+	}
+
+	return b.String()
+}
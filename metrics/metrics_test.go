@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	reloads := New("test_reloads_total", "Reloads.", "counter", "result")
+	reloads.Inc("success")
+	reloads.Inc("failure")
+	reloads.Inc("failure")
+
+	last := New("test_last_reload_successful", "Last reload.", "gauge", "")
+	last.Set("", 0)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+
+	assert.Contains(t, string(body), "# TYPE test_reloads_total counter\n"+
+		"test_reloads_total{result=\"failure\"} 2\n"+
+		"test_reloads_total{result=\"success\"} 1\n")
+	assert.Contains(t, string(body), "# HELP test_last_reload_successful Last reload.\n"+
+		"# TYPE test_last_reload_successful gauge\n"+
+		"test_last_reload_successful 0\n")
+	assert.Equal(t, float64(2), reloads.Value("failure"))
+}
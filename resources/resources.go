@@ -0,0 +1,281 @@
+package resources
+
+import (
+	"fmt"
+	"strings"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "vault-unlocker.io"
+	Version = "v1alpha1"
+
+	KindPolicy    = "VaultPolicy"
+	KindAuthMount = "VaultAuthMount"
+	KindAppRole   = "VaultAppRole"
+	KindKVSecret  = "VaultKVSecret"
+
+	defaultAppRoleMount = "approle"
+	defaultKVSecretType = "kv-v2"
+
+	// reservedMount holds the root token and the unseal keys
+	reservedMount = "unlocker"
+)
+
+// Kinds maps every supported kind to its resource.
+var Kinds = map[string]schema.GroupVersionResource{
+	KindPolicy:    {Group: Group, Version: Version, Resource: "vaultpolicies"},
+	KindAuthMount: {Group: Group, Version: Version, Resource: "vaultauthmounts"},
+	KindAppRole:   {Group: Group, Version: Version, Resource: "vaultapproles"},
+	KindKVSecret:  {Group: Group, Version: Version, Resource: "vaultkvsecrets"},
+}
+
+// Resource is a custom resource translated to the provisioner config it
+// declares, a single policy, auth mount, approle or kv secret.
+type Resource struct {
+	Kind        string
+	Namespace   string
+	Name        string
+	Generation  int64
+	Provisioner *conf.Provisioner
+}
+
+func (r Resource) String() string {
+	return fmt.Sprintf("%s %s/%s", r.Kind, r.Namespace, r.Name)
+}
+
+// Prefix is the prefix of the policies, approles, auth mounts and kv mounts a
+// namespace owns. Namespace names can't contain a dot, so no namespace owns
+// the names of another.
+func Prefix(namespace string) string {
+	return namespace + "."
+}
+
+// FromUnstructured translates the spec of obj through the same yaml decoding
+// and validation as the config file. Exports always land in the namespace of
+// the resource through the kubernetes exporter, and every vault name must
+// start with the Prefix of the namespace, so a team can not read or write
+// anything it does not own.
+func FromUnstructured(obj *unstructured.Unstructured) (Resource, error) {
+	res := Resource{
+		Kind:       obj.GetKind(),
+		Namespace:  obj.GetNamespace(),
+		Name:       obj.GetName(),
+		Generation: obj.GetGeneration(),
+	}
+
+	spec, _, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return res, fmt.Errorf("invalid spec: [%w]", err)
+	}
+	if spec == nil {
+		spec = map[string]interface{}{}
+	}
+
+	if err := scopeExport(spec, res.Namespace); err != nil {
+		return res, err
+	}
+
+	if _, ok := spec["name"]; !ok {
+		spec["name"] = res.Name
+		if res.Kind == KindPolicy || res.Kind == KindAppRole {
+			spec["name"] = Prefix(res.Namespace) + res.Name
+		}
+	}
+
+	var fragment map[string]interface{}
+	switch res.Kind {
+	case KindPolicy:
+		for _, key := range []string{"file", "dir"} {
+			if _, ok := spec[key]; ok {
+				return res, fmt.Errorf("spec.%s not allowed in custom resources, it would read the files of the unlocker", key)
+			}
+		}
+		fragment = map[string]interface{}{"policies": []interface{}{spec}}
+
+	case KindAuthMount:
+		// users are not reconciled from custom resources
+		if _, ok := spec["users"]; ok {
+			return res, fmt.Errorf("spec.users not allowed in custom resources")
+		}
+		delete(spec, "name")
+		fragment = map[string]interface{}{"auth": []interface{}{spec}}
+
+	case KindAppRole:
+		mount := pop(spec, "mount", defaultAppRoleMount)
+		fragment = map[string]interface{}{"auth": []interface{}{map[string]interface{}{
+			"type":     "approle",
+			"path":     mount,
+			"approles": []interface{}{spec},
+		}}}
+
+	case KindKVSecret:
+		mount := pop(spec, "mount", "")
+		if mount == "" {
+			return res, fmt.Errorf("spec.mount is required")
+		}
+		if err := rejectSources(spec["data"]); err != nil {
+			return res, err
+		}
+		fragment = map[string]interface{}{"mounts": []interface{}{map[string]interface{}{
+			"type":    defaultKVSecretType,
+			"path":    mount,
+			"secrets": []interface{}{spec},
+		}}}
+
+	default:
+		return res, fmt.Errorf("kind not supported: %s", res.Kind)
+	}
+
+	raw, err := yaml.Marshal(fragment)
+	if err != nil {
+		return res, err
+	}
+
+	prov := &conf.Provisioner{}
+	if err := yaml.Unmarshal(raw, prov); err != nil {
+		return res, fmt.Errorf("invalid spec: [%w]", err)
+	}
+	for i := range prov.Policies {
+		if err := prov.Policies[i].Compile(); err != nil {
+			return res, fmt.Errorf("invalid spec.rules: [%w]", err)
+		}
+	}
+	if err := confine(res.Kind, prov, Prefix(res.Namespace)); err != nil {
+		return res, err
+	}
+	res.Provisioner = prov
+
+	return res, nil
+}
+
+// confine refuses the vault names of prov outside prefix. Policies may only
+// grant paths under prefix and approles may only bind policies of prefix, the
+// reconciler runs with the root token.
+func confine(kind string, prov *conf.Provisioner, prefix string) error {
+	owned := func(field string, name string) error {
+		if !strings.HasPrefix(strings.TrimPrefix(name, "/"), prefix) {
+			return fmt.Errorf("%s must start with %q: %s", field, prefix, name)
+		}
+		return nil
+	}
+
+	for _, policy := range prov.Policies {
+		if err := owned("spec.name", policy.Name); err != nil {
+			return err
+		}
+		paths, err := conf.PolicyPaths(policy.Rules)
+		if err != nil {
+			return fmt.Errorf("invalid spec.rules: [%w]", err)
+		}
+		for _, path := range paths {
+			if err := owned("spec.rules path", path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, auth := range prov.Auth {
+		if kind != KindAppRole || auth.Path != defaultAppRoleMount {
+			field := "spec.path"
+			if kind == KindAppRole {
+				field = "spec.mount"
+			}
+			if err := owned(field, auth.Path); err != nil {
+				return err
+			}
+		}
+		for _, role := range auth.AppRoles {
+			if err := owned("spec.name", role.Name); err != nil {
+				return err
+			}
+			for _, policy := range role.PolicyNames {
+				if err := owned("spec.policies", policy); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, mount := range prov.Mount {
+		if strings.Trim(mount.Path, "/") == reservedMount {
+			return fmt.Errorf("spec.mount %s is reserved for the unseal keys", reservedMount)
+		}
+		if err := owned("spec.mount", mount.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scopeExport(spec map[string]interface{}, namespace string) error {
+	raw, ok := spec["export"]
+	if !ok || raw == nil {
+		return nil
+	}
+
+	export, ok := raw.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("spec.export must be an object")
+	}
+
+	if exp, ok := export["exporter"]; ok && exp != exporter.DefaultExporter {
+		return fmt.Errorf("spec.export.exporter not allowed in custom resources: %v", exp)
+	}
+
+	// force would take over secrets of the namespace managed by someone else
+	if force, ok := export["force"]; ok && force != false {
+		return fmt.Errorf("spec.export.force not allowed in custom resources: %v", force)
+	}
+
+	if ns, ok := export["namespace"]; ok && ns != namespace {
+		return fmt.Errorf("spec.export.namespace must be the resource namespace %s: %v", namespace, ns)
+	}
+	export["namespace"] = namespace
+
+	return nil
+}
+
+// rejectSources refuses ${env:}, ${file:} and ${ref:} values, they would read
+// the environment and files of the unlocker or any kv secret on behalf of
+// the resource owner.
+func rejectSources(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		sources, err := conf.ParseSources(v)
+		if err != nil {
+			return err
+		}
+		if len(sources) > 0 {
+			return fmt.Errorf("secret sources are not allowed in custom resources: ${%s:%s}", sources[0].Kind, sources[0].Arg)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := rejectSources(item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := rejectSources(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func pop(spec map[string]interface{}, key string, fallback string) string {
+	value, ok := spec[key].(string)
+	delete(spec, key)
+	if !ok || value == "" {
+		return fallback
+	}
+	return value
+}
@@ -0,0 +1,206 @@
+package resources
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newResource(kind string, namespace string, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+	obj.SetAPIVersion(Group + "/" + Version)
+	obj.SetKind(kind)
+	obj.SetNamespace(namespace)
+	obj.SetName(name)
+	obj.SetGeneration(1)
+	return obj
+}
+
+func TestFromUnstructured(t *testing.T) {
+	res, err := FromUnstructured(newResource(KindPolicy, "team-a", "read-app", map[string]interface{}{
+		"rules": `path "team-a.apps/*" { capabilities = ["read"] }`,
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, "team-a.read-app", res.Provisioner.Policies[0].Name)
+
+	res, err = FromUnstructured(newResource(KindPolicy, "team-a", "read-app", map[string]interface{}{
+		"rules": `path "${var.mount}/*" { capabilities = ["read"] }`,
+		"vars":  map[string]interface{}{"mount": "team-a.apps"},
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, `path "team-a.apps/*" { capabilities = ["read"] }`, res.Provisioner.Policies[0].Rules)
+
+	res, err = FromUnstructured(newResource(KindAuthMount, "team-a", "approle", map[string]interface{}{
+		"type": "approle",
+		"path": "team-a.approle",
+	}))
+	assert.NoError(t, err)
+	assert.Equal(t, conf.Auth{AuthType: "approle", Path: "team-a.approle"}, res.Provisioner.Auth[0])
+
+	res, err = FromUnstructured(newResource(KindAppRole, "team-a", "web", map[string]interface{}{
+		"policies":      []interface{}{"team-a.read-app"},
+		"secret_id_ttl": int64(3600),
+		"export":        map[string]interface{}{},
+	}))
+	assert.NoError(t, err)
+	auth := res.Provisioner.Auth[0]
+	assert.Equal(t, "approle", auth.Path)
+	assert.Equal(t, "team-a.web", auth.AppRoles[0].Name)
+	assert.Equal(t, 3600, auth.AppRoles[0].SecretIdTTL)
+	assert.Equal(t, "team-a", auth.AppRoles[0].Export.Namespace)
+
+	res, err = FromUnstructured(newResource(KindKVSecret, "team-a", "db", map[string]interface{}{
+		"mount":  "team-a.apps",
+		"path":   "web",
+		"data":   map[string]interface{}{"password": "*random*"},
+		"export": map[string]interface{}{"namespace": "team-a"},
+	}))
+	assert.NoError(t, err)
+	mount := res.Provisioner.Mount[0]
+	assert.Equal(t, "team-a.apps", mount.Path)
+	assert.Equal(t, "kv-v2", mount.Type)
+	assert.Equal(t, "db", mount.Secrets[0].Name)
+	assert.Equal(t, "create_only", mount.Secrets[0].UpdatePolicy)
+
+	scenarios := []struct {
+		kind        string
+		spec        map[string]interface{}
+		expectedErr string
+	}{
+		{kind: "VaultToken", spec: map[string]interface{}{}, expectedErr: "kind not supported"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"data": map[string]interface{}{"k": "v"}}, expectedErr: "spec.mount is required"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "team-a.apps", "data": map[string]interface{}{"k": "${env:VAULT_TOKEN}"}}, expectedErr: "secret sources are not allowed"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "team-a.apps", "data": map[string]interface{}{"k": map[string]interface{}{"n": "x${ref:kv/root#token}"}}}, expectedErr: "secret sources are not allowed"},
+		{kind: KindAppRole, spec: map[string]interface{}{"export": map[string]interface{}{"namespace": "kube-system"}}, expectedErr: "must be the resource namespace"},
+		{kind: KindAppRole, spec: map[string]interface{}{"export": map[string]interface{}{"exporter": "compose"}}, expectedErr: "exporter not allowed"},
+		{kind: KindAppRole, spec: map[string]interface{}{"export": map[string]interface{}{"force": true}}, expectedErr: "spec.export.force not allowed"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "team-a.apps", "export": map[string]interface{}{"force": true}}, expectedErr: "spec.export.force not allowed"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "team-a.apps", "update_policy": "sometimes"}, expectedErr: "invalid spec"},
+		{kind: KindPolicy, spec: map[string]interface{}{"file": "/etc/passwd"}, expectedErr: "spec.file not allowed"},
+		{kind: KindPolicy, spec: map[string]interface{}{"rules": `path "team-a.apps/*" { capabilities = ["raed"] }`}, expectedErr: `unknown capability "raed"`},
+		{kind: KindPolicy, spec: map[string]interface{}{"rules": `path "${var.mount}/*" {}`}, expectedErr: "undefined policy variable: mount"},
+		// the root token and unseal keys live in the unlocker mount
+		{kind: KindKVSecret, spec: map[string]interface{}{"name": "keys", "mount": "unlocker", "export": map[string]interface{}{}}, expectedErr: "spec.mount unlocker is reserved"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "/unlocker/"}, expectedErr: "spec.mount unlocker is reserved"},
+		{kind: KindKVSecret, spec: map[string]interface{}{"mount": "team-b.apps"}, expectedErr: `spec.mount must start with "team-a."`},
+		// global policies and policies of other namespaces are out of reach
+		{kind: KindPolicy, spec: map[string]interface{}{"name": "default", "rules": `path "team-a.apps/*" {}`}, expectedErr: `spec.name must start with "team-a."`},
+		{kind: KindPolicy, spec: map[string]interface{}{"rules": `path "unlocker/*" { capabilities = ["read"] }`}, expectedErr: `spec.rules path must start with "team-a."`},
+		{kind: KindPolicy, spec: map[string]interface{}{"rules": `{"path": {"sys/*": {"capabilities": ["sudo"]}}}`}, expectedErr: `spec.rules path must start with "team-a."`},
+		{kind: KindPolicy, spec: map[string]interface{}{"rules": `path "+/data/*" { capabilities = ["read"] }`}, expectedErr: `spec.rules path must start with "team-a."`},
+		{kind: KindAppRole, spec: map[string]interface{}{"policies": []interface{}{"root"}, "export": map[string]interface{}{}}, expectedErr: `spec.policies must start with "team-a."`},
+		{kind: KindAppRole, spec: map[string]interface{}{"policies": []interface{}{"team-b.admin"}}, expectedErr: `spec.policies must start with "team-a."`},
+		{kind: KindAppRole, spec: map[string]interface{}{"name": "admin"}, expectedErr: `spec.name must start with "team-a."`},
+		{kind: KindAppRole, spec: map[string]interface{}{"mount": "ops"}, expectedErr: `spec.mount must start with "team-a."`},
+		{kind: KindAuthMount, spec: map[string]interface{}{"type": "userpass", "path": "team-a.users", "users": []interface{}{map[string]interface{}{"name": "ci", "pass": "x", "policies": []interface{}{"root"}}}}, expectedErr: "spec.users not allowed"},
+		// namespace team owns team., not the names of team-a
+		{kind: KindAuthMount, spec: map[string]interface{}{"type": "approle", "path": "team-a-x"}, expectedErr: `spec.path must start with "team-a."`},
+	}
+
+	for _, scenario := range scenarios {
+		_, err := FromUnstructured(newResource(scenario.kind, "team-a", "x", scenario.spec))
+		assert.ErrorContains(t, err, scenario.expectedErr, scenario.kind)
+	}
+}
+
+type recordingReconciler struct {
+	mu         sync.Mutex
+	reconciled []string
+	removed    []string
+}
+
+func (r *recordingReconciler) Reconcile(_ context.Context, res Resource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconciled = append(r.reconciled, res.String())
+	return nil
+}
+
+func (r *recordingReconciler) Remove(_ context.Context, res Resource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removed = append(r.removed, res.String())
+	return nil
+}
+
+func (r *recordingReconciler) snapshot() ([]string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.reconciled...), append([]string{}, r.removed...)
+}
+
+func TestWatch(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		Kinds[KindPolicy]:    KindPolicy + "List",
+		Kinds[KindAuthMount]: KindAuthMount + "List",
+		Kinds[KindAppRole]:   KindAppRole + "List",
+		Kinds[KindKVSecret]:  KindKVSecret + "List",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	policies := client.Resource(Kinds[KindPolicy]).Namespace("team-a")
+	_, err := policies.Create(ctx, newResource(KindPolicy, "team-a", "read-app", map[string]interface{}{"rules": "path \"team-a.apps/*\" {}"}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	_, err = client.Resource(Kinds[KindKVSecret]).Namespace("team-b").Create(ctx, newResource(KindKVSecret, "team-b", "db", map[string]interface{}{"mount": "apps"}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	reconciler := &recordingReconciler{}
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, client, &conf.Resources{Namespaces: []string{"team-a"}, ResyncInterval: time.Hour}, reconciler)
+	}()
+
+	ready := func(name string) map[string]interface{} {
+		obj, err := policies.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil
+		}
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		if len(conditions) == 0 {
+			return nil
+		}
+		return conditions[0].(map[string]interface{})
+	}
+
+	assert.Eventually(t, func() bool { return ready("read-app") != nil }, 5*time.Second, 20*time.Millisecond)
+	condition := ready("read-app")
+	assert.Equal(t, "True", condition["status"])
+	assert.Equal(t, ReasonReconciled, condition["reason"])
+
+	// invalid specs are reported without reaching the reconciler
+	_, err = policies.Create(ctx, newResource(KindPolicy, "team-a", "bad", map[string]interface{}{"rules": []interface{}{"path"}}), metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return ready("bad") != nil }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, "False", ready("bad")["status"])
+	assert.Equal(t, ReasonInvalidSpec, ready("bad")["reason"])
+
+	assert.NoError(t, policies.Delete(ctx, "read-app", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		_, removed := reconciler.snapshot()
+		return len(removed) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// team-b is not watched. The fake client keeps resource versions empty, so
+	// the status write looks like a resync, unchanged conditions stop there.
+	reconciled, removed := reconciler.snapshot()
+	assert.NotEmpty(t, reconciled)
+	assert.LessOrEqual(t, len(reconciled), 2)
+	for _, res := range reconciled {
+		assert.Equal(t, "VaultPolicy team-a/read-app", res)
+	}
+	assert.Equal(t, []string{"VaultPolicy team-a/read-app"}, removed)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
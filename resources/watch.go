@@ -0,0 +1,182 @@
+package resources
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+	"vault-unlocker/conf"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	ConditionReady = "Ready"
+
+	ReasonReconciled      = "Reconciled"
+	ReasonReconcileFailed = "ReconcileFailed"
+	ReasonInvalidSpec     = "InvalidSpec"
+)
+
+// Reconciler applies resources to vault. Reconcile is called on create, on
+// spec changes and every resync, Remove once the resource is deleted.
+type Reconciler interface {
+	Reconcile(ctx context.Context, res Resource) error
+	Remove(ctx context.Context, res Resource) error
+}
+
+// Watch reconciles every custom resource of cfg.Namespaces (all when empty)
+// and writes the outcome to its Ready condition. It blocks until ctx is done.
+func Watch(ctx context.Context, client dynamic.Interface, cfg *conf.Resources, reconciler Reconciler) error {
+	namespaces := cfg.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	kinds := make([]string, 0, len(Kinds))
+	for kind := range Kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	synced := []cache.InformerSynced{}
+	for _, ns := range namespaces {
+		factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, cfg.ResyncInterval, ns, nil)
+
+		for _, kind := range kinds {
+			gvr := Kinds[kind]
+			w := &watcher{client: client.Resource(gvr), reconciler: reconciler}
+
+			informer := factory.ForResource(gvr).Informer()
+			_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { w.reconcile(ctx, obj) },
+				UpdateFunc: w.update(ctx),
+				DeleteFunc: func(obj interface{}) { w.remove(ctx, obj) },
+			})
+			if err != nil {
+				return err
+			}
+			synced = append(synced, informer.HasSynced)
+		}
+
+		factory.Start(ctx.Done())
+		defer factory.Shutdown()
+	}
+
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) && ctx.Err() == nil {
+		return fmt.Errorf("custom resources informers did not sync: namespaces=%v", cfg.Namespaces)
+	}
+	slog.Info("watching vault custom resources", "namespaces", cfg.Namespaces)
+
+	<-ctx.Done()
+	return nil
+}
+
+type watcher struct {
+	client     dynamic.NamespaceableResourceInterface
+	reconciler Reconciler
+}
+
+// update skips status only changes, written by the watcher itself. Resyncs
+// deliver the same object twice and are reconciled.
+func (w *watcher) update(ctx context.Context) func(interface{}, interface{}) {
+	return func(oldObj interface{}, newObj interface{}) {
+		before, ok := oldObj.(*unstructured.Unstructured)
+		after, ok2 := newObj.(*unstructured.Unstructured)
+		if ok && ok2 && before.GetResourceVersion() != after.GetResourceVersion() && before.GetGeneration() == after.GetGeneration() {
+			return
+		}
+		w.reconcile(ctx, newObj)
+	}
+}
+
+func (w *watcher) reconcile(ctx context.Context, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	res, err := FromUnstructured(u)
+	if err != nil {
+		slog.Warn("invalid custom resource, continuing...", "resource", res.String(), "err", err)
+		w.setReady(ctx, u, metav1.ConditionFalse, ReasonInvalidSpec, err.Error())
+		return
+	}
+
+	if err := w.reconciler.Reconcile(ctx, res); err != nil {
+		slog.Warn("not possible to reconcile custom resource, continuing...", "resource", res.String(), "err", err)
+		w.setReady(ctx, u, metav1.ConditionFalse, ReasonReconcileFailed, err.Error())
+		return
+	}
+
+	w.setReady(ctx, u, metav1.ConditionTrue, ReasonReconciled, "applied to vault")
+}
+
+func (w *watcher) remove(ctx context.Context, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	res, err := FromUnstructured(u)
+	if err != nil {
+		// nothing was applied for an invalid spec
+		return
+	}
+
+	if err := w.reconciler.Remove(ctx, res); err != nil {
+		slog.Warn("not possible to remove custom resource exports, continuing...", "resource", res.String(), "err", err)
+	}
+}
+
+// setReady writes the Ready condition, the transition time only moves when
+// the status changes and unchanged conditions are not written again.
+func (w *watcher) setReady(ctx context.Context, u *unstructured.Unstructured, status metav1.ConditionStatus, reason string, message string) {
+	condition := map[string]interface{}{
+		"type":               ConditionReady,
+		"status":             string(status),
+		"reason":             reason,
+		"message":            message,
+		"observedGeneration": u.GetGeneration(),
+		"lastTransitionTime": time.Now().UTC().Format(time.RFC3339),
+	}
+
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	kept := []interface{}{}
+	for _, c := range conditions {
+		existing, ok := c.(map[string]interface{})
+		if !ok || existing["type"] != ConditionReady {
+			kept = append(kept, c)
+			continue
+		}
+		if existing["status"] == condition["status"] {
+			if existing["reason"] == reason && existing["message"] == message && existing["observedGeneration"] == u.GetGeneration() {
+				return
+			}
+			condition["lastTransitionTime"] = existing["lastTransitionTime"]
+		}
+	}
+
+	updated := u.DeepCopy()
+	if err := unstructured.SetNestedSlice(updated.Object, append(kept, condition), "status", "conditions"); err != nil {
+		slog.Warn("not possible to build custom resource status, continuing...", "kind", u.GetKind(), "namespace", u.GetNamespace(), "name", u.GetName(), "err", err)
+		return
+	}
+	if err := unstructured.SetNestedField(updated.Object, u.GetGeneration(), "status", "observedGeneration"); err != nil {
+		slog.Warn("not possible to build custom resource status, continuing...", "kind", u.GetKind(), "namespace", u.GetNamespace(), "name", u.GetName(), "err", err)
+		return
+	}
+
+	_, err := w.client.Namespace(u.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	if err != nil {
+		slog.Warn("not possible to update custom resource status, continuing...", "kind", u.GetKind(), "namespace", u.GetNamespace(), "name", u.GetName(), "err", err)
+	}
+}
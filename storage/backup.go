@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"vault-unlocker/conf"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	backupFormat = "vault-unlocker-backup"
+	// BackupVersion is the archive version written, Restore reads archives up
+	// to this version.
+	BackupVersion = 1
+
+	backupPassphrase = "passphrase"
+	backupRSA        = "rsa"
+	backupSuffix     = ".backup"
+)
+
+// KeyWrapper encrypts the data key of an archive, encryption.Crypto is one.
+type KeyWrapper interface {
+	Encrypt(text string) (string, error)
+	Decrypt(encoded string) (string, error)
+}
+
+// BackupKey encrypts an archive with a key derived from Passphrase or, when
+// empty, with a random key wrapped by Keys.
+type BackupKey struct {
+	Passphrase string
+	Keys       KeyWrapper
+}
+
+// backupHeader is stored in clear and authenticated with the ciphertext, so
+// the version and checksum can't be altered.
+type backupHeader struct {
+	Format     string    `json:"format"`
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	Encryption string    `json:"encryption"`
+	Salt       []byte    `json:"salt,omitempty"`
+	WrappedKey string    `json:"wrapped_key,omitempty"`
+	Nonce      []byte    `json:"nonce"`
+	// SHA256 is the checksum of the plain tables
+	SHA256 string `json:"sha256"`
+}
+
+type backupArchive struct {
+	Header     backupHeader `json:"header"`
+	Ciphertext []byte       `json:"ciphertext"`
+}
+
+// backupTables holds every key of every table.
+type backupTables map[string]map[string][]byte
+
+// Backup writes every table of s, read in a single transaction, to w as an
+// encrypted archive.
+func Backup(s Storage, w io.Writer, key BackupKey) error {
+	tables := backupTables{}
+	err := s.View(func(tx Tx) error {
+		for _, table := range Tables {
+			keys, err := tx.List(table, "")
+			if err != nil {
+				return err
+			}
+			tables[table] = map[string][]byte{}
+			for _, k := range keys {
+				value, err := tx.Get(table, k)
+				if err != nil {
+					return err
+				}
+				tables[table][k] = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("read storage: [%w]", err)
+	}
+
+	plain, err := json.Marshal(tables)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(plain)
+
+	header := backupHeader{
+		Format:  backupFormat,
+		Version: BackupVersion,
+		Created: time.Now().UTC(),
+		SHA256:  hex.EncodeToString(sum[:]),
+		Nonce:   make([]byte, 12),
+	}
+	if _, err := rand.Read(header.Nonce); err != nil {
+		return err
+	}
+
+	dataKey, err := header.newDataKey(key)
+	if err != nil {
+		return err
+	}
+
+	aead, aad, err := header.cipher(dataKey)
+	if err != nil {
+		return err
+	}
+
+	archive := backupArchive{Header: header, Ciphertext: aead.Seal(nil, header.Nonce, plain, aad)}
+	return json.NewEncoder(w).Encode(archive)
+}
+
+// Restore replaces the content of s by the archive read from r in a single
+// transaction. The archive is checked before anything is written.
+func Restore(s Storage, r io.Reader, key BackupKey) (time.Time, error) {
+	var archive backupArchive
+	if err := json.NewDecoder(r).Decode(&archive); err != nil {
+		return time.Time{}, fmt.Errorf("read archive: [%w]", err)
+	}
+
+	header := archive.Header
+	if header.Format != backupFormat {
+		return time.Time{}, errors.New("not a vault-unlocker backup")
+	}
+	if header.Version < 1 || header.Version > BackupVersion {
+		return time.Time{}, fmt.Errorf("unsupported backup version %d, this build reads up to %d", header.Version, BackupVersion)
+	}
+
+	dataKey, err := header.dataKey(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	aead, aad, err := header.cipher(dataKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	plain, err := aead.Open(nil, header.Nonce, archive.Ciphertext, aad)
+	if err != nil {
+		return time.Time{}, errors.New("decrypt archive: wrong key or corrupted archive")
+	}
+
+	sum := sha256.Sum256(plain)
+	if hex.EncodeToString(sum[:]) != header.SHA256 {
+		return time.Time{}, errors.New("archive checksum mismatch")
+	}
+
+	var tables backupTables
+	if err := json.Unmarshal(plain, &tables); err != nil {
+		return time.Time{}, fmt.Errorf("decode archive: [%w]", err)
+	}
+	for table := range tables {
+		if !slices.Contains(Tables, table) {
+			return time.Time{}, fmt.Errorf("archive holds unknown table: %s", table)
+		}
+	}
+
+	err = s.Update(func(tx Tx) error {
+		for _, table := range Tables {
+			keys, err := tx.List(table, "")
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				if err := tx.Delete(table, k); err != nil {
+					return err
+				}
+			}
+			for k, value := range tables[table] {
+				if err := tx.Put(table, k, value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("write storage: [%w]", err)
+	}
+
+	return header.Created, nil
+}
+
+// BackupToDir writes an archive named after the current time in dir and
+// removes the oldest archives beyond keep, 0 keeping all of them. The archive
+// is written to a temporary file first so a failed backup leaves no partial
+// archive behind.
+func BackupToDir(s Storage, dir string, keep int, key BackupKey) (string, error) {
+	if err := ensurePath(dir); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := Backup(s, &buf, key); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000Z")+backupSuffix)
+	if err := conf.WriteFileAtomic(path, buf.Bytes(), 0600); err != nil {
+		return "", fmt.Errorf("write archive: [%w]", err)
+	}
+
+	if keep > 0 {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return path, err
+		}
+		var archives []string
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), backupSuffix) {
+				archives = append(archives, entry.Name())
+			}
+		}
+		sort.Strings(archives)
+		for len(archives) > keep {
+			if err := os.Remove(filepath.Join(dir, archives[0])); err != nil {
+				slog.Warn("not possible to remove old backup, continuing...", "path", archives[0], "err", err)
+			}
+			archives = archives[1:]
+		}
+	}
+
+	return path, nil
+}
+
+// newDataKey creates the data key of a new archive and records in h how to
+// get it back.
+func (h *backupHeader) newDataKey(key BackupKey) ([]byte, error) {
+	if key.Passphrase != "" {
+		h.Encryption = backupPassphrase
+		h.Salt = make([]byte, 16)
+		if _, err := rand.Read(h.Salt); err != nil {
+			return nil, err
+		}
+		return h.dataKey(key)
+	}
+
+	if key.Keys == nil {
+		return nil, errors.New("backup requires a passphrase or an encryption key")
+	}
+	h.Encryption = backupRSA
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := key.Keys.Encrypt(string(dataKey))
+	if err != nil {
+		return nil, fmt.Errorf("wrap archive key: [%w]", err)
+	}
+	h.WrappedKey = wrapped
+	return dataKey, nil
+}
+
+func (h *backupHeader) dataKey(key BackupKey) ([]byte, error) {
+	switch h.Encryption {
+	case backupPassphrase:
+		if key.Passphrase == "" {
+			return nil, errors.New("archive is encrypted with a passphrase")
+		}
+		return scrypt.Key([]byte(key.Passphrase), h.Salt, 1<<15, 8, 1, 32)
+	case backupRSA:
+		if key.Keys == nil {
+			return nil, errors.New("archive is encrypted with the encryption key pair")
+		}
+		dataKey, err := key.Keys.Decrypt(h.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("unwrap archive key: [%w]", err)
+		}
+		return []byte(dataKey), nil
+	default:
+		return nil, fmt.Errorf("unknown archive encryption: %s", h.Encryption)
+	}
+}
+
+// cipher returns the AES-GCM cipher of dataKey and the header it
+// authenticates.
+func (h *backupHeader) cipher(dataKey []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(h.Nonce) != aead.NonceSize() {
+		return nil, nil, errors.New("invalid archive nonce")
+	}
+	aad, err := json.Marshal(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, aad, nil
+}
@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+	"vault-unlocker/encryption"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestBolt(t *testing.T, data map[string]map[string]string) *BoltBDStorage {
+	store, err := NewBoltDBStorage(&conf.BoltBD{Path: filepath.Join(t.TempDir(), "bolt.db")}, 0)
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	for table, values := range data {
+		for key, value := range values {
+			assert.NoError(t, store.Put(table, key, []byte(value)))
+		}
+	}
+	return store
+}
+
+func dump(t *testing.T, s Storage) map[string]map[string]string {
+	data := map[string]map[string]string{}
+	for _, table := range Tables {
+		keys, err := s.List(table, "")
+		assert.NoError(t, err)
+		for _, key := range keys {
+			value, err := s.Get(table, key)
+			assert.NoError(t, err)
+			if data[table] == nil {
+				data[table] = map[string]string{}
+			}
+			data[table][key] = string(value)
+		}
+	}
+	return data
+}
+
+func TestBackupRestore(t *testing.T) {
+	data := map[string]map[string]string{
+		"keys":     {"token": "root", "0": "k0", "1": "k1"},
+		"secrets":  {"kv/app": "hash"},
+		"approles": {"web": "2026-01-01T00:00:00Z"},
+	}
+	source := newTestBolt(t, data)
+
+	crypto, err := encryption.NewCrypto(t.TempDir())
+	assert.NoError(t, err)
+
+	for name, key := range map[string]BackupKey{
+		"passphrase": {Passphrase: "correct horse"},
+		"rsa":        {Keys: crypto},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var archive bytes.Buffer
+			assert.NoError(t, Backup(source, &archive, key))
+			assert.NotContains(t, archive.String(), "root")
+
+			// the restored store holds exactly the archived keys
+			target := newTestBolt(t, map[string]map[string]string{"keys": {"token": "other", "2": "k2"}, "exports": {"e": "x"}})
+			_, err := Restore(target, bytes.NewReader(archive.Bytes()), key)
+			assert.NoError(t, err)
+			assert.Equal(t, data, dump(t, target))
+		})
+	}
+
+	var archive bytes.Buffer
+	assert.NoError(t, Backup(source, &archive, BackupKey{Passphrase: "correct horse"}))
+
+	tamper := func(edit func(a map[string]interface{})) []byte {
+		var a map[string]interface{}
+		assert.NoError(t, json.Unmarshal(archive.Bytes(), &a))
+		edit(a)
+		out, err := json.Marshal(a)
+		assert.NoError(t, err)
+		return out
+	}
+	header := func(a map[string]interface{}) map[string]interface{} {
+		return a["header"].(map[string]interface{})
+	}
+
+	scenarios := []struct {
+		name     string
+		archive  []byte
+		key      BackupKey
+		expected string
+	}{
+		{name: "wrong passphrase", archive: archive.Bytes(), key: BackupKey{Passphrase: "wrong"}, expected: "wrong key or corrupted archive"},
+		{name: "missing passphrase", archive: archive.Bytes(), key: BackupKey{Keys: crypto}, expected: "encrypted with a passphrase"},
+		{name: "newer version", archive: tamper(func(a map[string]interface{}) { header(a)["version"] = 2 }), key: BackupKey{Passphrase: "correct horse"}, expected: "unsupported backup version 2"},
+		{name: "altered header", archive: tamper(func(a map[string]interface{}) { header(a)["created"] = "2020-01-01T00:00:00Z" }), key: BackupKey{Passphrase: "correct horse"}, expected: "wrong key or corrupted archive"},
+		{name: "altered ciphertext", archive: tamper(func(a map[string]interface{}) { a["ciphertext"] = "AAAA" + a["ciphertext"].(string)[4:] }), key: BackupKey{Passphrase: "correct horse"}, expected: "wrong key or corrupted archive"},
+		{name: "not an archive", archive: []byte(`{"header":{"format":"other"}}`), expected: "not a vault-unlocker backup"},
+	}
+
+	for _, scenario := range scenarios {
+		target := newTestBolt(t, map[string]map[string]string{"keys": {"token": "kept"}})
+		_, err := Restore(target, bytes.NewReader(scenario.archive), scenario.key)
+		assert.ErrorContains(t, err, scenario.expected, scenario.name)
+		// nothing is written when the archive is rejected
+		assert.Equal(t, map[string]map[string]string{"keys": {"token": "kept"}}, dump(t, target), scenario.name)
+	}
+}
+
+func TestBackupToDir(t *testing.T) {
+	source := newTestBolt(t, map[string]map[string]string{"keys": {"token": "root"}})
+	dir := filepath.Join(t.TempDir(), "backups")
+	key := BackupKey{Passphrase: "secret"}
+
+	var paths []string
+	for range 4 {
+		path, err := BackupToDir(source, dir, 2, key)
+		assert.NoError(t, err)
+		paths = append(paths, path)
+	}
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, filepath.Base(paths[2]), entries[0].Name())
+	assert.Equal(t, filepath.Base(paths[3]), entries[1].Name())
+
+	info, err := os.Stat(paths[3])
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
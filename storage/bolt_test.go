@@ -1,9 +1,11 @@
 package storage
 
 import (
+	"errors"
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 	"vault-unlocker/conf"
 
 	"github.com/stretchr/testify/assert"
@@ -24,7 +26,7 @@ storage:
 		panic(err)
 	}
 
-	boltDB, err = NewBoltDBStorage(cfg.Storage.BoltDB)
+	boltDB, err = NewBoltDBStorage(cfg.Storage.BoltDB, 0)
 	if err != nil {
 		panic(err)
 	}
@@ -46,13 +48,85 @@ storage:
 }
 
 func TestBoltDB(t *testing.T) {
-	err := boltDB.InsertKeyValue("keys", "0", "somerandomkey")
+	err := boltDB.Put("keys", "0", []byte("somerandomkey"))
 	assert.NoError(t, err)
 
-	value, err := boltDB.RetrieveKey("keys", "0")
+	value, err := boltDB.Get("keys", "0")
 	assert.NoError(t, err)
-	assert.Equal(t, "somerandomkey", value)
+	assert.Equal(t, []byte("somerandomkey"), value)
 
-	_, err = boltDB.RetrieveKey("keys", "1")
-	assert.ErrorContains(t, err, "not found")
+	_, err = boltDB.Get("keys", "1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = boltDB.Get("users", "0")
+	assert.ErrorContains(t, err, "unknown table")
+
+	for _, key := range []string{"apps/web/db", "apps/web/cache", "apps/api/db", "infra/dns"} {
+		assert.NoError(t, boltDB.Put("secrets", key, []byte(key)))
+	}
+	keys, err := boltDB.List("secrets", "apps/web/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apps/web/cache", "apps/web/db"}, keys)
+
+	assert.NoError(t, boltDB.Delete("secrets", "apps/web/db"))
+	assert.NoError(t, boltDB.Delete("secrets", "apps/web/db"))
+	keys, err = boltDB.List("secrets", "apps/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"apps/api/db", "apps/web/cache"}, keys)
+}
+
+func TestBoltDBCompareAndSwap(t *testing.T) {
+	assert.NoError(t, boltDB.CompareAndSwap("approles", "cas", nil, []byte("v1")))
+	assert.ErrorIs(t, boltDB.CompareAndSwap("approles", "cas", nil, []byte("v2")), ErrConflict)
+	assert.ErrorIs(t, boltDB.CompareAndSwap("approles", "cas", []byte("v0"), []byte("v2")), ErrConflict)
+	assert.NoError(t, boltDB.CompareAndSwap("approles", "cas", []byte("v1"), []byte("v2")))
+
+	value, err := boltDB.Get("approles", "cas")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestBoltDBUpdate(t *testing.T) {
+	// a failing transaction writes nothing
+	err := boltDB.Update(func(tx Tx) error {
+		for _, key := range []string{"token", "0", "1"} {
+			if err := tx.Put("exports", "tx/"+key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return errors.New("crash")
+	})
+	assert.EqualError(t, err, "crash")
+
+	keys, err := boltDB.List("exports", "tx/")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+
+	err = boltDB.Update(func(tx Tx) error {
+		for _, key := range []string{"token", "0", "1"} {
+			if err := tx.Put("exports", "tx/"+key, []byte(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = boltDB.View(func(tx Tx) error {
+		keys, err := tx.List("exports", "tx/")
+		assert.Equal(t, []string{"tx/0", "tx/1", "tx/token"}, keys)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = boltDB.View(func(tx Tx) error {
+		return tx.Put("exports", "tx/2", []byte("2"))
+	})
+	assert.Error(t, err)
+}
+
+func TestBoltDBInUse(t *testing.T) {
+	// boltDB holds the lock of the database, as a running unlocker does
+	_, err := NewBoltDBStorage(&conf.BoltBD{Path: boltDB.path}, 50*time.Millisecond)
+	assert.ErrorIs(t, err, ErrInUse)
 }
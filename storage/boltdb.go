@@ -1,12 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/user"
 	"strings"
+	"time"
 	"vault-unlocker/conf"
 
 	"go.etcd.io/bbolt"
@@ -17,12 +19,10 @@ type BoltBDStorage struct {
 	db   *bbolt.DB
 }
 
-// UpdateKeys implements Storage.
-func (b *BoltBDStorage) UpdateKeys() {
-	panic("unimplemented")
-}
-
-func NewBoltDBStorage(boltConf *conf.BoltBD) (*BoltBDStorage, error) {
+// NewBoltDBStorage opens the database at boltConf.Path. BoltDB locks the file
+// while open, ErrInUse is returned when it is still locked after lockTimeout,
+// zero waits forever.
+func NewBoltDBStorage(boltConf *conf.BoltBD, lockTimeout time.Duration) (*BoltBDStorage, error) {
 
 	parts := strings.Split(boltConf.Path, "/")
 	path := strings.Join(parts[:len(parts)-1], "/")
@@ -32,20 +32,26 @@ func NewBoltDBStorage(boltConf *conf.BoltBD) (*BoltBDStorage, error) {
 		return nil, fmt.Errorf("initializing boldDB directory: [%w]", err)
 	}
 
-	db, err := bbolt.Open(boltConf.Path, 0666, nil)
+	db, err := bbolt.Open(boltConf.Path, 0666, &bbolt.Options{Timeout: lockTimeout})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s: [%w]", boltConf.Path, ErrInUse)
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// Create bucket if not exists
-	for _, bucketName := range bucketsName {
-		err = db.Update(func(tx *bbolt.Tx) error {
-			_, err := tx.CreateBucketIfNotExists([]byte(bucketName))
-			return err
-		})
-		if err != nil {
-			return nil, err
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucketName := range Tables {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucketName)); err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
 
 	bolt := BoltBDStorage{
@@ -58,29 +64,122 @@ func NewBoltDBStorage(boltConf *conf.BoltBD) (*BoltBDStorage, error) {
 
 var _ Storage = (*BoltBDStorage)(nil)
 
-var bucketsName = []string{"users", "keys"}
+func (b *BoltBDStorage) Get(table string, key string) ([]byte, error) {
+	var value []byte
+	err := b.View(func(tx Tx) error {
+		var err error
+		value, err = tx.Get(table, key)
+		return err
+	})
+	return value, err
+}
 
-func (b *BoltBDStorage) InsertKeyValue(table string, key string, data string) error {
-	return b.db.Update(func(tx *bbolt.Tx) error {
-		slog.Info("insert key in boldtd", "table", table, "key", key)
-		b := tx.Bucket([]byte(table))
-		return b.Put([]byte(key), []byte(data))
+func (b *BoltBDStorage) Put(table string, key string, value []byte) error {
+	return b.Update(func(tx Tx) error {
+		return tx.Put(table, key, value)
+	})
+}
+
+func (b *BoltBDStorage) Delete(table string, key string) error {
+	return b.Update(func(tx Tx) error {
+		return tx.Delete(table, key)
 	})
 }
 
-// RetrieveKeys implements Storage.
-func (b *BoltBDStorage) RetrieveKey(table string, key string) (string, error) {
-	var data []byte
+func (b *BoltBDStorage) List(table string, prefix string) ([]string, error) {
+	var keys []string
+	err := b.View(func(tx Tx) error {
+		var err error
+		keys, err = tx.List(table, prefix)
+		return err
+	})
+	return keys, err
+}
 
-	err := b.db.View(func(tx *bbolt.Tx) error {
-		b := tx.Bucket([]byte(table))
-		data = b.Get([]byte(key))
-		if data == nil {
-			return errors.New("key not found")
+func (b *BoltBDStorage) CompareAndSwap(table string, key string, old []byte, value []byte) error {
+	return b.Update(func(tx Tx) error {
+		current, err := tx.Get(table, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
 		}
-		return nil
+		if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+			return ErrConflict
+		}
+		return tx.Put(table, key, value)
+	})
+}
+
+func (b *BoltBDStorage) View(fn func(tx Tx) error) error {
+	return b.db.View(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
 	})
-	return string(data), err
+}
+
+func (b *BoltBDStorage) Update(fn func(tx Tx) error) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *BoltBDStorage) Close() error {
+	return b.db.Close()
+}
+
+// boltTx maps tables to buckets, values are copied out since bbolt only
+// keeps them valid during the transaction.
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t boltTx) bucket(table string) (*bbolt.Bucket, error) {
+	bucket := t.tx.Bucket([]byte(table))
+	if bucket == nil {
+		return nil, fmt.Errorf("unknown table: %s", table)
+	}
+	return bucket, nil
+}
+
+func (t boltTx) Get(table string, key string) ([]byte, error) {
+	bucket, err := t.bucket(table)
+	if err != nil {
+		return nil, err
+	}
+	value := bucket.Get([]byte(key))
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	return bytes.Clone(value), nil
+}
+
+func (t boltTx) Put(table string, key string, value []byte) error {
+	bucket, err := t.bucket(table)
+	if err != nil {
+		return err
+	}
+	slog.Info("insert key in boltdb", "table", table, "key", key)
+	return bucket.Put([]byte(key), value)
+}
+
+func (t boltTx) Delete(table string, key string) error {
+	bucket, err := t.bucket(table)
+	if err != nil {
+		return err
+	}
+	return bucket.Delete([]byte(key))
+}
+
+func (t boltTx) List(table string, prefix string) ([]string, error) {
+	bucket, err := t.bucket(table)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	c := bucket.Cursor()
+	for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys, nil
 }
 
 func ensurePath(path string) error {
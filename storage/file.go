@@ -0,0 +1,467 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"vault-unlocker/conf"
+)
+
+const (
+	fileLock    = ".lock"
+	fileTxLog   = ".txlog"
+	fileDataKey = ".datakey"
+)
+
+// FileStorage keeps every key in its own file under dir/<table>/, so the
+// directory can live on a read-only root filesystem volume or be shared over
+// NFS. Writes replace files atomically, an Update touching several keys goes
+// through a synced transaction log replayed after a crash. Processes sharing
+// dir are serialized by an advisory lock on dir/.lock.
+type FileStorage struct {
+	dir  string
+	mu   sync.Mutex
+	lock *os.File
+	// aead encrypts the values when the storage is encrypted, its key is
+	// stored in dir/.datakey wrapped by the encryption key pair
+	aead cipher.AEAD
+}
+
+// fileOp is a write of a transaction, a nil Value deleting the key.
+type fileOp struct {
+	Table string `json:"table"`
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// NewFileStorage opens the storage at fileConf.Path, its values are
+// encrypted with a data key wrapped by keys when fileConf.Encrypt is set.
+func NewFileStorage(fileConf *conf.FileStore, keys KeyWrapper) (*FileStorage, error) {
+	for _, table := range Tables {
+		if err := ensurePath(filepath.Join(fileConf.Path, table)); err != nil {
+			return nil, fmt.Errorf("initializing file storage directory: [%w]", err)
+		}
+	}
+
+	lock, err := os.OpenFile(filepath.Join(fileConf.Path, fileLock), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open file storage lock: [%w]", err)
+	}
+
+	f := &FileStorage{dir: fileConf.Path, lock: lock}
+
+	if err := f.acquire(true); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	err = f.setupEncryption(fileConf.Encrypt, keys)
+	f.release()
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *FileStorage) setupEncryption(encrypt bool, keys KeyWrapper) error {
+	if !encrypt {
+		if _, err := os.Stat(filepath.Join(f.dir, fileDataKey)); err == nil {
+			return errors.New("file storage is encrypted, enable encrypt")
+		}
+		return nil
+	}
+
+	if keys == nil {
+		return errors.New("file storage encryption requires the encryption key pair")
+	}
+	var err error
+	f.aead, err = f.loadDataKey(keys)
+	return err
+}
+
+var _ Storage = (*FileStorage)(nil)
+
+func (f *FileStorage) Get(table string, key string) ([]byte, error) {
+	var value []byte
+	err := f.View(func(tx Tx) error {
+		var err error
+		value, err = tx.Get(table, key)
+		return err
+	})
+	return value, err
+}
+
+func (f *FileStorage) Put(table string, key string, value []byte) error {
+	return f.Update(func(tx Tx) error {
+		return tx.Put(table, key, value)
+	})
+}
+
+func (f *FileStorage) Delete(table string, key string) error {
+	return f.Update(func(tx Tx) error {
+		return tx.Delete(table, key)
+	})
+}
+
+func (f *FileStorage) List(table string, prefix string) ([]string, error) {
+	var keys []string
+	err := f.View(func(tx Tx) error {
+		var err error
+		keys, err = tx.List(table, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (f *FileStorage) CompareAndSwap(table string, key string, old []byte, value []byte) error {
+	return f.Update(func(tx Tx) error {
+		current, err := tx.Get(table, key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if (old == nil) != (current == nil) || !bytes.Equal(old, current) {
+			return ErrConflict
+		}
+		return tx.Put(table, key, value)
+	})
+}
+
+func (f *FileStorage) View(fn func(tx Tx) error) error {
+	if err := f.acquire(false); err != nil {
+		return err
+	}
+	defer f.release()
+
+	return fn(&fileTx{storage: f})
+}
+
+func (f *FileStorage) Update(fn func(tx Tx) error) error {
+	if err := f.acquire(true); err != nil {
+		return err
+	}
+	defer f.release()
+
+	tx := &fileTx{storage: f, writable: true, writes: map[string]int{}}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return f.commit(tx.ops)
+}
+
+func (f *FileStorage) Close() error {
+	return f.lock.Close()
+}
+
+// acquire locks the storage, shared for reads. A transaction log left by a
+// crashed writer is replayed first, which requires the exclusive lock.
+func (f *FileStorage) acquire(write bool) error {
+	f.mu.Lock()
+
+	how := syscall.LOCK_SH
+	if write {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.lock.Fd()), how); err != nil {
+		f.mu.Unlock()
+		return fmt.Errorf("lock file storage: [%w]", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(f.dir, fileTxLog)); err != nil {
+		return nil
+	}
+	if !write {
+		if err := syscall.Flock(int(f.lock.Fd()), syscall.LOCK_EX); err != nil {
+			f.release()
+			return fmt.Errorf("lock file storage: [%w]", err)
+		}
+	}
+	if err := f.replay(); err != nil {
+		f.release()
+		return err
+	}
+	return nil
+}
+
+func (f *FileStorage) release() {
+	_ = syscall.Flock(int(f.lock.Fd()), syscall.LOCK_UN)
+	f.mu.Unlock()
+}
+
+// commit applies ops, logging them first when there are several so a crash
+// can't leave part of them applied.
+func (f *FileStorage) commit(ops []fileOp) error {
+	switch len(ops) {
+	case 0:
+		return nil
+	case 1:
+		return f.apply(ops)
+	}
+
+	log, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	if err := conf.WriteFileAtomic(filepath.Join(f.dir, fileTxLog), log, 0600); err != nil {
+		return fmt.Errorf("write transaction log: [%w]", err)
+	}
+	if err := f.apply(ops); err != nil {
+		return err
+	}
+	return f.removeSynced(filepath.Join(f.dir, fileTxLog))
+}
+
+// replay applies the transaction log of an interrupted commit again.
+func (f *FileStorage) replay() error {
+	log, err := os.ReadFile(filepath.Join(f.dir, fileTxLog))
+	if err != nil {
+		return fmt.Errorf("read transaction log: [%w]", err)
+	}
+
+	var ops []fileOp
+	if err := json.Unmarshal(log, &ops); err != nil {
+		return fmt.Errorf("decode transaction log: [%w]", err)
+	}
+	if err := f.apply(ops); err != nil {
+		return err
+	}
+	return f.removeSynced(filepath.Join(f.dir, fileTxLog))
+}
+
+func (f *FileStorage) apply(ops []fileOp) error {
+	for _, op := range ops {
+		path := f.path(op.Table, op.Key)
+		if op.Value == nil {
+			if err := f.removeSynced(path); err != nil {
+				return fmt.Errorf("delete %s/%s: [%w]", op.Table, op.Key, err)
+			}
+			continue
+		}
+		if err := conf.WriteFileAtomic(path, op.Value, 0600); err != nil {
+			return fmt.Errorf("write %s/%s: [%w]", op.Table, op.Key, err)
+		}
+	}
+	return nil
+}
+
+// removeSynced removes path, ignoring missing files, and syncs its directory.
+func (f *FileStorage) removeSynced(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (f *FileStorage) path(table string, key string) string {
+	return filepath.Join(f.dir, table, escapeKey(key))
+}
+
+// loadDataKey unwraps the data key of the storage, creating it on first use.
+func (f *FileStorage) loadDataKey(keys KeyWrapper) (cipher.AEAD, error) {
+	path := filepath.Join(f.dir, fileDataKey)
+
+	wrapped, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		for _, table := range Tables {
+			if names, err := os.ReadDir(filepath.Join(f.dir, table)); err != nil || len(names) > 0 {
+				return nil, errors.New("file storage holds unencrypted values, it can't be encrypted in place")
+			}
+		}
+
+		dataKey := make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		encoded, err := keys.Encrypt(string(dataKey))
+		if err != nil {
+			return nil, fmt.Errorf("wrap file storage key: [%w]", err)
+		}
+		if err := conf.WriteFileAtomic(path, []byte(encoded), 0600); err != nil {
+			return nil, fmt.Errorf("write file storage key: [%w]", err)
+		}
+		return newGCM(dataKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read file storage key: [%w]", err)
+	}
+
+	dataKey, err := keys.Decrypt(string(wrapped))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap file storage key: [%w]", err)
+	}
+	return newGCM([]byte(dataKey))
+}
+
+// seal encrypts value, bound to its table and key so files can't be swapped.
+func (f *FileStorage) seal(table string, key string, value []byte) ([]byte, error) {
+	if f.aead == nil {
+		return value, nil
+	}
+	nonce := make([]byte, f.aead.NonceSize(), f.aead.NonceSize()+len(value)+f.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return f.aead.Seal(nonce, nonce, value, []byte(table+"/"+key)), nil
+}
+
+func (f *FileStorage) open(table string, key string, content []byte) ([]byte, error) {
+	if f.aead == nil {
+		return content, nil
+	}
+	if len(content) < f.aead.NonceSize() {
+		return nil, fmt.Errorf("decrypt %s/%s: value too short", table, key)
+	}
+	nonce, sealed := content[:f.aead.NonceSize()], content[f.aead.NonceSize():]
+	value, err := f.aead.Open(nil, nonce, sealed, []byte(table+"/"+key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s/%s: [%w]", table, key, err)
+	}
+	return value, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// escapeKey maps key to a file name, hidden names are kept for the storage
+// files.
+func escapeKey(key string) string {
+	name := url.PathEscape(key)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return name
+}
+
+// fileTx reads the files through the writes of the transaction, which are
+// only applied by commit.
+type fileTx struct {
+	storage  *FileStorage
+	writable bool
+	ops      []fileOp
+	// writes indexes ops by table and key
+	writes map[string]int
+}
+
+func (t *fileTx) checkTable(table string) error {
+	if !slices.Contains(Tables, table) {
+		return fmt.Errorf("unknown table: %s", table)
+	}
+	return nil
+}
+
+func (t *fileTx) Get(table string, key string) ([]byte, error) {
+	if err := t.checkTable(table); err != nil {
+		return nil, err
+	}
+
+	if i, ok := t.writes[table+"/"+key]; ok {
+		if t.ops[i].Value == nil {
+			return nil, ErrNotFound
+		}
+		return t.storage.open(table, key, t.ops[i].Value)
+	}
+
+	content, err := os.ReadFile(t.storage.path(table, key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t.storage.open(table, key, content)
+}
+
+func (t *fileTx) Put(table string, key string, value []byte) error {
+	if err := t.checkTable(table); err != nil {
+		return err
+	}
+	if key == "" {
+		return errors.New("empty key")
+	}
+	sealed, err := t.storage.seal(table, key, bytes.Clone(value))
+	if err != nil {
+		return err
+	}
+	if sealed == nil {
+		sealed = []byte{}
+	}
+	return t.write(fileOp{Table: table, Key: key, Value: sealed})
+}
+
+func (t *fileTx) Delete(table string, key string) error {
+	if err := t.checkTable(table); err != nil {
+		return err
+	}
+	return t.write(fileOp{Table: table, Key: key})
+}
+
+func (t *fileTx) write(op fileOp) error {
+	if !t.writable {
+		return errors.New("read-only transaction")
+	}
+	if i, ok := t.writes[op.Table+"/"+op.Key]; ok {
+		t.ops[i] = op
+		return nil
+	}
+	t.writes[op.Table+"/"+op.Key] = len(t.ops)
+	t.ops = append(t.ops, op)
+	return nil
+}
+
+func (t *fileTx) List(table string, prefix string) ([]string, error) {
+	if err := t.checkTable(table); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(t.storage.dir, table))
+	if err != nil {
+		return nil, err
+	}
+
+	found := map[string]bool{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		found[key] = true
+	}
+	for _, op := range t.ops {
+		if op.Table == table {
+			found[op.Key] = op.Value != nil
+		}
+	}
+
+	keys := []string{}
+	for key, exists := range found {
+		if exists && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
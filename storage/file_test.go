@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/encryption"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStorage(&conf.FileStore{Path: dir}, nil)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	assert.NoError(t, store.Put("keys", "0", []byte("somerandomkey")))
+	assert.NoError(t, store.Put("secrets", "kv/app/db", []byte("hash")))
+	assert.NoError(t, store.Put("secrets", "..", []byte("dots")))
+	assert.NoError(t, store.Put("secrets", "empty", []byte{}))
+
+	value, err := store.Get("keys", "0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("somerandomkey"), value)
+	assert.FileExists(t, filepath.Join(dir, "secrets", "kv%2Fapp%2Fdb"))
+	assert.FileExists(t, filepath.Join(dir, "secrets", "%2E."))
+
+	value, err = store.Get("secrets", "empty")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, value)
+
+	_, err = store.Get("keys", "1")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = store.Get("users", "0")
+	assert.ErrorContains(t, err, "unknown table: users")
+
+	keys, err := store.List("secrets", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"..", "empty", "kv/app/db"}, keys)
+
+	keys, err = store.List("secrets", "kv/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"kv/app/db"}, keys)
+
+	assert.NoError(t, store.Delete("secrets", ".."))
+	assert.NoError(t, store.Delete("secrets", "missing"))
+	_, err = store.Get("secrets", "..")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, store.CompareAndSwap("approles", "web", nil, []byte("1")))
+	assert.ErrorIs(t, store.CompareAndSwap("approles", "web", nil, []byte("2")), ErrConflict)
+	assert.NoError(t, store.CompareAndSwap("approles", "web", []byte("1"), []byte("2")))
+
+	// an Update is applied entirely or not at all, and reads its own writes
+	err = store.Update(func(tx Tx) error {
+		assert.NoError(t, tx.Put("keys", "1", []byte("k1")))
+		assert.NoError(t, tx.Delete("keys", "0"))
+		keys, err := tx.List("keys", "")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"1"}, keys)
+		return errors.New("abort")
+	})
+	assert.ErrorContains(t, err, "abort")
+	keys, err = store.List("keys", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0"}, keys)
+
+	err = store.Update(func(tx Tx) error {
+		assert.NoError(t, tx.Put("keys", "1", []byte("k1")))
+		return tx.Delete("keys", "0")
+	})
+	assert.NoError(t, err)
+	keys, err = store.List("keys", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1"}, keys)
+	assert.NoFileExists(t, filepath.Join(dir, fileTxLog))
+
+	err = store.View(func(tx Tx) error {
+		return tx.Put("keys", "2", []byte("k2"))
+	})
+	assert.ErrorContains(t, err, "read-only transaction")
+}
+
+func TestFileStorageReplay(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStorage(&conf.FileStore{Path: dir}, nil)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, store.Put("keys", "stale", []byte("x")))
+
+	// a writer crashed after logging its transaction
+	log, err := json.Marshal([]fileOp{
+		{Table: "keys", Key: "token", Value: []byte("root")},
+		{Table: "keys", Key: "0", Value: []byte("k0")},
+		{Table: "keys", Key: "stale"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, fileTxLog), log, 0600))
+
+	keys, err := store.List("keys", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "token"}, keys)
+	assert.NoFileExists(t, filepath.Join(dir, fileTxLog))
+}
+
+func TestFileStorageEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	crypto, err := encryption.NewCrypto(t.TempDir())
+	assert.NoError(t, err)
+
+	store, err := NewFileStorage(&conf.FileStore{Path: dir, Encrypt: true}, crypto)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put("keys", "token", []byte("root")))
+	assert.NoError(t, store.Put("keys", "0", []byte("k0")))
+	assert.NoError(t, store.Close())
+
+	content, err := os.ReadFile(filepath.Join(dir, "keys", "token"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "root")
+
+	// the data key is read back on open
+	store, err = NewFileStorage(&conf.FileStore{Path: dir, Encrypt: true}, crypto)
+	assert.NoError(t, err)
+	defer store.Close()
+	value, err := store.Get("keys", "token")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("root"), value)
+
+	// values are bound to their key
+	assert.NoError(t, os.Rename(filepath.Join(dir, "keys", "0"), filepath.Join(dir, "keys", "1")))
+	_, err = store.Get("keys", "1")
+	assert.ErrorContains(t, err, "decrypt keys/1")
+
+	_, err = NewFileStorage(&conf.FileStore{Path: dir}, nil)
+	assert.ErrorContains(t, err, "file storage is encrypted")
+
+	plain := t.TempDir()
+	store, err = NewFileStorage(&conf.FileStore{Path: plain}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put("keys", "token", []byte("root")))
+	assert.NoError(t, store.Close())
+	_, err = NewFileStorage(&conf.FileStore{Path: plain, Encrypt: true}, crypto)
+	assert.ErrorContains(t, err, "holds unencrypted values")
+}
+
+func TestFileStorageLock(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewFileStorage(&conf.FileStore{Path: dir}, nil)
+	assert.NoError(t, err)
+	defer writer.Close()
+	reader, err := NewFileStorage(&conf.FileStore{Path: dir}, nil)
+	assert.NoError(t, err)
+	defer reader.Close()
+
+	// a second handle on the directory waits for the running transaction
+	inTx, read := make(chan struct{}), make(chan []string)
+	go func() {
+		<-inTx
+		keys, err := reader.List("keys", "")
+		assert.NoError(t, err)
+		read <- keys
+	}()
+
+	err = writer.Update(func(tx Tx) error {
+		close(inTx)
+		assert.NoError(t, tx.Put("keys", "token", []byte("root")))
+		select {
+		case <-read:
+			t.Error("read during a transaction")
+		case <-time.After(100 * time.Millisecond):
+		}
+		return tx.Put("keys", "0", []byte("k0"))
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0", "token"}, <-read)
+}
@@ -1,6 +1,55 @@
 package storage
 
+import (
+	"errors"
+	"time"
+	"vault-unlocker/conf"
+)
+
+var (
+	// ErrNotFound is returned when a key does not exist.
+	ErrNotFound = errors.New("key not found")
+	// ErrConflict is returned by CompareAndSwap when the stored value is not
+	// the expected one.
+	ErrConflict = errors.New("value changed concurrently")
+	// ErrInUse is returned when the storage stays locked by another process
+	// past the lock timeout.
+	ErrInUse = errors.New("storage is in use by another process")
+)
+
+// Tables are the tables every backend provides.
+var Tables = []string{"keys", "secrets", "approles", "exports", "journal"}
+
+// Tx reads and writes the tables, a Tx given to Update is applied atomically.
+type Tx interface {
+	Get(table string, key string) ([]byte, error)
+	Put(table string, key string, value []byte) error
+	// Delete removes key, missing keys are ignored.
+	Delete(table string, key string) error
+	// List returns the keys of table starting with prefix, sorted.
+	List(table string, prefix string) ([]string, error)
+}
+
+// Storage persists the unseal keys and the state of the unlocker. Every
+// method of Tx runs in its own transaction.
 type Storage interface {
-	RetrieveKey(table string, key string) (string, error)
-	InsertKeyValue(table string, key string, data string) error
+	Tx
+	// CompareAndSwap stores value if key currently holds old, nil old
+	// meaning the key must not exist, and returns ErrConflict otherwise.
+	CompareAndSwap(table string, key string, old []byte, value []byte) error
+	// View runs fn with a consistent snapshot of the tables, writes fail.
+	View(fn func(tx Tx) error) error
+	// Update runs fn in a transaction, nothing is written if fn fails.
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// NewStorage opens the backend selected by storageConf, keys wraps the data
+// key of an encrypted file storage. lockTimeout bounds the wait for a BoltDB
+// storage held open by another process, zero waits forever.
+func NewStorage(storageConf *conf.Storage, keys KeyWrapper, lockTimeout time.Duration) (Storage, error) {
+	if storageConf.StorageType == "file" {
+		return NewFileStorage(storageConf.File, keys)
+	}
+	return NewBoltDBStorage(storageConf.BoltDB, lockTimeout)
 }
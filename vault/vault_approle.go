@@ -0,0 +1,232 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+	"vault-unlocker/storage"
+)
+
+const (
+	approlesTable = "approles"
+)
+
+// secretIDState is what the unlocker remembers about an exported secret-id,
+// the secret-id itself only lives in vault and in the exported secret.
+type secretIDState struct {
+	Accessor   string               `json:"accessor"`
+	CreatedAt  time.Time            `json:"created_at"`
+	Wrapped    bool                 `json:"wrapped,omitempty"`
+	Superseded []supersededSecretID `json:"superseded,omitempty"`
+}
+
+type supersededSecretID struct {
+	Accessor     string    `json:"accessor"`
+	SupersededAt time.Time `json:"superseded_at"`
+}
+
+func (v *vaultManager) exportAppRoles(ctx context.Context, mountPath string, roles []conf.AppRole, token string) error {
+	for _, role := range roles {
+		if role.Export == nil {
+			continue
+		}
+
+		if err := v.exportAppRole(ctx, mountPath, role, token); err != nil {
+			slog.Warn("not possible to export approle, continuing...", "role", role.Name, "path", mountPath, "namespace", role.Export.Namespace, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (v *vaultManager) exportAppRole(ctx context.Context, mountPath string, role conf.AppRole, token string) error {
+	stateKey := path.Join(v.namespace, mountPath, role.Name, role.Export.Namespace)
+	state, err := v.loadSecretIDState(stateKey)
+	if err != nil {
+		return err
+	}
+
+	rotate, err := v.isSecretIDRotationDue(ctx, mountPath, role, state, token)
+	if err != nil {
+		return err
+	}
+
+	if rotate {
+		if err := v.rotateSecretID(ctx, mountPath, role, state, token); err != nil {
+			return err
+		}
+		if err := v.saveSecretIDState(stateKey, state); err != nil {
+			return err
+		}
+	}
+
+	if v.destroySupersededSecretIDs(ctx, mountPath, role, state, token) {
+		return v.saveSecretIDState(stateKey, state)
+	}
+
+	return nil
+}
+
+func (v *vaultManager) isSecretIDRotationDue(ctx context.Context, mountPath string, role conf.AppRole, state *secretIDState, token string) (bool, error) {
+	if state.Accessor == "" {
+		return true, nil
+	}
+
+	if state.Wrapped != (role.Export.WrapTTL > 0) {
+		slog.Info("approle export wrapping changed, rotating", "role", role.Name, "wrapped", role.Export.WrapTTL > 0)
+		return true, nil
+	}
+
+	createdAt, found, err := v.lookupAppRoleSecretIDAccessor(ctx, role.Name, mountPath, state.Accessor, token)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		slog.Info("exported secret id not found in vault, rotating", "role", role.Name, "accessor", state.Accessor)
+		return true, nil
+	}
+
+	exp, err := v.exporter(role.Export.Metadata.Exporter)
+	if err != nil {
+		return false, err
+	}
+
+	// the secret-id can not be read back, a deleted export needs a new one
+	exported, err := exp.Read(ctx, role.Export.Namespace, role.Name)
+	if err != nil {
+		return false, fmt.Errorf("read exported secret: [%w]", err)
+	}
+	if exported == nil {
+		slog.Info("exported secret not found, rotating", "role", role.Name, "namespace", role.Export.Namespace)
+		return true, nil
+	}
+
+	ttl := time.Duration(role.SecretIdTTL) * time.Second
+	return secretIDRotationDue(createdAt, ttl, role.Export.RotationThreshold, time.Now()), nil
+}
+
+func (v *vaultManager) rotateSecretID(ctx context.Context, mountPath string, role conf.AppRole, state *secretIDState, token string) error {
+	roleID, err := v.getAppRoleRoleID(ctx, role.Name, mountPath, token)
+	if err != nil {
+		return fmt.Errorf("get role id: [%w]", err)
+	}
+
+	exp, err := v.exporter(role.Export.Metadata.Exporter)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("exporting approle", "role", role.Name, "exporter", role.Export.Metadata.Exporter)
+	data := map[string][]byte{"role_id": []byte(roleID)}
+	wrapped := role.Export.WrapTTL > 0
+
+	var accessor string
+	if wrapped {
+		// consumers unwrap the secret-id once, an interception shows up as a failed unwrap
+		var wrappingToken string
+		wrappingToken, accessor, err = v.generateWrappedAppRoleSecretID(ctx, role.Name, mountPath, role.Export.WrapTTL, token)
+		if err != nil {
+			return fmt.Errorf("generate wrapped secret id: [%w]", err)
+		}
+		data["wrapping_token"] = []byte(wrappingToken)
+	} else {
+		var secretID string
+		secretID, accessor, err = v.generateAppRoleSecretID(ctx, role.Name, mountPath, token)
+		if err != nil {
+			return fmt.Errorf("generate secret id: [%w]", err)
+		}
+		data["secret_id"] = []byte(secretID)
+	}
+
+	err = exp.Write(ctx, exporter.Secret{
+		Namespace:   role.Export.Namespace,
+		Name:        role.Name,
+		Labels:      role.Export.Metadata.Labels,
+		Annotations: role.Export.Metadata.Annotations,
+		Data:        data,
+		Force:       role.Export.Metadata.Force,
+	})
+	if err != nil {
+		// nobody received it, drop it right away
+		if derr := v.destroyAppRoleSecretIDAccessor(ctx, role.Name, mountPath, accessor, token); derr != nil {
+			slog.Warn("not possible to destroy unused secret id", "role", role.Name, "err", derr)
+		}
+		return fmt.Errorf("write exported secret: [%w]", err)
+	}
+
+	now := time.Now().UTC()
+	if state.Accessor != "" {
+		state.Superseded = append(state.Superseded, supersededSecretID{Accessor: state.Accessor, SupersededAt: now})
+	}
+	state.Accessor = accessor
+	state.CreatedAt = now
+	state.Wrapped = wrapped
+
+	slog.Info("secret id rotated", "role", role.Name, "path", mountPath, "accessor", accessor)
+	return nil
+}
+
+// destroySupersededSecretIDs revokes secret-ids replaced longer than the grace
+// period ago, consumers had that long to pick up the new one. Reports whether
+// the state changed.
+func (v *vaultManager) destroySupersededSecretIDs(ctx context.Context, mountPath string, role conf.AppRole, state *secretIDState, token string) bool {
+	remaining := state.Superseded[:0]
+	for _, old := range state.Superseded {
+		if time.Since(old.SupersededAt) < role.Export.GracePeriod {
+			remaining = append(remaining, old)
+			continue
+		}
+
+		if err := v.destroyAppRoleSecretIDAccessor(ctx, role.Name, mountPath, old.Accessor, token); err != nil {
+			slog.Warn("not possible to destroy superseded secret id, continuing...", "role", role.Name, "accessor", old.Accessor, "err", err)
+			remaining = append(remaining, old)
+		}
+	}
+
+	changed := len(remaining) != len(state.Superseded)
+	state.Superseded = remaining
+	return changed
+}
+
+func (v *vaultManager) loadSecretIDState(key string) (*secretIDState, error) {
+	state := &secretIDState{}
+
+	raw, err := v.storage.Get(approlesTable, key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return state, nil
+		}
+		return nil, fmt.Errorf("retrieve secret id state: [%w]", err)
+	}
+
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, fmt.Errorf("decode secret id state: [%w]", err)
+	}
+	return state, nil
+}
+
+func (v *vaultManager) saveSecretIDState(key string, state *secretIDState) error {
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := v.storage.Put(approlesTable, key, raw); err != nil {
+		return fmt.Errorf("store secret id state: [%w]", err)
+	}
+	return nil
+}
+
+// secretIDRotationDue reports whether threshold (0-1) of the secret-id ttl
+// has elapsed. Secret-ids without ttl never expire and are kept.
+func secretIDRotationDue(createdAt time.Time, ttl time.Duration, threshold float64, now time.Time) bool {
+	if ttl <= 0 {
+		return false
+	}
+	return now.Sub(createdAt) >= time.Duration(float64(ttl)*threshold)
+}
@@ -0,0 +1,232 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSecretIDRotationDue(t *testing.T) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.False(t, secretIDRotationDue(created, time.Hour, 0.5, created.Add(29*time.Minute)))
+	assert.True(t, secretIDRotationDue(created, time.Hour, 0.5, created.Add(30*time.Minute)))
+	assert.True(t, secretIDRotationDue(created, time.Hour, 0, created))
+	assert.False(t, secretIDRotationDue(created, 0, 0.5, created.Add(24*time.Hour)))
+}
+
+// approleStub serves the secret-id endpoints of an approle mount, secret-ids
+// are kept by accessor.
+type approleStub struct {
+	mu        sync.Mutex
+	created   map[string]time.Time
+	destroyed []string
+	count     int
+	wrapTTL   string
+}
+
+func newApproleStub() (*httptest.Server, *approleStub) {
+	stub := &approleStub{created: map[string]time.Time{}}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+
+		body := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		accessor, _ := body["secret_id_accessor"].(string)
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/role-id"):
+			_, _ = w.Write([]byte(`{"data":{"role_id":"role-1"}}`))
+
+		case strings.HasSuffix(r.URL.Path, "/secret-id"):
+			stub.count++
+			accessor := fmt.Sprintf("accessor-%d", stub.count)
+			stub.created[accessor] = time.Now().UTC()
+			if wrapTTL := r.Header.Get("X-Vault-Wrap-TTL"); wrapTTL != "" {
+				stub.wrapTTL = wrapTTL
+				fmt.Fprintf(w, `{"wrap_info":{"token":"wrap-%d","ttl":300,"wrapped_accessor":%q}}`, stub.count, accessor)
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"secret_id":"secret-%d","secret_id_accessor":%q}}`, stub.count, accessor)
+
+		case strings.HasSuffix(r.URL.Path, "/secret-id-accessor/lookup"):
+			created, ok := stub.created[accessor]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			fmt.Fprintf(w, `{"data":{"creation_time":%q}}`, created.Format(time.RFC3339Nano))
+
+		case strings.HasSuffix(r.URL.Path, "/secret-id-accessor/destroy"):
+			delete(stub.created, accessor)
+			stub.destroyed = append(stub.destroyed, accessor)
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return srv, stub
+}
+
+func TestAppRoleSecretIDRotation(t *testing.T) {
+	srv, stub := newApproleStub()
+	defer srv.Close()
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(&conf.Unlocker{}, &conf.Provisioner{}, client, store, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	role := conf.AppRole{
+		Name:        "eso",
+		SecretIdTTL: 3600,
+		Export:      &conf.AppRoleExport{Namespace: "security", RotationThreshold: 0.5, GracePeriod: time.Hour},
+	}
+	stateKey := "approle/eso/security"
+
+	secretID := func() string {
+		secret, err := k8s.Client.CoreV1().Secrets("security").Get(ctx, "eso", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return string(secret.Data["secret_id"])
+	}
+
+	// first export
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, "secret-1", secretID())
+
+	// still fresh, nothing happens
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, 1, stub.count)
+
+	// past the threshold, the old secret-id is kept during the grace period
+	stub.created["accessor-1"] = time.Now().Add(-31 * time.Minute)
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, "secret-2", secretID())
+	assert.Empty(t, stub.destroyed)
+
+	state, err := vm.loadSecretIDState(stateKey)
+	assert.NoError(t, err)
+	assert.Equal(t, "accessor-2", state.Accessor)
+	assert.Len(t, state.Superseded, 1)
+
+	// grace period over
+	state.Superseded[0].SupersededAt = time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, vm.saveSecretIDState(stateKey, state))
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, []string{"accessor-1"}, stub.destroyed)
+
+	state, err = vm.loadSecretIDState(stateKey)
+	assert.NoError(t, err)
+	assert.Empty(t, state.Superseded)
+
+	// kubernetes secret deleted, a new secret-id is issued
+	assert.NoError(t, k8s.Client.CoreV1().Secrets("security").Delete(ctx, "eso", metav1.DeleteOptions{}))
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, "secret-3", secretID())
+
+	// secret-id expired in vault
+	delete(stub.created, "accessor-3")
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, "secret-4", secretID())
+}
+
+func TestAppRoleWrappedSecretID(t *testing.T) {
+	srv, stub := newApproleStub()
+	defer srv.Close()
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(&conf.Unlocker{}, &conf.Provisioner{}, client, store, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	role := conf.AppRole{
+		Name:        "eso",
+		SecretIdTTL: 3600,
+		Export:      &conf.AppRoleExport{Namespace: "security", RotationThreshold: 0.5, GracePeriod: time.Hour, WrapTTL: 5 * time.Minute},
+	}
+
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+
+	secret, err := k8s.Client.CoreV1().Secrets("security").Get(ctx, "eso", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"role_id": []byte("role-1"), "wrapping_token": []byte("wrap-1")}, secret.Data)
+	assert.Equal(t, "300s", stub.wrapTTL)
+
+	state, err := vm.loadSecretIDState("approle/eso/security")
+	assert.NoError(t, err)
+	assert.Equal(t, "accessor-1", state.Accessor)
+	assert.True(t, state.Wrapped)
+
+	// turning wrapping off exports a plain secret-id right away
+	role.Export.WrapTTL = 0
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+
+	secret, err = k8s.Client.CoreV1().Secrets("security").Get(ctx, "eso", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"role_id": []byte("role-1"), "secret_id": []byte("secret-2")}, secret.Data)
+}
+
+func TestAppRoleFileExport(t *testing.T) {
+	srv, stub := newApproleStub()
+	defer srv.Close()
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	local, err := exporter.NewFileExporter(conf.FileExporter{Name: "local", Format: "files", Path: dir})
+	assert.NoError(t, err)
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(&conf.Unlocker{}, &conf.Provisioner{}, client, store, map[string]exporter.Exporter{"local": local})
+	assert.NoError(t, err)
+
+	// file exports need no namespace
+	ctx := context.Background()
+	role := conf.AppRole{
+		Name:        "backup",
+		SecretIdTTL: 3600,
+		Export:      &conf.AppRoleExport{RotationThreshold: 0.5, GracePeriod: time.Hour, Metadata: conf.ExportMetadata{Exporter: "local"}},
+	}
+
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	secretID, err := os.ReadFile(filepath.Join(dir, "backup", "secret_id"))
+	assert.NoError(t, err)
+	assert.Equal(t, "secret-1", string(secretID))
+
+	state, err := vm.loadSecretIDState("approle/backup")
+	assert.NoError(t, err)
+	assert.Equal(t, "accessor-1", state.Accessor)
+
+	// the export is the one cleanup expects
+	assert.Equal(t, []exportRecord{{Exporter: "local", Name: "backup", Mount: "approle", Role: "backup"}}, desiredExports("", &conf.Provisioner{Auth: []conf.Auth{{AuthType: "approle", Path: "approle", AppRoles: []conf.AppRole{role}}}}))
+
+	assert.NoError(t, vm.exportAppRoles(ctx, "approle", []conf.AppRole{role}, "token"))
+	assert.Equal(t, 1, stub.count)
+}
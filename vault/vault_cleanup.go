@@ -0,0 +1,230 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"sort"
+	"strings"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+	"vault-unlocker/storage"
+)
+
+const (
+	exportsTable = "exports"
+	exportsIndex = "index"
+)
+
+// exportRecord is an exported secret the unlocker is responsible for. Approle
+// exports also carry what is needed to revoke their secret-ids.
+type exportRecord struct {
+	Exporter       string `json:"exporter"`
+	Namespace      string `json:"namespace"`
+	Name           string `json:"name"`
+	VaultNamespace string `json:"vault_namespace,omitempty"`
+	Mount          string `json:"mount,omitempty"`
+	Role           string `json:"role,omitempty"`
+}
+
+// target is the exported secret.
+func (r exportRecord) target() string {
+	return strings.Join([]string{r.Exporter, r.Namespace, r.Name}, "/")
+}
+
+// id tells apart approles of different Vault namespaces or mounts exported to
+// the same target, each has its own secret-ids to revoke. Namespaces and
+// mounts may contain slashes, so the parts are NUL separated.
+func (r exportRecord) id() string {
+	return strings.Join([]string{r.target(), r.VaultNamespace, r.Mount}, "\x00")
+}
+
+// cleanupExports deletes exported secrets that are no longer in the config
+// and revokes the secret-ids of removed approle exports. What was exported is
+// remembered in the storage, secrets that lost the managed-by label are left
+// alone. Failed removals are retried on the next cycle.
+func (v *vaultManager) cleanupExports(ctx context.Context, token string) error {
+	if v.provisioner == nil || v.storage == nil {
+		return nil
+	}
+
+	previous, err := v.loadExportIndex()
+	if err != nil {
+		return err
+	}
+
+	desired := map[string]exportRecord{}
+	targets := map[string]bool{}
+	for _, rec := range desiredExports("", v.provisioner) {
+		desired[rec.id()] = rec
+		targets[rec.target()] = true
+	}
+
+	index := make([]exportRecord, 0, len(desired))
+	for _, rec := range desired {
+		index = append(index, rec)
+	}
+
+	for _, rec := range previous {
+		if _, ok := desired[rec.id()]; ok {
+			continue
+		}
+
+		if err := v.removeExport(ctx, rec, targets[rec.target()], token); err != nil {
+			slog.Warn("not possible to remove export, retrying next cycle...", "exporter", rec.Exporter, "namespace", rec.Namespace, "name", rec.Name, "err", err)
+			index = append(index, rec)
+			continue
+		}
+		slog.Info("removed export no longer in config", "exporter", rec.Exporter, "namespace", rec.Namespace, "name", rec.Name)
+	}
+
+	return v.saveExportIndex(index)
+}
+
+// removeExport deletes the exported secret of rec, unless another export
+// still writes it, and revokes the secret-ids of an approle export.
+func (v *vaultManager) removeExport(ctx context.Context, rec exportRecord, targetInUse bool, token string) error {
+	if !targetInUse {
+		exp, err := v.exporter(rec.Exporter)
+		if err != nil {
+			return err
+		}
+
+		existing, err := exp.Read(ctx, rec.Namespace, rec.Name)
+		if err != nil {
+			return fmt.Errorf("read exported secret: [%w]", err)
+		}
+
+		if existing != nil && existing.Labels[exporter.LabelManagedBy] == exporter.ManagedByValue {
+			if err := exp.Delete(ctx, rec.Namespace, rec.Name); err != nil {
+				return fmt.Errorf("delete exported secret: [%w]", err)
+			}
+		}
+	}
+
+	if rec.Role == "" {
+		return nil
+	}
+
+	return v.revokeExportedSecretIDs(ctx, rec, token)
+}
+
+// revokeExportedSecretIDs destroys the current and superseded secret-ids of a
+// removed approle export and forgets its state.
+func (v *vaultManager) revokeExportedSecretIDs(ctx context.Context, rec exportRecord, token string) error {
+	scoped := *v
+	scoped.vaultClient = v.vaultClient.withNamespace(rec.VaultNamespace)
+
+	stateKey := path.Join(rec.VaultNamespace, rec.Mount, rec.Role, rec.Namespace)
+	state, err := scoped.loadSecretIDState(stateKey)
+	if err != nil {
+		return err
+	}
+
+	accessors := []string{}
+	if state.Accessor != "" {
+		accessors = append(accessors, state.Accessor)
+	}
+	for _, old := range state.Superseded {
+		accessors = append(accessors, old.Accessor)
+	}
+
+	for _, accessor := range accessors {
+		if err := scoped.destroyAppRoleSecretIDAccessor(ctx, rec.Role, rec.Mount, accessor, token); err != nil {
+			return err
+		}
+	}
+
+	return scoped.saveSecretIDState(stateKey, &secretIDState{})
+}
+
+// desiredExports lists every export of the config, child namespaces included.
+func desiredExports(vaultNamespace string, prov *conf.Provisioner) []exportRecord {
+	var records []exportRecord
+
+	for _, auth := range prov.Auth {
+		for _, role := range auth.AppRoles {
+			if role.Export == nil {
+				continue
+			}
+			records = append(records, exportRecord{
+				Exporter:       role.Export.Metadata.Exporter,
+				Namespace:      role.Export.Namespace,
+				Name:           role.Name,
+				VaultNamespace: vaultNamespace,
+				Mount:          auth.Path,
+				Role:           role.Name,
+			})
+		}
+
+		for _, user := range auth.Users {
+			if user.Export == nil {
+				continue
+			}
+			records = append(records, exportRecord{
+				Exporter:  user.Export.Metadata.Exporter,
+				Namespace: user.Export.Namespace,
+				Name:      exportName(user.Export, user.Name),
+			})
+		}
+	}
+
+	for _, mount := range prov.Mount {
+		for _, secret := range mount.Secrets {
+			if secret.Export == nil {
+				continue
+			}
+			records = append(records, exportRecord{
+				Exporter:  secret.Export.Metadata.Exporter,
+				Namespace: secret.Export.Namespace,
+				Name:      exportName(secret.Export, secret.Name),
+			})
+		}
+
+		for _, cert := range mount.Certificates {
+			records = append(records, exportRecord{
+				Exporter:  cert.Export.Metadata.Exporter,
+				Namespace: cert.Export.Namespace,
+				Name:      cert.Export.Name,
+			})
+		}
+	}
+
+	for _, ns := range prov.Namespaces {
+		records = append(records, desiredExports(path.Join(vaultNamespace, ns.Path), &ns.Provisioner)...)
+	}
+
+	return records
+}
+
+func (v *vaultManager) loadExportIndex() ([]exportRecord, error) {
+	raw, err := v.storage.Get(exportsTable, exportsIndex)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("retrieve export index: [%w]", err)
+	}
+
+	var records []exportRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, fmt.Errorf("decode export index: [%w]", err)
+	}
+	return records, nil
+}
+
+func (v *vaultManager) saveExportIndex(records []exportRecord) error {
+	sort.Slice(records, func(i, j int) bool { return records[i].id() < records[j].id() })
+
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	if err := v.storage.Put(exportsTable, exportsIndex, raw); err != nil {
+		return fmt.Errorf("store export index: [%w]", err)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package vault_manager
+
+import (
+	"context"
+	"testing"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCleanupExports(t *testing.T) {
+	srv, stub := newApproleStub()
+	defer srv.Close()
+
+	data := []byte(`
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: eso
+          secret_id_ttl: 3600
+          export:
+            namespace: security
+        - name: kept
+          export:
+            namespace: security
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          pass: s3cret
+          export:
+            namespace: build
+        - name: taken
+          pass: s3cret
+          export:
+            namespace: build
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, store, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	vm.export(ctx, "token")
+	assert.NoError(t, vm.cleanupExports(ctx, "token"))
+	assert.Empty(t, stub.destroyed)
+
+	secrets := k8s.Client.CoreV1().Secrets
+	// someone else took over this secret, it must survive
+	taken, err := secrets("build").Get(ctx, "taken", metav1.GetOptions{})
+	assert.NoError(t, err)
+	delete(taken.Labels, exporter.LabelManagedBy)
+	_, err = secrets("build").Update(ctx, taken, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	// eso and both users are removed from the config
+	vm.provisioner.Auth[0].AppRoles = vm.provisioner.Auth[0].AppRoles[1:]
+	vm.provisioner.Auth[1].Users = nil
+	assert.NoError(t, vm.cleanupExports(ctx, "token"))
+
+	_, err = secrets("security").Get(ctx, "eso", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = secrets("build").Get(ctx, "ci", metav1.GetOptions{})
+	assert.True(t, apierrors.IsNotFound(err))
+	_, err = secrets("build").Get(ctx, "taken", metav1.GetOptions{})
+	assert.NoError(t, err)
+	_, err = secrets("security").Get(ctx, "kept", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"accessor-1"}, stub.destroyed)
+
+	index, err := vm.loadExportIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, []exportRecord{{Exporter: "kubernetes", Namespace: "security", Name: "kept", Mount: "approle", Role: "kept"}}, index)
+
+	// nothing left to do
+	assert.NoError(t, vm.cleanupExports(ctx, "token"))
+	assert.Equal(t, []string{"accessor-1"}, stub.destroyed)
+}
+
+func TestCleanupExportsMovedAppRole(t *testing.T) {
+	srv, stub := newApproleStub()
+	defer srv.Close()
+
+	data := []byte(`
+provisioner:
+  auth:
+    - type: approle
+      path: approle
+      approles:
+        - name: app
+          export:
+            namespace: apps
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, store, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	vm.export(ctx, "token")
+	assert.NoError(t, vm.cleanupExports(ctx, "token"))
+
+	// the role moves to another mount and keeps exporting to apps/app
+	vm.provisioner.Auth[0].Path = "ci"
+	vm.export(ctx, "token")
+	assert.NoError(t, vm.cleanupExports(ctx, "token"))
+
+	// the secret-ids of the old mount are revoked, the shared secret stays
+	assert.Equal(t, []string{"accessor-1"}, stub.destroyed)
+	_, err = k8s.Client.CoreV1().Secrets("apps").Get(ctx, "app", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	index, err := vm.loadExportIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, []exportRecord{{Exporter: "kubernetes", Namespace: "apps", Name: "app", Mount: "ci", Role: "app"}}, index)
+}
+
+func TestExportRecordID(t *testing.T) {
+	records := []exportRecord{
+		{Exporter: "kubernetes", Namespace: "apps", Name: "app", Mount: "approle", Role: "app"},
+		{Exporter: "kubernetes", Namespace: "apps", Name: "app", Mount: "ci", Role: "app"},
+		{Exporter: "kubernetes", Namespace: "apps", Name: "app", VaultNamespace: "team-a", Mount: "approle", Role: "app"},
+		{Exporter: "kubernetes", Namespace: "apps", Name: "app", VaultNamespace: "team-a/approle", Role: "app"},
+		{Exporter: "kubernetes", Namespace: "apps", Name: "app"},
+	}
+
+	ids := map[string]bool{}
+	for _, rec := range records {
+		ids[rec.id()] = true
+		assert.Equal(t, "kubernetes/apps/app", rec.target())
+	}
+	assert.Len(t, ids, len(records))
+}
+
+func TestDesiredExportsInNamespaces(t *testing.T) {
+	data := []byte(`
+provisioner:
+  namespaces:
+    - path: team-a
+      auth:
+        - type: approle
+          path: approle
+          approles:
+            - name: app
+              export:
+                namespace: apps
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []exportRecord{{
+		Exporter:       "kubernetes",
+		Namespace:      "apps",
+		Name:           "app",
+		VaultNamespace: "team-a",
+		Mount:          "approle",
+		Role:           "app",
+	}}, desiredExports("", cfg.Provisioner))
+}
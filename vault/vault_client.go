@@ -2,9 +2,12 @@ package vault_manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 	"vault-unlocker/conf"
 
@@ -14,27 +17,53 @@ import (
 )
 
 type vaultClient struct {
-	ep      string
-	timeout int
-	client  *vault.Client
+	ep        string
+	timeout   int
+	namespace string
+	client    *vault.Client
 }
 
 func NewVaultClient(cfg *conf.Unlocker) (*vaultClient, error) {
+	return newVaultClient(cfg.Url, false)
+}
+
+func newVaultClient(address string, tlsSkipVerify bool) (*vaultClient, error) {
 
 	vm := &vaultClient{
-		ep:      cfg.Url,
+		ep:      address,
 		timeout: 5,
 	}
 
-	var err error
-	vm.client, err = vault.New(
+	opts := []vault.ClientOption{
 		vault.WithAddress(vm.ep),
-		vault.WithRequestTimeout(time.Duration(vm.timeout)*time.Second),
-	)
+		vault.WithRequestTimeout(time.Duration(vm.timeout) * time.Second),
+	}
+	if tlsSkipVerify {
+		opts = append(opts, vault.WithTLS(vault.TLSConfiguration{InsecureSkipVerify: true}))
+	}
+
+	var err error
+	vm.client, err = vault.New(opts...)
 
 	return vm, err
 }
 
+// withNamespace returns a copy of the client whose calls are scoped to the
+// given namespace, the underlying http client is shared.
+func (v *vaultClient) withNamespace(namespace string) *vaultClient {
+	scoped := *v
+	scoped.namespace = namespace
+	return &scoped
+}
+
+func (v *vaultClient) options(token string, opts ...vault.RequestOption) []vault.RequestOption {
+	opts = append(opts, vault.WithToken(token))
+	if v.namespace != "" {
+		opts = append(opts, vault.WithNamespace(v.namespace))
+	}
+	return opts
+}
+
 func (v *vaultClient) isSealed(ctx context.Context) (bool, error) {
 
 	resp, err := v.client.System.SealStatus(ctx)
@@ -90,7 +119,7 @@ func (v *vaultClient) unseal(ctx context.Context, keys []interface{}) error {
 
 func (v *vaultClient) enableAuth(ctx context.Context, engType string, mountPath string, token string) error {
 	_, err := v.client.System.AuthEnableMethod(ctx, engType, schema.AuthEnableMethodRequest{Type: engType},
-		vault.WithToken(token), vault.WithMountPath(mountPath))
+		v.options(token, vault.WithMountPath(mountPath))...)
 	if err != nil {
 		return fmt.Errorf("enable %s [%w]", engType, err)
 	}
@@ -101,7 +130,7 @@ func (v *vaultClient) enableAuth(ctx context.Context, engType string, mountPath
 func (v *vaultClient) createUserPassAuthUser(ctx context.Context, mountPath string, user string, pass string, policies []string, token string) error {
 	_, err := v.client.Auth.UserpassWriteUser(ctx, user, schema.UserpassWriteUserRequest{
 		Password: pass, TokenPolicies: policies,
-	}, vault.WithToken(token), vault.WithMountPath(mountPath))
+	}, v.options(token, vault.WithMountPath(mountPath))...)
 
 	if err != nil {
 		return fmt.Errorf("create userpass [%w]", err)
@@ -113,7 +142,7 @@ func (v *vaultClient) createUserPassAuthUser(ctx context.Context, mountPath stri
 func (v *vaultClient) mountKvEnginePath(ctx context.Context, path string, kvType string, token string) (*vault.Response[map[string]interface{}], error) {
 	resp, err := v.client.System.MountsEnableSecretsEngine(ctx, path, schema.MountsEnableSecretsEngineRequest{
 		Type: kvType,
-	}, vault.WithToken(token))
+	}, v.options(token)...)
 	if err != nil {
 		return nil, fmt.Errorf("enable kv [%w]", err)
 	}
@@ -121,11 +150,22 @@ func (v *vaultClient) mountKvEnginePath(ctx context.Context, path string, kvType
 	return resp, nil
 }
 
+func (v *vaultClient) issuePkiCertificate(ctx context.Context, mountPath string, role string, request schema.PkiIssueWithRoleRequest, token string) (*schema.PkiIssueWithRoleResponse, error) {
+	resp, err := v.client.Secrets.PkiIssueWithRole(ctx, role, request, v.options(token, vault.WithMountPath(mountPath))...)
+	if err != nil {
+		return nil, fmt.Errorf("issue certificate: (%s, %s) [%w]", mountPath, role, err)
+	}
+	if resp == nil || resp.Data.Certificate == "" {
+		return nil, fmt.Errorf("no certificate issued: (%s, %s)", mountPath, role)
+	}
+	slog.Info("issue certificate operation completed", "mountPath", mountPath, "role", role, "common_name", request.CommonName, "serial", resp.Data.SerialNumber)
+	return &resp.Data, nil
+}
+
 func (v *vaultClient) creteOrUpdateKvV2Secret(ctx context.Context, secretPath string, mountPath string, data map[string]interface{}, token string) error {
 	_, err := v.client.Secrets.KvV2Write(ctx, secretPath, schema.KvV2WriteRequest{
 		Data: data,
-	}, vault.WithToken(token),
-		vault.WithMountPath(mountPath))
+	}, v.options(token, vault.WithMountPath(mountPath))...)
 	if err != nil {
 		return fmt.Errorf("enable kv [%w]", err)
 	}
@@ -135,7 +175,7 @@ func (v *vaultClient) creteOrUpdateKvV2Secret(ctx context.Context, secretPath st
 
 func (v *vaultClient) isKVSecretExistent(ctx context.Context, mountPath string, path string, token string) error {
 	slog.Info("checking if secret is existent", "mount", mountPath, "path", path)
-	_, err := v.client.Secrets.KvV2Read(ctx, path, vault.WithMountPath(mountPath), vault.WithToken(token))
+	_, err := v.client.Secrets.KvV2Read(ctx, path, v.options(token, vault.WithMountPath(mountPath))...)
 	return err
 }
 
@@ -143,7 +183,7 @@ func (v *vaultClient) ensurePolicy(ctx context.Context, policyName string, polic
 
 	_, err := v.client.System.PoliciesWriteAclPolicy(ctx, policyName, schema.PoliciesWriteAclPolicyRequest{
 		Policy: policy,
-	}, vault.WithToken(token))
+	}, v.options(token)...)
 	if err != nil {
 		return fmt.Errorf("create policy: [%w]", err)
 	}
@@ -156,47 +196,330 @@ func (v *vaultClient) ensureAppRoleCreate(ctx context.Context, roleName string,
 	res, err := v.client.Auth.AppRoleWriteRole(ctx, roleName, schema.AppRoleWriteRoleRequest{
 		SecretIdTtl: strconv.Itoa(secretIDTTl),
 		Policies:    policies,
-	}, vault.WithMountPath(mountPath), vault.WithToken(token))
+	}, v.options(token, vault.WithMountPath(mountPath))...)
 
 	slog.Info("approle create with success", "role", roleName, "path", mountPath, "policies", policies, "secretTTL", secretIDTTl)
 	return res, err
 }
 
-func (v *vaultClient) generateAppRoleSecretID(ctx context.Context, roleName string, path string, token string) (string, error) {
-	// Using another vault API client sdk because vault-client-go does not support this operation yet
-	// or at least it is trowing an odd erros
-	slog.Info("generating secret id", "role", roleName, "path", path)
-
+// apiClient returns a client of the official vault api sdk, used where
+// vault-client-go does not support the operation yet or at least it is
+// throwing odd errors (secret-id responses carry numbers typed as strings)
+func (v *vaultClient) apiClient(token string) (*vapi.Client, error) {
 	config := vapi.DefaultConfig()
 	config.Address = v.ep
 
 	client, err := vapi.NewClient(config)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	client.SetToken(token)
+	if v.namespace != "" {
+		client.SetNamespace(v.namespace)
+	}
+
+	return client, nil
+}
+
+func (v *vaultClient) generateAppRoleSecretID(ctx context.Context, roleName string, path string, token string) (string, string, error) {
+	slog.Info("generating secret id", "role", roleName, "path", path)
+
+	client, err := v.apiClient(token)
+	if err != nil {
+		return "", "", err
+	}
 
 	request := fmt.Sprintf("auth/%s/role/%s/secret-id", path, roleName)
-	secret, err := client.Logical().Write(request, nil)
+	secret, err := client.Logical().WriteWithContext(ctx, request, nil)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// Extract SecretID and Accessor
-	if secret != nil && secret.Data != nil {
-		return secret.Data["secret_id"].(string), nil
-	} else {
-		return "", fmt.Errorf("no secret data found")
+	if secret == nil || secret.Data == nil {
+		return "", "", fmt.Errorf("no secret data found")
+	}
+
+	secretID, _ := secret.Data["secret_id"].(string)
+	accessor, _ := secret.Data["secret_id_accessor"].(string)
+	return secretID, accessor, nil
+}
+
+// generateWrappedAppRoleSecretID requests a response-wrapped secret-id and
+// returns the wrapping token together with the accessor of the wrapped
+// secret-id. The secret-id itself never leaves vault until it is unwrapped.
+func (v *vaultClient) generateWrappedAppRoleSecretID(ctx context.Context, roleName string, path string, wrapTTL time.Duration, token string) (string, string, error) {
+	slog.Info("generating wrapped secret id", "role", roleName, "path", path, "wrap_ttl", wrapTTL)
+
+	client, err := v.apiClient(token)
+	if err != nil {
+		return "", "", err
+	}
+	client.SetWrappingLookupFunc(func(operation, path string) string {
+		return fmt.Sprintf("%ds", int(wrapTTL.Seconds()))
+	})
+
+	request := fmt.Sprintf("auth/%s/role/%s/secret-id", path, roleName)
+	secret, err := client.Logical().WriteWithContext(ctx, request, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
+		return "", "", fmt.Errorf("no wrap info found")
 	}
 
+	return secret.WrapInfo.Token, secret.WrapInfo.WrappedAccessor, nil
+}
+
+// lookupAppRoleSecretIDAccessor returns the creation time of a secret-id, or
+// found=false when vault does not know the accessor anymore (expired or
+// destroyed).
+func (v *vaultClient) lookupAppRoleSecretIDAccessor(ctx context.Context, roleName string, path string, accessor string, token string) (time.Time, bool, error) {
+	client, err := v.apiClient(token)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	request := fmt.Sprintf("auth/%s/role/%s/secret-id-accessor/lookup", path, roleName)
+	secret, err := client.Logical().WriteWithContext(ctx, request, map[string]interface{}{
+		"secret_id_accessor": accessor,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return time.Time{}, false, nil
+		}
+		return time.Time{}, false, fmt.Errorf("lookup secret id accessor: [%w]", err)
+	}
+
+	if secret == nil || secret.Data == nil {
+		return time.Time{}, false, nil
+	}
+
+	created, _ := secret.Data["creation_time"].(string)
+	creationTime, err := time.Parse(time.RFC3339Nano, created)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("parse secret id creation time: [%w]", err)
+	}
+
+	return creationTime, true, nil
+}
+
+func (v *vaultClient) destroyAppRoleSecretIDAccessor(ctx context.Context, roleName string, path string, accessor string, token string) error {
+	client, err := v.apiClient(token)
+	if err != nil {
+		return err
+	}
+
+	request := fmt.Sprintf("auth/%s/role/%s/secret-id-accessor/destroy", path, roleName)
+	_, err = client.Logical().WriteWithContext(ctx, request, map[string]interface{}{
+		"secret_id_accessor": accessor,
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("destroy secret id accessor: [%w]", err)
+	}
+
+	slog.Info("destroy secret id completed", "role", roleName, "path", path, "accessor", accessor)
+	return nil
+}
+
+// isNotFound matches missing secret-id accessors, older vault versions answer
+// them with a 500 instead of a 404.
+func isNotFound(err error) bool {
+	var respErr *vapi.ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound {
+		return true
+	}
+	return strings.Contains(err.Error(), "failed to find accessor entry")
 }
 
 func (v *vaultClient) getAppRoleRoleID(ctx context.Context, roleName string, path string, token string) (string, error) {
-	resp, err := v.client.Auth.AppRoleReadRoleId(ctx, roleName, vault.WithMountPath(path), vault.WithToken(token))
+	resp, err := v.client.Auth.AppRoleReadRoleId(ctx, roleName, v.options(token, vault.WithMountPath(path))...)
 	if err != nil {
 		return "", fmt.Errorf("get role id: [%w]", err)
 	}
 	slog.Info("get role id with success", "role", roleName, "path", path)
 	return resp.Data.RoleId, nil
 }
+
+func (v *vaultClient) getAuthMountAccessor(ctx context.Context, mountPath string, token string) (string, error) {
+	resp, err := v.client.System.AuthReadConfiguration(ctx, mountPath, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("read auth configuration: (%s) [%w]", mountPath, err)
+	}
+	if resp == nil || resp.Data.Accessor == "" {
+		return "", fmt.Errorf("no accessor found for auth mount: %s", mountPath)
+	}
+	return resp.Data.Accessor, nil
+}
+
+func (v *vaultClient) ensureEntity(ctx context.Context, name string, policies []string, metadata map[string]interface{}, disabled bool, token string) (string, error) {
+	_, err := v.client.Identity.EntityUpdateByName(ctx, name, schema.EntityUpdateByNameRequest{
+		Policies: policies,
+		Metadata: metadata,
+		Disabled: disabled,
+	}, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("write entity: [%w]", err)
+	}
+
+	resp, err := v.client.Identity.EntityReadByName(ctx, name, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("read entity: [%w]", err)
+	}
+
+	id, ok := readString(resp, "id")
+	if !ok {
+		return "", fmt.Errorf("no id found for entity: %s", name)
+	}
+	slog.Info("ensure entity completed", "name", name, "id", id)
+	return id, nil
+}
+
+func (v *vaultClient) ensureGroup(ctx context.Context, name string, groupType string, policies []string, metadata map[string]interface{}, entityIDs []string, groupIDs []string, token string) (string, error) {
+	_, err := v.client.Identity.GroupUpdateByName(ctx, name, schema.GroupUpdateByNameRequest{
+		Type:            groupType,
+		Policies:        policies,
+		Metadata:        metadata,
+		MemberEntityIds: entityIDs,
+		MemberGroupIds:  groupIDs,
+	}, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("write group: [%w]", err)
+	}
+
+	resp, err := v.client.Identity.GroupReadByName(ctx, name, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("read group: [%w]", err)
+	}
+
+	id, ok := readString(resp, "id")
+	if !ok {
+		return "", fmt.Errorf("no id found for group: %s", name)
+	}
+	slog.Info("ensure group completed", "name", name, "type", groupType, "id", id)
+	return id, nil
+}
+
+func (v *vaultClient) ensureEntityAlias(ctx context.Context, name string, mountAccessor string, entityID string, token string) error {
+	resp, err := v.client.Identity.EntityLookUp(ctx, schema.EntityLookUpRequest{
+		AliasName:          name,
+		AliasMountAccessor: mountAccessor,
+	}, v.options(token)...)
+	if err != nil {
+		return fmt.Errorf("lookup entity alias: [%w]", err)
+	}
+
+	if currentID, ok := readString(resp, "id"); ok {
+		if currentID == entityID {
+			slog.Info("entity alias already exists, continuing...", "alias", name, "accessor", mountAccessor)
+			return nil
+		}
+		return fmt.Errorf("alias %s on %s is bound to another entity: %s", name, mountAccessor, currentID)
+	}
+
+	_, err = v.client.Identity.EntityCreateAlias(ctx, schema.EntityCreateAliasRequest{
+		Name:          name,
+		MountAccessor: mountAccessor,
+		CanonicalId:   entityID,
+	}, v.options(token)...)
+	if err != nil {
+		return fmt.Errorf("create entity alias: [%w]", err)
+	}
+	slog.Info("create entity alias completed", "alias", name, "accessor", mountAccessor, "entity", entityID)
+	return nil
+}
+
+func (v *vaultClient) ensureGroupAlias(ctx context.Context, name string, mountAccessor string, groupID string, token string) error {
+	resp, err := v.client.Identity.GroupReadById(ctx, groupID, v.options(token)...)
+	if err != nil {
+		return fmt.Errorf("read group: [%w]", err)
+	}
+
+	var alias map[string]interface{}
+	if resp != nil {
+		alias, _ = resp.Data["alias"].(map[string]interface{})
+	}
+
+	aliasID, _ := alias["id"].(string)
+	if aliasID == "" {
+		_, err = v.client.Identity.GroupCreateAlias(ctx, schema.GroupCreateAliasRequest{
+			Name:          name,
+			MountAccessor: mountAccessor,
+			CanonicalId:   groupID,
+		}, v.options(token)...)
+		if err != nil {
+			return fmt.Errorf("create group alias: [%w]", err)
+		}
+		slog.Info("create group alias completed", "alias", name, "accessor", mountAccessor, "group", groupID)
+		return nil
+	}
+
+	if alias["name"] == name && alias["mount_accessor"] == mountAccessor {
+		slog.Info("group alias already exists, continuing...", "alias", name, "accessor", mountAccessor)
+		return nil
+	}
+
+	_, err = v.client.Identity.GroupUpdateAliasById(ctx, aliasID, schema.GroupUpdateAliasByIdRequest{
+		Name:          name,
+		MountAccessor: mountAccessor,
+		CanonicalId:   groupID,
+	}, v.options(token)...)
+	if err != nil {
+		return fmt.Errorf("update group alias: [%w]", err)
+	}
+	slog.Info("update group alias completed", "alias", name, "accessor", mountAccessor, "group", groupID)
+	return nil
+}
+
+func (v *vaultClient) ensureNamespace(ctx context.Context, path string, token string) error {
+	_, err := v.client.Read(ctx, "sys/namespaces/"+path, v.options(token)...)
+	if err == nil {
+		slog.Info("namespace already exists, continuing...", "parent", v.namespace, "path", path)
+		return nil
+	}
+
+	if !vault.IsErrorStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("read namespace: [%w]", err)
+	}
+
+	_, err = v.client.Write(ctx, "sys/namespaces/"+path, nil, v.options(token)...)
+	if err != nil {
+		return fmt.Errorf("create namespace: [%w]", err)
+	}
+	slog.Info("create namespace completed", "parent", v.namespace, "path", path)
+	return nil
+}
+
+// readString returns a string field from a generic response, vault answers
+// with an empty body (nil response) when a lookup finds nothing.
+func readString(resp *vault.Response[map[string]interface{}], key string) (string, bool) {
+	if resp == nil || resp.Data == nil {
+		return "", false
+	}
+	value, ok := resp.Data[key].(string)
+	return value, ok && value != ""
+}
+
+func (v *vaultClient) generatePasswordFromPolicy(ctx context.Context, policyName string, token string) (string, error) {
+	resp, err := v.client.System.PoliciesGeneratePasswordFromPasswordPolicy(ctx, policyName, v.options(token)...)
+	if err != nil {
+		return "", fmt.Errorf("generate password: (%s) [%w]", policyName, err)
+	}
+	if resp == nil || resp.Data.Password == "" {
+		return "", fmt.Errorf("no password generated by policy: %s", policyName)
+	}
+	return resp.Data.Password, nil
+}
+
+func (v *vaultClient) readKvV2Secret(ctx context.Context, mountPath string, path string, token string) (map[string]interface{}, error) {
+	resp, err := v.client.Secrets.KvV2Read(ctx, path, v.options(token, vault.WithMountPath(mountPath))...)
+	if err != nil {
+		return nil, fmt.Errorf("read kv: (%s, %s) [%w]", mountPath, path, err)
+	}
+	if resp == nil || resp.Data.Data == nil {
+		return nil, fmt.Errorf("no data found for secret: (%s, %s)", mountPath, path)
+	}
+	return resp.Data.Data, nil
+}
@@ -0,0 +1,64 @@
+package vault_manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+)
+
+// WatchVaultPods is the operator mode: every vault pod found through the
+// discovery selector is unsealed by its pod IP as soon as it runs, so a
+// rolling restart does not wait for the next cycle. It blocks until ctx is
+// done.
+func (v *vaultManager) WatchVaultPods(ctx context.Context, k8s *exporter.KubernetesClient, cfg *conf.Discovery) error {
+	return k8s.WatchPods(ctx, cfg.Namespace, cfg.LabelSelector, cfg.ResyncInterval, func(name string, ip string) {
+		address := fmt.Sprintf("%s://%s", cfg.Scheme, net.JoinHostPort(ip, strconv.Itoa(cfg.Port)))
+		if err := v.unsealPod(ctx, address, cfg.TLSSkipVerify); err != nil {
+			slog.Warn("not possible to unseal vault pod, continuing...", "pod", name, "address", address, "err", err)
+		}
+	})
+}
+
+func (v *vaultManager) unsealPod(ctx context.Context, address string, tlsSkipVerify bool) error {
+	client, err := newVaultClient(address, tlsSkipVerify)
+	if err != nil {
+		return err
+	}
+
+	pod := *v
+	pod.vaultClient = client
+
+	initialized, err := pod.isInitialized(ctx)
+	if err != nil {
+		return fmt.Errorf("checking if vault is initialized: [%w]", err)
+	}
+	if !initialized {
+		// the cycle initializes vault through the unlocker url
+		slog.Info("vault pod not initialized yet, skipping", "address", address)
+		return nil
+	}
+
+	sealed, err := pod.isSealed(ctx)
+	if err != nil {
+		return fmt.Errorf("checking if vault is sealed: [%w]", err)
+	}
+	if !sealed {
+		return nil
+	}
+
+	keys, err := v.storedUnsealKeys()
+	if err != nil {
+		return err
+	}
+
+	if err := pod.unseal(ctx, keys); err != nil {
+		return err
+	}
+
+	slog.Info("vault pod unsealed", "address", address)
+	return nil
+}
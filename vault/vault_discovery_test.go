@@ -0,0 +1,107 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWatchVaultPods(t *testing.T) {
+	var mu sync.Mutex
+	sealed := true
+	keys := []string{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch r.URL.Path {
+		case "/v1/sys/init":
+			_, _ = w.Write([]byte(`{"initialized":true}`))
+		case "/v1/sys/seal-status":
+			fmt.Fprintf(w, `{"data":{"sealed":%t}}`, sealed)
+		case "/v1/sys/unseal":
+			req := struct {
+				Key string `json:"key"`
+			}{}
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			keys = append(keys, req.Key)
+			sealed = len(keys) < 3
+			fmt.Fprintf(w, `{"data":{"sealed":%t}}`, sealed)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	host, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	assert.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+
+	store := &memStorage{data: map[string]string{"keys/0": "k0", "keys/1": "k1", "keys/2": "k2"}}
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+	vm, err := NewVaultManager(&conf.Unlocker{NumberKeys: 3}, nil, client, store, nil)
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- vm.WatchVaultPods(ctx, k8s, &conf.Discovery{
+			Namespace:      "vault",
+			LabelSelector:  "app.kubernetes.io/name=vault",
+			Port:           portNum,
+			Scheme:         "http",
+			ResyncInterval: time.Minute,
+		})
+	}()
+
+	pods := k8s.Client.CoreV1().Pods("vault")
+	_, err = pods.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "other", Labels: map[string]string{"app.kubernetes.io/name": "consul"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.255.255.1"},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// pending pods are ignored until they run
+	pod, err := pods.Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "vault-0", Labels: map[string]string{"app.kubernetes.io/name": "vault"}},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	pod.Status = corev1.PodStatus{Phase: corev1.PodRunning, PodIP: host}
+	_, err = pods.UpdateStatus(ctx, pod, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return !sealed
+	}, 5*time.Second, 20*time.Millisecond)
+
+	mu.Lock()
+	assert.Equal(t, []string{"k0", "k1", "k2"}, keys)
+	mu.Unlock()
+
+	cancel()
+	assert.NoError(t, <-done)
+}
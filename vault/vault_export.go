@@ -0,0 +1,167 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+)
+
+// exportUsers syncs the credentials of userpass users with an export
+// block to their exporter.
+func (v *vaultManager) exportUsers(ctx context.Context, mountPath string, users []conf.User) {
+	for _, user := range users {
+		if user.Export == nil {
+			continue
+		}
+
+		err := v.exportSecret(ctx, user.Export, user.Name, map[string]string{
+			"username": user.Name,
+			"password": user.Pass,
+		})
+		if err != nil {
+			slog.Warn("not possible to export user, continuing...", "user", user.Name, "path", mountPath, "namespace", user.Export.Namespace, "err", err)
+		}
+	}
+}
+
+// exportKvSecrets syncs kv secrets with an export block to their
+// exporter. The data is read back from vault so generated values match.
+func (v *vaultManager) exportKvSecrets(ctx context.Context, token string) {
+	for _, mount := range v.provisioner.Mount {
+		for _, secret := range mount.Secrets {
+			if secret.Export == nil {
+				continue
+			}
+
+			if err := v.exportKvSecret(ctx, mount.Path, secret, token); err != nil {
+				slog.Warn("not possible to export secret, continuing...", "mount", mount.Path, "path", secret.Path, "secret", secret.Name, "namespace", secret.Export.Namespace, "err", err)
+			}
+		}
+	}
+}
+
+func (v *vaultManager) exportKvSecret(ctx context.Context, mountPath string, secret conf.Secrets, token string) error {
+	secretPathName, err := url.JoinPath(secret.Path, secret.Name)
+	if err != nil {
+		return fmt.Errorf("manipulating secret path: [%w]", err)
+	}
+
+	stored, err := v.readKvV2Secret(ctx, mountPath, secretPathName, token)
+	if err != nil {
+		return fmt.Errorf("read secret: [%w]", err)
+	}
+
+	data := make(map[string]string, len(stored))
+	for k, value := range stored {
+		str, ok := value.(string)
+		if !ok {
+			// nested maps and lists are exported as json
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("%s: [%w]", k, err)
+			}
+			str = string(raw)
+		}
+		data[k] = str
+	}
+
+	return v.exportSecret(ctx, secret.Export, secret.Name, data)
+}
+
+func (v *vaultManager) exportSecret(ctx context.Context, export *conf.SecretExport, defaultName string, data map[string]string) error {
+	name := exportName(export, defaultName)
+
+	secretData, err := buildExportData(export, data)
+	if err != nil {
+		return err
+	}
+
+	exp, err := v.exporter(export.Metadata.Exporter)
+	if err != nil {
+		return err
+	}
+
+	if err := exp.Write(ctx, exporter.Secret{
+		Namespace:   export.Namespace,
+		Name:        name,
+		Type:        export.Type,
+		Labels:      export.Metadata.Labels,
+		Annotations: export.Metadata.Annotations,
+		Data:        secretData,
+		Force:       export.Metadata.Force,
+	}); err != nil {
+		return fmt.Errorf("write exported secret: [%w]", err)
+	}
+
+	slog.Info("exported secret", "exporter", export.Metadata.Exporter, "name", name, "namespace", export.Namespace, "type", export.Type)
+	return nil
+}
+
+func exportName(export *conf.SecretExport, defaultName string) string {
+	if export.Name != "" {
+		return export.Name
+	}
+	return defaultName
+}
+
+// buildExportData renames the keys and shapes the data for the secret type.
+func buildExportData(export *conf.SecretExport, data map[string]string) (map[string][]byte, error) {
+	renamed := make(map[string]string, len(data))
+	for k, value := range data {
+		if target, ok := export.Keys[k]; ok {
+			k = target
+		}
+		renamed[k] = value
+	}
+
+	switch export.Type {
+	case "kubernetes.io/basic-auth":
+		_, hasUser := renamed["username"]
+		_, hasPass := renamed["password"]
+		if !hasUser && !hasPass {
+			return nil, fmt.Errorf("basic-auth secret requires a username or password key, found: %v", sortedKeys(renamed))
+		}
+
+	case "kubernetes.io/dockerconfigjson":
+		username, hasUser := renamed["username"]
+		password, hasPass := renamed["password"]
+		if !hasUser || !hasPass {
+			return nil, fmt.Errorf("dockerconfigjson secret requires username and password keys, found: %v", sortedKeys(renamed))
+		}
+
+		raw, err := json.Marshal(map[string]interface{}{
+			"auths": map[string]interface{}{
+				export.Registry: map[string]string{
+					"username": username,
+					"password": password,
+					"auth":     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+				},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{".dockerconfigjson": raw}, nil
+	}
+
+	result := make(map[string][]byte, len(renamed))
+	for k, value := range renamed {
+		result[k] = []byte(value)
+	}
+	return result, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
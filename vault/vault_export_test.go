@@ -0,0 +1,98 @@
+package vault_manager
+
+import (
+	"context"
+	"testing"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestBuildExportData(t *testing.T) {
+	credentials := map[string]string{"username": "ci", "password": "s3cret"}
+
+	data, err := buildExportData(&conf.SecretExport{Type: "Opaque", Keys: map[string]string{"password": "token"}}, credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"username": []byte("ci"), "token": []byte("s3cret")}, data)
+
+	data, err = buildExportData(&conf.SecretExport{Type: "kubernetes.io/dockerconfigjson", Registry: "registry.local"}, credentials)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"auths":{"registry.local":{"username":"ci","password":"s3cret","auth":"Y2k6czNjcmV0"}}}`, string(data[".dockerconfigjson"]))
+	assert.Len(t, data, 1)
+
+	_, err = buildExportData(&conf.SecretExport{Type: "kubernetes.io/basic-auth"}, map[string]string{"token": "x"})
+	assert.ErrorContains(t, err, "basic-auth")
+
+	_, err = buildExportData(&conf.SecretExport{Type: "kubernetes.io/dockerconfigjson", Registry: "r"}, map[string]string{"username": "x"})
+	assert.ErrorContains(t, err, "dockerconfigjson")
+}
+
+func TestExportUsersAndSecrets(t *testing.T) {
+	srv, stored := newKvStub()
+	defer srv.Close()
+	stored["/v1/apps/web/db"] = map[string]interface{}{
+		"user":     "web",
+		"password": "generated",
+		"hosts":    []interface{}{"a", "b"},
+	}
+
+	data := []byte(`
+provisioner:
+  auth:
+    - type: userpass
+      path: userpass
+      users:
+        - name: ci
+          pass: s3cret
+          export:
+            namespace: build
+            type: kubernetes.io/basic-auth
+        - name: not-exported
+          pass: x
+  mounts:
+    - type: kv-v2
+      path: apps
+      secrets:
+        - path: web
+          name: db
+          export:
+            namespace: web
+            name: web-db
+            keys:
+              user: username
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, nil, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	vm.export(ctx, "token")
+
+	user, err := k8s.Client.CoreV1().Secrets("build").Get(ctx, "ci", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeBasicAuth, user.Type)
+	assert.Equal(t, map[string][]byte{"username": []byte("ci"), "password": []byte("s3cret")}, user.Data)
+
+	secret, err := k8s.Client.CoreV1().Secrets("web").Get(ctx, "web-db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, corev1.SecretTypeOpaque, secret.Type)
+	assert.Equal(t, map[string][]byte{
+		"username": []byte("web"),
+		"password": []byte("generated"),
+		"hosts":    []byte(`["a","b"]`),
+	}, secret.Data)
+
+	list, err := k8s.Client.CoreV1().Secrets("").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Items, 2)
+}
@@ -0,0 +1,200 @@
+package vault_manager
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"vault-unlocker/conf"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type renderer struct {
+	generate func(g *conf.Generator) (string, error)
+	resolve  func(src conf.Source) (interface{}, error)
+}
+
+// renderSecretData returns a copy of data with every generator marker
+// replaced by a freshly generated value and every source resolved. kept are
+// the values stored in vault, bcrypt markers of data may reference them.
+func (v *vaultManager) renderSecretData(ctx context.Context, data map[string]interface{}, kept map[string]interface{}, token string) (map[string]interface{}, error) {
+	refs := map[string]map[string]interface{}{}
+
+	return renderMap(data, kept, &renderer{
+		generate: func(g *conf.Generator) (string, error) {
+			if g.Kind == "password-policy" {
+				return v.generatePasswordFromPolicy(ctx, g.Ref, token)
+			}
+			return generate(g)
+		},
+		resolve: func(src conf.Source) (interface{}, error) {
+			return v.resolveSource(ctx, src, refs, token)
+		},
+	})
+}
+
+// renderMap renders m, a bcrypt marker hashes the rendered value of its
+// sibling or, when that one is not rendered, its value in kept as is.
+func renderMap(m map[string]interface{}, kept map[string]interface{}, r *renderer) (map[string]interface{}, error) {
+	result := make(map[string]interface{}, len(m))
+	hashes := map[string]*conf.Generator{}
+
+	for k, v := range m {
+		if str, ok := v.(string); ok {
+			g, isGen, err := conf.ParseGenerator(str)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			// bcrypt needs the final value of its sibling, resolved below
+			if isGen && g.Kind == "bcrypt" {
+				hashes[k] = g
+				continue
+			}
+		}
+
+		rendered, err := renderValue(v, r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", k, err)
+		}
+		result[k] = rendered
+	}
+
+	for k, g := range hashes {
+		sibling, rendered := result[g.Ref]
+		if !rendered {
+			sibling = kept[g.Ref]
+		}
+		ref, ok := sibling.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: bcrypt references unknown key: %s", k, g.Ref)
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(ref), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("%s: [%w]", k, err)
+		}
+		result[k] = string(hash)
+	}
+
+	return result, nil
+}
+
+func renderValue(v interface{}, r *renderer) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		g, isGen, err := conf.ParseGenerator(val)
+		if err != nil {
+			return nil, err
+		}
+		if isGen {
+			return r.generate(g)
+		}
+		return conf.ExpandSources(val, func(src conf.Source) (interface{}, error) {
+			if r.resolve == nil {
+				return nil, fmt.Errorf("sources not supported here: %s", src.Kind)
+			}
+			return r.resolve(src)
+		})
+	case map[string]interface{}:
+		return renderMap(val, nil, r)
+	case []interface{}:
+		result := make([]interface{}, len(val))
+		for i, item := range val {
+			rendered, err := renderValue(item, r)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			result[i] = rendered
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+func generate(g *conf.Generator) (string, error) {
+	switch g.Kind {
+	case "random":
+		return generateRandomString(g.Length, conf.Charsets[g.Charset])
+	case "password":
+		return generatePassword(g.Length, g.Charset == "symbols")
+	case "uuid":
+		return uuid.NewString(), nil
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, g.Bits)
+		if err != nil {
+			return "", err
+		}
+		return encodePrivateKey(key)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		return encodePrivateKey(key)
+	default:
+		return "", fmt.Errorf("generator not supported here: %s", g.Kind)
+	}
+}
+
+func generateRandomString(length int, charset string) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(charset)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = charset[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// generatePassword guarantees at least one character of every class, the
+// remaining ones are drawn from all classes and the result is shuffled.
+func generatePassword(length int, symbols bool) (string, error) {
+	classes := []string{conf.Charsets["lower"], conf.Charsets["upper"], conf.Charsets["numeric"]}
+	if symbols {
+		classes = append(classes, conf.Charsets["symbols"])
+	}
+
+	all := ""
+	result := make([]byte, 0, length)
+	for _, class := range classes {
+		all += class
+		c, err := generateRandomString(1, class)
+		if err != nil {
+			return "", err
+		}
+		result = append(result, c...)
+	}
+
+	rest, err := generateRandomString(length-len(result), all)
+	if err != nil {
+		return "", err
+	}
+	result = append(result, rest...)
+
+	for i := len(result) - 1; i > 0; i-- {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		result[i], result[j.Int64()] = result[j.Int64()], result[i]
+	}
+
+	return string(result), nil
+}
+
+func encodePrivateKey(key interface{}) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
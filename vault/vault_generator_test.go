@@ -0,0 +1,92 @@
+package vault_manager
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRenderSecretData(t *testing.T) {
+	input := map[string]interface{}{
+		"plain":    "value",
+		"number":   42,
+		"random":   "*random*",
+		"hex":      "*random:64:hex*",
+		"id":       "*uuid*",
+		"password": "*password:24:symbols*",
+		"hash":     "*bcrypt:password*",
+		"key":      "*ed25519*",
+		"nested": map[string]interface{}{
+			"token": "*random:8*",
+			"list":  []interface{}{"*random:4:numeric*", "keep"},
+		},
+	}
+
+	result, err := renderMap(input, nil, &renderer{generate: generate})
+	assert.NoError(t, err)
+
+	assert.Equal(t, "value", result["plain"])
+	assert.Equal(t, 42, result["number"])
+	assert.Len(t, result["random"], 32)
+
+	_, err = hex.DecodeString(result["hex"].(string))
+	assert.NoError(t, err)
+	assert.Len(t, result["hex"], 64)
+
+	_, err = uuid.Parse(result["id"].(string))
+	assert.NoError(t, err)
+
+	password := result["password"].(string)
+	assert.Len(t, password, 24)
+	assert.True(t, strings.ContainsAny(password, conf.Charsets["symbols"]))
+	assert.True(t, strings.ContainsAny(password, conf.Charsets["numeric"]))
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(result["hash"].(string)), []byte(password)))
+
+	block, _ := pem.Decode([]byte(result["key"].(string)))
+	assert.NotNil(t, block)
+	_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	assert.NoError(t, err)
+
+	nested := result["nested"].(map[string]interface{})
+	assert.Len(t, nested["token"], 8)
+	list := nested["list"].([]interface{})
+	assert.Len(t, list[0], 4)
+	assert.Equal(t, "keep", list[1])
+
+	// source map must stay untouched so the next cycle renders again
+	assert.Equal(t, "*random*", input["random"])
+
+	again, err := renderMap(input, nil, &renderer{generate: generate})
+	assert.NoError(t, err)
+	assert.NotEqual(t, result["random"], again["random"])
+}
+
+func TestRenderSecretDataKept(t *testing.T) {
+	input := map[string]interface{}{"hash": "*bcrypt:password*"}
+	kept := map[string]interface{}{"password": "${x}"}
+
+	// kept values are hashed as stored, never rendered again
+	result, err := renderMap(input, kept, &renderer{generate: generate})
+	assert.NoError(t, err)
+	assert.NotContains(t, result, "password")
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(result["hash"].(string)), []byte("${x}")))
+
+	// kept values are only reachable from the top level
+	_, err = renderMap(map[string]interface{}{"nested": input}, kept, &renderer{generate: generate})
+	assert.ErrorContains(t, err, "bcrypt references unknown key")
+}
+
+func TestRenderSecretDataErrors(t *testing.T) {
+	_, err := renderMap(map[string]interface{}{"a": "*nope*"}, nil, &renderer{generate: generate})
+	assert.ErrorContains(t, err, "unknown generator")
+
+	_, err = renderMap(map[string]interface{}{"a": "*password-policy:strong*"}, nil, &renderer{generate: generate})
+	assert.ErrorContains(t, err, "not supported here")
+}
@@ -0,0 +1,115 @@
+package vault_manager
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"vault-unlocker/conf"
+)
+
+func (v *vaultManager) ensureIdentityProvisioned(ctx context.Context, token string) error {
+	if v.provisioner == nil || v.provisioner.Identity == nil {
+		slog.Warn("no identity is going to be provisioned")
+		return nil
+	}
+
+	accessors := map[string]string{}
+	accessor := func(mount string) (string, error) {
+		mount = strings.Trim(mount, "/")
+		if acc, ok := accessors[mount]; ok {
+			return acc, nil
+		}
+		acc, err := v.getAuthMountAccessor(ctx, mount, token)
+		if err != nil {
+			return "", err
+		}
+		accessors[mount] = acc
+		return acc, nil
+	}
+
+	entityIDs := map[string]string{}
+	for _, entity := range v.provisioner.Identity.Entities {
+		id, err := v.ensureEntity(ctx, entity.Name, entity.Policies, toMetadata(entity.Metadata), entity.Disabled, token)
+		if err != nil {
+			slog.Warn("not possible to create entity, continuing...", "entity", entity.Name, "err", err)
+			continue
+		}
+		entityIDs[entity.Name] = id
+
+		for _, alias := range entity.Aliases {
+			acc, err := accessor(alias.Mount)
+			if err != nil {
+				slog.Warn("not possible to resolve auth mount accessor, continuing...", "entity", entity.Name, "mount", alias.Mount, "err", err)
+				continue
+			}
+			if err := v.ensureEntityAlias(ctx, alias.Name, acc, id, token); err != nil {
+				slog.Warn("not possible to create entity alias, continuing...", "entity", entity.Name, "alias", alias.Name, "err", err)
+			}
+		}
+	}
+
+	groups, err := conf.SortGroups(v.provisioner.Identity.Groups)
+	if err != nil {
+		return fmt.Errorf("identity groups: [%w]", err)
+	}
+
+	groupIDs := map[string]string{}
+	for _, group := range groups {
+		members, err := resolveIDs(group.MemberEntities, entityIDs)
+		if err != nil {
+			slog.Warn("not possible to resolve group entities, continuing...", "group", group.Name, "err", err)
+			continue
+		}
+		memberGroups, err := resolveIDs(group.MemberGroups, groupIDs)
+		if err != nil {
+			slog.Warn("not possible to resolve group members, continuing...", "group", group.Name, "err", err)
+			continue
+		}
+
+		id, err := v.ensureGroup(ctx, group.Name, group.Type, group.Policies, toMetadata(group.Metadata), members, memberGroups, token)
+		if err != nil {
+			slog.Warn("not possible to create group, continuing...", "group", group.Name, "err", err)
+			continue
+		}
+		groupIDs[group.Name] = id
+
+		if group.Alias == nil {
+			continue
+		}
+
+		acc, err := accessor(group.Alias.Mount)
+		if err != nil {
+			slog.Warn("not possible to resolve auth mount accessor, continuing...", "group", group.Name, "mount", group.Alias.Mount, "err", err)
+			continue
+		}
+		if err := v.ensureGroupAlias(ctx, group.Alias.Name, acc, id, token); err != nil {
+			slog.Warn("not possible to create group alias, continuing...", "group", group.Name, "alias", group.Alias.Name, "err", err)
+		}
+	}
+
+	return nil
+}
+
+func resolveIDs(names []string, ids map[string]string) ([]string, error) {
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		id, ok := ids[name]
+		if !ok {
+			return nil, fmt.Errorf("id not available for: %s", name)
+		}
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+func toMetadata(m map[string]string) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
@@ -0,0 +1,199 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+	"vault-unlocker/storage"
+)
+
+const (
+	journalTable = "journal"
+	initJournal  = "init"
+	// stagedInit is the init response staged in the keys table, next to the
+	// keys it holds, until they are committed.
+	stagedInit = "staged-init"
+)
+
+// init journal states, a journal is deleted once the keys are committed
+const (
+	initPending = "pending"
+	initStaged  = "staged"
+)
+
+// initStep names the points of the first initialization a crash can happen
+// after, see vaultManager.afterInitStep.
+type initStep string
+
+const (
+	stepIntent    initStep = "intent"
+	stepInit      initStep = "init"
+	stepStaged    initStep = "staged"
+	stepCommitted initStep = "committed"
+)
+
+// initRecord is the journal of the first initialization. Pending is written
+// before vault is initialized, staged once the init response is stored under
+// stagedInit. The journal itself never holds the token or the keys.
+type initRecord struct {
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+}
+
+// initialize initializes vault through the journal: intent, init, staged
+// response, then token and keys committed together with the journal removal.
+// Every write is synced by the storage before the next step.
+func (v *vaultManager) initialize(ctx context.Context) (map[string]interface{}, error) {
+	record := &initRecord{State: initPending, Started: time.Now().UTC()}
+	if err := v.saveInitRecord(record); err != nil {
+		return nil, fmt.Errorf("write init intent: [%w]", err)
+	}
+	v.step(stepIntent)
+
+	dataKeys, err := v.init(ctx, int32(v.accessKeysNum))
+	if err != nil {
+		// vault refused, nothing to recover
+		if derr := v.storage.Delete(journalTable, initJournal); derr != nil {
+			slog.Warn("not possible to clear init journal, continuing...", "err", derr)
+		}
+		return nil, err
+	}
+	v.step(stepInit)
+
+	if err := v.stageInit(record, dataKeys); err != nil {
+		return nil, fmt.Errorf("stage init response: [%w]", err)
+	}
+	v.step(stepStaged)
+
+	if err := v.commitInit(dataKeys); err != nil {
+		return nil, err
+	}
+	v.step(stepCommitted)
+
+	return dataKeys, nil
+}
+
+// recoverInit finishes an initialization interrupted by a crash. A staged
+// response is committed and returned so it is handled like a fresh init. A
+// pending journal is dropped when vault is still uninitialized, otherwise the
+// keys of that init were lost and unlocking stops.
+func (v *vaultManager) recoverInit(isInit bool) (map[string]interface{}, error) {
+	raw, err := v.storage.Get(journalTable, initJournal)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read init journal: [%w]", err)
+	}
+
+	record := &initRecord{}
+	if err := json.Unmarshal(raw, record); err != nil {
+		return nil, fmt.Errorf("decode init journal: [%w]", err)
+	}
+
+	switch record.State {
+	case initStaged:
+		if !isInit {
+			return nil, fmt.Errorf("an interrupted run started at %s staged keys but vault is not initialized", record.Started.Format(time.RFC3339))
+		}
+		raw, err := v.storage.Get(kvKey, stagedInit)
+		if err != nil {
+			return nil, fmt.Errorf("read staged init response: [%w]", err)
+		}
+		dataKeys := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &dataKeys); err != nil {
+			return nil, fmt.Errorf("decode staged init response: [%w]", err)
+		}
+		slog.Warn("committing the keys of an interrupted initialization", "started", record.Started)
+		if err := v.commitInit(dataKeys); err != nil {
+			return nil, err
+		}
+		return dataKeys, nil
+
+	case initPending:
+		if isInit {
+			return nil, fmt.Errorf("vault was initialized by an interrupted run started at %s and its keys were never stored, recover them manually", record.Started.Format(time.RFC3339))
+		}
+		slog.Warn("vault was not initialized by an interrupted run, initializing again", "started", record.Started)
+		if err := v.storage.Delete(journalTable, initJournal); err != nil {
+			return nil, fmt.Errorf("clear init journal: [%w]", err)
+		}
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown init journal state: %s", record.State)
+	}
+}
+
+// stageInit stores the init response in the keys table and marks the journal
+// staged, in a single transaction.
+func (v *vaultManager) stageInit(record *initRecord, dataKeys map[string]interface{}) error {
+	response, err := json.Marshal(dataKeys)
+	if err != nil {
+		return err
+	}
+
+	record.State = initStaged
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return v.storage.Update(func(tx storage.Tx) error {
+		if err := tx.Put(kvKey, stagedInit, response); err != nil {
+			return err
+		}
+		return tx.Put(journalTable, initJournal, raw)
+	})
+}
+
+// commitInit stores the token and every key, and removes the staged response
+// and the journal, in a single transaction.
+func (v *vaultManager) commitInit(dataKeys map[string]interface{}) error {
+	token, ok := dataKeys["root_token"].(string)
+	if !ok {
+		return errors.New("root_token not received")
+	}
+
+	unsealKeys, ok := dataKeys["keys"].([]interface{})
+	if !ok {
+		return errors.New("keys not received")
+	}
+
+	err := v.storage.Update(func(tx storage.Tx) error {
+		if err := tx.Put(kvKey, "token", []byte(token)); err != nil {
+			return err
+		}
+		for i, key := range unsealKeys {
+			if err := tx.Put(kvKey, strconv.Itoa(i), []byte(key.(string))); err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(kvKey, stagedInit); err != nil {
+			return err
+		}
+		return tx.Delete(journalTable, initJournal)
+	})
+	if err != nil {
+		return fmt.Errorf("unlock store keys: [%w]", err)
+	}
+	return nil
+}
+
+func (v *vaultManager) saveInitRecord(record *initRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return v.storage.Put(journalTable, initJournal, raw)
+}
+
+func (v *vaultManager) step(step initStep) {
+	if v.afterInitStep != nil {
+		v.afterInitStep(step)
+	}
+}
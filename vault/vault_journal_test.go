@@ -0,0 +1,145 @@
+package vault_manager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"vault-unlocker/conf"
+	"vault-unlocker/storage"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const crashExitCode = 3
+
+// TestInitCrashHelper is run by TestInitCrash in a child process which exits
+// after the step named by UNLOCKER_CRASH_AT.
+func TestInitCrashHelper(t *testing.T) {
+	at := os.Getenv("UNLOCKER_CRASH_AT")
+	if at == "" {
+		t.Skip("only run by TestInitCrash")
+	}
+
+	vm := newJournalManager(t, os.Getenv("UNLOCKER_CRASH_URL"), os.Getenv("UNLOCKER_CRASH_DB"))
+	vm.afterInitStep = func(step initStep) {
+		if step == initStep(at) {
+			os.Exit(crashExitCode)
+		}
+	}
+
+	_, err := vm.unlock(context.Background())
+	t.Fatalf("unlock returned without crashing: %v", err)
+}
+
+func TestInitCrash(t *testing.T) {
+	scenarios := []struct {
+		step     initStep
+		inits    int
+		returned bool
+		expected string
+	}{
+		// vault was never initialized, the intent is dropped and init runs again
+		{step: stepIntent, inits: 1, returned: true},
+		// vault kept the keys it returned, nothing can recover them
+		{step: stepInit, inits: 1, expected: "its keys were never stored"},
+		// the staged response is committed and handed back as a fresh init
+		{step: stepStaged, inits: 1, returned: true},
+		// the keys are stored, vault is unsealed with them as on any restart
+		{step: stepCommitted, inits: 1},
+	}
+
+	for _, scenario := range scenarios {
+		t.Run(string(scenario.step), func(t *testing.T) {
+			stub := &vaultStub{}
+			srv := httptest.NewServer(stub)
+			defer srv.Close()
+
+			db := filepath.Join(t.TempDir(), "unlocker.db")
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestInitCrashHelper$")
+			cmd.Env = append(os.Environ(),
+				"UNLOCKER_CRASH_AT="+string(scenario.step),
+				"UNLOCKER_CRASH_URL="+srv.URL,
+				"UNLOCKER_CRASH_DB="+db,
+			)
+			out, err := cmd.CombinedOutput()
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) || exitErr.ExitCode() != crashExitCode {
+				t.Fatalf("child did not crash at %s: %v\n%s", scenario.step, err, out)
+			}
+
+			vm := newJournalManager(t, srv.URL, db)
+
+			// the journal never holds the token or the keys
+			if journal, err := vm.storage.Get(journalTable, initJournal); err == nil {
+				assert.NotContains(t, string(journal), "root")
+				assert.NotContains(t, string(journal), "k0")
+			}
+
+			dataKeys, err := vm.unlock(context.Background())
+			if scenario.expected != "" {
+				assert.ErrorContains(t, err, scenario.expected)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, scenario.inits, stub.inits)
+			assert.Equal(t, scenario.returned, dataKeys != nil)
+
+			_, err = vm.storage.Get(journalTable, initJournal)
+			assert.ErrorIs(t, err, storage.ErrNotFound)
+			_, err = vm.storage.Get(kvKey, stagedInit)
+			assert.ErrorIs(t, err, storage.ErrNotFound)
+
+			keys, err := vm.storedUnsealKeys()
+			assert.NoError(t, err)
+			assert.Equal(t, []interface{}{"k0", "k1", "k2"}, keys)
+			token, err := vm.rootToken()
+			assert.NoError(t, err)
+			assert.Equal(t, "root", token)
+			assert.Equal(t, 3, stub.unsealed)
+		})
+	}
+}
+
+func newJournalManager(t *testing.T, url string, db string) *vaultManager {
+	client, err := NewVaultClient(&conf.Unlocker{Url: url})
+	assert.NoError(t, err)
+
+	store, err := storage.NewBoltDBStorage(&conf.BoltBD{Path: db}, 0)
+	assert.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	vm, err := NewVaultManager(&conf.Unlocker{NumberKeys: 3}, nil, client, store, nil)
+	assert.NoError(t, err)
+	return vm
+}
+
+// vaultStub answers the init, seal status and unseal calls and remembers
+// whether vault was initialized across processes.
+type vaultStub struct {
+	inits    int
+	unsealed int
+}
+
+func (s *vaultStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/sys/init" && r.Method == http.MethodGet:
+		fmt.Fprintf(w, `{"initialized":%t}`, s.inits > 0)
+	case r.URL.Path == "/v1/sys/init":
+		s.inits++
+		_, _ = w.Write([]byte(`{"keys":["k0","k1","k2"],"root_token":"root"}`))
+	case r.URL.Path == "/v1/sys/seal-status":
+		fmt.Fprintf(w, `{"data":{"sealed":%t}}`, s.unsealed < 3)
+	case r.URL.Path == "/v1/sys/unseal":
+		s.unsealed++
+		fmt.Fprintf(w, `{"data":{"sealed":%t}}`, s.unsealed < 3)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
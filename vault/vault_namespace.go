@@ -0,0 +1,45 @@
+package vault_manager
+
+import (
+	"context"
+	"log/slog"
+	"path"
+	"vault-unlocker/conf"
+)
+
+func (v *vaultManager) ensureNamespacesProvisioned(ctx context.Context, token string) error {
+	if v.provisioner == nil || v.provisioner.Namespaces == nil {
+		return nil
+	}
+
+	for _, ns := range v.provisioner.Namespaces {
+		scoped := v.inNamespace(ns)
+
+		if err := v.ensureNamespace(ctx, ns.Path, token); err != nil {
+			slog.Warn("not possible to create namespace, continuing...", "namespace", scoped.namespace, "err", err)
+			continue
+		}
+
+		if err := scoped.provision(ctx, token); err != nil {
+			slog.Warn("not possible to provision namespace, continuing...", "namespace", scoped.namespace, "err", err)
+			continue
+		}
+
+		scoped.export(ctx, token)
+
+		if err := scoped.ensureNamespacesProvisioned(ctx, token); err != nil {
+			slog.Warn("not possible to provision child namespaces, continuing...", "namespace", scoped.namespace, "err", err)
+		}
+	}
+
+	return nil
+}
+
+// inNamespace returns a manager bound to a child namespace, every vault call
+// it makes carries the full namespace path.
+func (v *vaultManager) inNamespace(ns conf.Namespace) *vaultManager {
+	scoped := *v
+	scoped.vaultClient = v.vaultClient.withNamespace(path.Join(v.namespace, ns.Path))
+	scoped.provisioner = &ns.Provisioner
+	return &scoped
+}
@@ -0,0 +1,74 @@
+package vault_manager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"vault-unlocker/conf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNamespacesProvisioned(t *testing.T) {
+	var mu sync.Mutex
+	existing := map[string]bool{"team-a": true}
+	requests := []string{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		ns := r.Header.Get("X-Vault-Namespace")
+		requests = append(requests, r.Method+" "+r.URL.Path+" ns="+ns)
+
+		switch {
+		case r.URL.Path == "/v1/sys/namespaces/team-a" || r.URL.Path == "/v1/sys/namespaces/dev":
+			name := r.URL.Path[len("/v1/sys/namespaces/"):]
+			if r.Method == http.MethodGet && !existing[name] {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			existing[name] = true
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	data := []byte(`
+provisioner:
+  namespaces:
+    - path: team-a
+      policies:
+        - name: reader
+          rules: path "secret/*" { capabilities = ["read"] }
+      namespaces:
+        - path: dev
+          policies:
+            - name: writer
+              rules: path "secret/*" { capabilities = ["create"] }
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, nil, nil)
+	assert.NoError(t, err)
+
+	err = vm.ensureNamespacesProvisioned(context.Background(), "token")
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"GET /v1/sys/namespaces/team-a ns=",
+		"POST /v1/sys/policies/acl/reader ns=team-a",
+		"GET /v1/sys/namespaces/dev ns=team-a",
+		"POST /v1/sys/namespaces/dev ns=team-a",
+		"POST /v1/sys/policies/acl/writer ns=team-a/dev",
+	}, requests)
+}
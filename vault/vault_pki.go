@@ -0,0 +1,128 @@
+package vault_manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/hashicorp/vault-client-go/schema"
+)
+
+const (
+	annotationNotBefore       = "vault-unlocker/not-before"
+	annotationNotAfter        = "vault-unlocker/not-after"
+	annotationCertificateSpec = "vault-unlocker/certificate-spec"
+)
+
+// exportCertificates issues the certificates of every pki mount and keeps
+// their kubernetes.io/tls exports renewed. Every reconcile cycle checks the
+// expiry recorded in the secret annotations.
+func (v *vaultManager) exportCertificates(ctx context.Context, token string) {
+	for _, mount := range v.provisioner.Mount {
+		for _, cert := range mount.Certificates {
+			if err := v.exportCertificate(ctx, mount.Path, cert, token); err != nil {
+				slog.Warn("not possible to export certificate, continuing...", "mount", mount.Path, "role", cert.Role, "common_name", cert.CommonName, "namespace", cert.Export.Namespace, "err", err)
+			}
+		}
+	}
+}
+
+func (v *vaultManager) exportCertificate(ctx context.Context, mountPath string, cert conf.Certificate, token string) error {
+	spec, err := certificateSpec(mountPath, cert)
+	if err != nil {
+		return err
+	}
+
+	exp, err := v.exporter(cert.Export.Metadata.Exporter)
+	if err != nil {
+		return err
+	}
+
+	existing, err := exp.Read(ctx, cert.Export.Namespace, cert.Export.Name)
+	if err != nil {
+		return fmt.Errorf("read exported secret: [%w]", err)
+	}
+
+	if existing != nil && existing.Annotations[annotationCertificateSpec] == spec {
+		notBefore, errBefore := time.Parse(time.RFC3339, existing.Annotations[annotationNotBefore])
+		notAfter, errAfter := time.Parse(time.RFC3339, existing.Annotations[annotationNotAfter])
+		if errBefore == nil && errAfter == nil && !certificateRenewalDue(notBefore, notAfter, cert.RenewBefore, time.Now()) {
+			return nil
+		}
+	}
+
+	request := schema.PkiIssueWithRoleRequest{
+		CommonName: cert.CommonName,
+		AltNames:   strings.Join(cert.AltNames, ","),
+		IpSans:     cert.IPSans,
+	}
+	if cert.TTL > 0 {
+		request.Ttl = fmt.Sprintf("%ds", int(cert.TTL.Seconds()))
+	}
+
+	issued, err := v.issuePkiCertificate(ctx, mountPath, cert.Role, request, token)
+	if err != nil {
+		return err
+	}
+
+	caBundle := strings.Join(issued.CaChain, "\n")
+	if caBundle == "" {
+		caBundle = issued.IssuingCa
+	}
+
+	annotations := map[string]string{
+		annotationNotBefore:       time.Now().UTC().Format(time.RFC3339),
+		annotationNotAfter:        time.Unix(issued.Expiration, 0).UTC().Format(time.RFC3339),
+		annotationCertificateSpec: spec,
+	}
+	for k, value := range cert.Export.Metadata.Annotations {
+		annotations[k] = value
+	}
+
+	err = exp.Write(ctx, exporter.Secret{
+		Namespace:   cert.Export.Namespace,
+		Name:        cert.Export.Name,
+		Type:        "kubernetes.io/tls",
+		Labels:      cert.Export.Metadata.Labels,
+		Annotations: annotations,
+		Force:       cert.Export.Metadata.Force,
+		Data: map[string][]byte{
+			"tls.crt": []byte(issued.Certificate),
+			"tls.key": []byte(issued.PrivateKey),
+			"ca.crt":  []byte(caBundle),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("write exported secret: [%w]", err)
+	}
+
+	slog.Info("certificate exported", "exporter", cert.Export.Metadata.Exporter, "common_name", cert.CommonName, "namespace", cert.Export.Namespace, "name", cert.Export.Name, "serial", issued.SerialNumber)
+	return nil
+}
+
+// certificateRenewalDue reports whether renewBefore is left until notAfter,
+// without renewBefore the last third of the lifetime is used.
+func certificateRenewalDue(notBefore time.Time, notAfter time.Time, renewBefore time.Duration, now time.Time) bool {
+	if renewBefore <= 0 {
+		renewBefore = notAfter.Sub(notBefore) / 3
+	}
+	return !now.Before(notAfter.Add(-renewBefore))
+}
+
+// certificateSpec fingerprints what is requested from vault, a change in the
+// config issues a new certificate right away.
+func certificateSpec(mountPath string, cert conf.Certificate) (string, error) {
+	raw, err := json.Marshal([]interface{}{mountPath, cert.Role, cert.CommonName, cert.AltNames, cert.IPSans, cert.TTL})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:8]), nil
+}
@@ -0,0 +1,117 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCertificateRenewalDue(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := notBefore.Add(90 * time.Hour)
+
+	assert.False(t, certificateRenewalDue(notBefore, notAfter, 0, notBefore.Add(59*time.Hour)))
+	assert.True(t, certificateRenewalDue(notBefore, notAfter, 0, notBefore.Add(60*time.Hour)))
+	assert.False(t, certificateRenewalDue(notBefore, notAfter, time.Hour, notBefore.Add(88*time.Hour)))
+	assert.True(t, certificateRenewalDue(notBefore, notAfter, time.Hour, notBefore.Add(89*time.Hour)))
+}
+
+func TestCertificatesExported(t *testing.T) {
+	var mu sync.Mutex
+	issued := []map[string]interface{}{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path != "/v1/pki/issue/web" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		req := map[string]interface{}{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		issued = append(issued, req)
+
+		expiration := time.Now().Add(90 * time.Hour).Unix()
+		fmt.Fprintf(w, `{"data":{"certificate":"cert-%d","private_key":"key-%d","issuing_ca":"ca","ca_chain":["intermediate","root"],"expiration":%d,"serial_number":"%d"}}`,
+			len(issued), len(issued), expiration, len(issued))
+	}))
+	defer srv.Close()
+
+	data := []byte(`
+provisioner:
+  mounts:
+    - type: pki
+      path: pki
+      certificates:
+        - role: web
+          common_name: web.apps.svc
+          alt_names: [web, web.apps]
+          ttl: 90h
+          export:
+            namespace: apps
+            name: web-tls
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, nil, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	getSecret := func() *corev1.Secret {
+		secret, err := k8s.Client.CoreV1().Secrets("apps").Get(ctx, "web-tls", metav1.GetOptions{})
+		assert.NoError(t, err)
+		return secret
+	}
+
+	vm.exportCertificates(ctx, "token")
+	secret := getSecret()
+	assert.Equal(t, corev1.SecretTypeTLS, secret.Type)
+	assert.Equal(t, map[string][]byte{
+		"tls.crt": []byte("cert-1"),
+		"tls.key": []byte("key-1"),
+		"ca.crt":  []byte("intermediate\nroot"),
+	}, secret.Data)
+	assert.Contains(t, secret.Annotations, annotationNotAfter)
+	assert.Equal(t, "web.apps.svc", issued[0]["common_name"])
+	assert.Equal(t, "web,web.apps", issued[0]["alt_names"])
+	assert.Equal(t, "324000s", issued[0]["ttl"])
+
+	// valid certificate, nothing is issued
+	vm.exportCertificates(ctx, "token")
+	assert.Len(t, issued, 1)
+
+	// two thirds of the lifetime elapsed
+	secret.Annotations[annotationNotBefore] = time.Now().Add(-61 * time.Hour).UTC().Format(time.RFC3339)
+	secret.Annotations[annotationNotAfter] = time.Now().Add(29 * time.Hour).UTC().Format(time.RFC3339)
+	_, err = k8s.Client.CoreV1().Secrets("apps").Update(ctx, secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	vm.exportCertificates(ctx, "token")
+	assert.Len(t, issued, 2)
+	assert.Equal(t, []byte("cert-2"), getSecret().Data["tls.crt"])
+
+	// config changes issue a new certificate
+	vm.provisioner.Mount[0].Certificates[0].AltNames = []string{"web"}
+	vm.exportCertificates(ctx, "token")
+	assert.Len(t, issued, 3)
+	assert.Equal(t, "web", issued[2]["alt_names"])
+}
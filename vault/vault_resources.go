@@ -0,0 +1,128 @@
+package vault_manager
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"vault-unlocker/conf"
+	"vault-unlocker/resources"
+
+	"k8s.io/client-go/dynamic"
+)
+
+// resourceReconciler applies custom resources one at a time, informers of
+// different kinds deliver events concurrently. mu is shared with the config
+// cycle, both rotate the same secret-ids and secrets.
+type resourceReconciler struct {
+	mu sync.Locker
+	vm *vaultManager
+}
+
+// WatchResources provisions the custom resources of cfg with the same ensure
+// functions as the config file, holding lock while applying one. It blocks
+// until ctx is done.
+func (v *vaultManager) WatchResources(ctx context.Context, client dynamic.Interface, cfg *conf.Resources, lock sync.Locker) error {
+	return resources.Watch(ctx, client, cfg, &resourceReconciler{mu: lock, vm: v})
+}
+
+// Reconcile implements resources.Reconciler. Unlike the config file cycle
+// every failure is returned, it ends up in the resource status.
+func (r *resourceReconciler) Reconcile(ctx context.Context, res resources.Resource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token, err := r.vm.rootToken()
+	if err != nil {
+		return fmt.Errorf("vault not initialized yet: [%w]", err)
+	}
+
+	scoped := *r.vm
+	scoped.provisioner = res.Provisioner
+
+	for _, policy := range res.Provisioner.Policies {
+		if err := scoped.ensurePolicy(ctx, policy.Name, policy.Rules, token); err != nil {
+			return fmt.Errorf("create policy: (%s) [%w]", policy.Name, err)
+		}
+	}
+
+	for _, auth := range res.Provisioner.Auth {
+		err := scoped.enableAuth(ctx, auth.AuthType, auth.Path, token)
+		if err != nil && !strings.Contains(err.Error(), "400 Bad") {
+			return fmt.Errorf("error enabling auth: [%w]", err)
+		}
+
+		for _, role := range auth.AppRoles {
+			if _, err := scoped.ensureAppRoleCreate(ctx, role.Name, auth.Path, role.PolicyNames, role.SecretIdTTL, token); err != nil {
+				return fmt.Errorf("create approle: (%s, %s) [%w]", auth.Path, role.Name, err)
+			}
+			if role.Export == nil {
+				continue
+			}
+			if err := scoped.exportAppRole(ctx, auth.Path, role, token); err != nil {
+				return fmt.Errorf("export approle: (%s, %s) [%w]", auth.Path, role.Name, err)
+			}
+		}
+	}
+
+	if len(res.Provisioner.Mount) == 0 {
+		return nil
+	}
+
+	for _, mount := range res.Provisioner.Mount {
+		_, err := scoped.mountKvEnginePath(ctx, mount.Path, mount.Type, token)
+		if err != nil && !strings.Contains(err.Error(), "400 Bad") {
+			return fmt.Errorf("enable kv: (%s, %s) [%w]", mount.Path, mount.Type, err)
+		}
+	}
+
+	secrets, err := sortSecretsByReference(res.Provisioner.Mount)
+	if err != nil {
+		return fmt.Errorf("secrets: [%w]", err)
+	}
+
+	for _, ms := range secrets {
+		if err := scoped.ensureSecretProvisioned(ctx, ms, token); err != nil {
+			return fmt.Errorf("provision secret: (%s) [%w]", ms.id(), err)
+		}
+	}
+
+	for _, mount := range res.Provisioner.Mount {
+		for _, secret := range mount.Secrets {
+			if secret.Export == nil {
+				continue
+			}
+			if err := scoped.exportKvSecret(ctx, mount.Path, secret, token); err != nil {
+				return fmt.Errorf("export secret: (%s, %s) [%w]", mount.Path, secret.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove implements resources.Reconciler. Exported secrets are deleted and
+// exported secret-ids revoked, the vault objects themselves are kept like
+// for entries removed from the config file.
+func (r *resourceReconciler) Remove(ctx context.Context, res resources.Resource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	records := desiredExports(r.vm.namespace, res.Provisioner)
+	if len(records) == 0 {
+		return nil
+	}
+
+	token, err := r.vm.rootToken()
+	if err != nil {
+		return fmt.Errorf("vault not initialized yet: [%w]", err)
+	}
+
+	for _, rec := range records {
+		if err := r.vm.removeExport(ctx, rec, false, token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
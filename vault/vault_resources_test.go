@@ -0,0 +1,75 @@
+package vault_manager
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"vault-unlocker/conf"
+	"vault-unlocker/exporter"
+	"vault-unlocker/resources"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResourceReconciler(t *testing.T) {
+	srv, stored := newKvStub()
+	defer srv.Close()
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	k8s := &exporter.KubernetesClient{Client: fake.NewSimpleClientset()}
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(&conf.Unlocker{}, nil, client, store, map[string]exporter.Exporter{"kubernetes": k8s})
+	assert.NoError(t, err)
+
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{
+		"mount":  "team-a.apps",
+		"path":   "web",
+		"data":   map[string]interface{}{"user": "web", "password": "*random*"},
+		"export": map[string]interface{}{},
+	}}}
+	obj.SetKind(resources.KindKVSecret)
+	obj.SetNamespace("team-a")
+	obj.SetName("db")
+
+	res, err := resources.FromUnstructured(obj)
+	assert.NoError(t, err)
+
+	reconciler := &resourceReconciler{mu: &sync.Mutex{}, vm: vm}
+	ctx := context.Background()
+
+	// no token until vault is initialized
+	assert.ErrorContains(t, reconciler.Reconcile(ctx, res), "vault not initialized yet")
+
+	store.data["keys/token"] = "token"
+	assert.NoError(t, reconciler.Reconcile(ctx, res))
+
+	password := stored["/v1/team-a.apps/web/db"]["password"]
+	assert.Len(t, password, 32)
+
+	secret, err := k8s.Read(ctx, "team-a", "db")
+	assert.NoError(t, err)
+	assert.Equal(t, password, string(secret.Data["password"]))
+
+	assert.NoError(t, reconciler.Remove(ctx, res))
+	secret, err = k8s.Read(ctx, "team-a", "db")
+	assert.NoError(t, err)
+	assert.Nil(t, secret)
+}
+
+func TestResourceReconcilerUnlockerMount(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{
+		"mount":  kvPath,
+		"export": map[string]interface{}{},
+	}}}
+	obj.SetKind(resources.KindKVSecret)
+	obj.SetNamespace("evil")
+	obj.SetName(kvKey)
+
+	// the root token and unseal keys never reach a reconcile
+	_, err := resources.FromUnstructured(obj)
+	assert.ErrorContains(t, err, "spec.mount unlocker is reserved")
+}
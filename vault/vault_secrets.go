@@ -0,0 +1,332 @@
+package vault_manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/storage"
+)
+
+const (
+	secretsTable = "secrets"
+)
+
+// mountedSecret is a configured secret together with the kv mount it lives in.
+type mountedSecret struct {
+	mount  string
+	secret conf.Secrets
+}
+
+func (m mountedSecret) id() string {
+	return path.Join(strings.Trim(m.mount, "/"), strings.Trim(m.secret.Path, "/"), m.secret.Name)
+}
+
+func (v *vaultManager) ensureSecretsProvisioned(ctx context.Context, token string) error {
+	if v.provisioner == nil {
+		return nil
+	}
+
+	secrets, err := sortSecretsByReference(v.provisioner.Mount)
+	if err != nil {
+		return fmt.Errorf("secrets: [%w]", err)
+	}
+
+	for _, ms := range secrets {
+		if err := v.ensureSecretProvisioned(ctx, ms, token); err != nil {
+			slog.Error("error when provisioning secret", "mount", ms.mount, "path", ms.secret.Path, "secret", ms.secret.Name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+func (v *vaultManager) ensureSecretProvisioned(ctx context.Context, ms mountedSecret, token string) error {
+	mountPath, secret := ms.mount, ms.secret
+
+	secretPathName, err := url.JoinPath(secret.Path, secret.Name)
+	if err != nil {
+		return fmt.Errorf("manipulating secret path: [%w]", err)
+	}
+
+	existing, err := v.readKvV2Secret(ctx, mountPath, secretPathName, token)
+	if err != nil && !strings.Contains(err.Error(), "404") {
+		return fmt.Errorf("not possible to check if secret exists: [%w]", err)
+	}
+	exists := err == nil
+
+	if exists && secret.UpdatePolicy == "create_only" {
+		slog.Info("secret already exists, continuing....", "mount", mountPath, "secret", secretPathName)
+		return nil
+	}
+
+	rotationKey := path.Join(v.namespace, ms.id())
+	rotate := !exists
+	if exists && secret.UpdatePolicy == "rotate" {
+		rotate, err = v.isRotationDue(rotationKey, secret.RotationPeriod)
+		if err != nil {
+			return err
+		}
+	}
+
+	toRender, keep := planSecretData(secret.Data, existing, secret.UpdatePolicy, rotate)
+	rendered, err := v.renderSecretData(ctx, toRender, keep, token)
+	if err != nil {
+		return fmt.Errorf("generating secret data: [%w]", err)
+	}
+
+	data := rendered
+	for k, value := range keep {
+		data[k] = value
+	}
+
+	if exists && jsonEqual(data, existing) {
+		slog.Info("secret up to date, continuing....", "mount", mountPath, "secret", secretPathName, "policy", secret.UpdatePolicy)
+		return nil
+	}
+
+	if err := v.creteOrUpdateKvV2Secret(ctx, secretPathName, mountPath, data, token); err != nil {
+		return fmt.Errorf("adding secret: [%w]", err)
+	}
+
+	if secret.UpdatePolicy == "rotate" && rotate {
+		if err := v.storage.Put(secretsTable, rotationKey, []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+			return fmt.Errorf("store rotation time: [%w]", err)
+		}
+		slog.Info("secret rotated", "mount", mountPath, "secret", secretPathName)
+	}
+
+	return nil
+}
+
+func (v *vaultManager) isRotationDue(key string, period time.Duration) (bool, error) {
+	last, err := v.storage.Get(secretsTable, key)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			return false, fmt.Errorf("retrieve rotation time: [%w]", err)
+		}
+		// secret created before the policy was set, start counting from now
+		// unless a concurrent reconcile already did
+		err := v.storage.CompareAndSwap(secretsTable, key, nil, []byte(time.Now().UTC().Format(time.RFC3339)))
+		if err != nil && !errors.Is(err, storage.ErrConflict) {
+			return false, fmt.Errorf("store rotation time: [%w]", err)
+		}
+		return false, nil
+	}
+
+	rotatedAt, err := time.Parse(time.RFC3339, string(last))
+	if err != nil {
+		return true, nil
+	}
+
+	return time.Since(rotatedAt) >= period, nil
+}
+
+// planSecretData splits the configured data into the keys that must be
+// rendered and the values already stored in vault that must be kept.
+//
+//	create_only         everything is rendered (secret does not exist yet)
+//	merge_missing_keys  only keys missing in vault are rendered, nothing removed
+//	overwrite, rotate   vault mirrors the config, generated keys are kept
+//	                    unless rotation is due
+func planSecretData(cfg map[string]interface{}, existing map[string]interface{}, policy string, rotate bool) (map[string]interface{}, map[string]interface{}) {
+	toRender := map[string]interface{}{}
+	keep := map[string]interface{}{}
+
+	if existing == nil {
+		existing = map[string]interface{}{}
+	}
+
+	if policy == "merge_missing_keys" {
+		for k, value := range existing {
+			keep[k] = value
+		}
+	}
+
+	for k, value := range cfg {
+		current, stored := existing[k]
+
+		switch {
+		case !stored:
+			toRender[k] = value
+		case policy == "merge_missing_keys":
+			// already kept
+		case hasGenerator(value) && !rotate:
+			keep[k] = current
+		default:
+			toRender[k] = value
+		}
+	}
+
+	return toRender, keep
+}
+
+func hasGenerator(value interface{}) bool {
+	switch val := value.(type) {
+	case string:
+		_, isGen, _ := conf.ParseGenerator(val)
+		return isGen
+	case map[string]interface{}:
+		for _, item := range val {
+			if hasGenerator(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range val {
+			if hasGenerator(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonEqual compares secret data regardless of how numbers were decoded.
+func jsonEqual(a map[string]interface{}, b map[string]interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+func (v *vaultManager) resolveSource(ctx context.Context, src conf.Source, cache map[string]map[string]interface{}, token string) (interface{}, error) {
+	switch src.Kind {
+	case "env":
+		value, ok := os.LookupEnv(src.Arg)
+		if !ok {
+			return nil, fmt.Errorf("environment variable not set: %s", src.Arg)
+		}
+		return value, nil
+
+	case "file":
+		content, err := os.ReadFile(src.Arg)
+		if err != nil {
+			return nil, err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+
+	case "ref":
+		data, ok := cache[src.Path]
+		if !ok {
+			mountPath, secretPath := splitSecretRef(src.Path, v.provisioner.Mount)
+			var err error
+			data, err = v.readKvV2Secret(ctx, mountPath, secretPath, token)
+			if err != nil {
+				return nil, err
+			}
+			cache[src.Path] = data
+		}
+
+		value, ok := data[src.Key]
+		if !ok {
+			return nil, fmt.Errorf("key %s not found in secret: %s", src.Key, src.Path)
+		}
+		return value, nil
+
+	default:
+		return nil, fmt.Errorf("unknown source: %s", src.Kind)
+	}
+}
+
+// splitSecretRef separates the kv mount from the secret path, the longest
+// configured mount wins and the first segment is used otherwise.
+func splitSecretRef(ref string, mounts []conf.Mount) (string, string) {
+	best := ""
+	for _, mount := range mounts {
+		m := strings.Trim(mount.Path, "/")
+		if strings.HasPrefix(ref, m+"/") && len(m) > len(best) {
+			best = m
+		}
+	}
+
+	if best == "" {
+		best, _, _ = strings.Cut(ref, "/")
+	}
+
+	return best, strings.TrimPrefix(ref, best+"/")
+}
+
+// sortSecretsByReference flattens the secrets of every mount, ordered so that
+// secrets referenced through ${ref:...} are provisioned before their readers.
+func sortSecretsByReference(mounts []conf.Mount) ([]mountedSecret, error) {
+	var secrets []mountedSecret
+	byID := map[string]mountedSecret{}
+	for _, mount := range mounts {
+		for _, secret := range mount.Secrets {
+			ms := mountedSecret{mount: mount.Path, secret: secret}
+			secrets = append(secrets, ms)
+			byID[ms.id()] = ms
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	sorted := make([]mountedSecret, 0, len(secrets))
+
+	var visit func(ms mountedSecret, chain []string) error
+	visit = func(ms mountedSecret, chain []string) error {
+		id := ms.id()
+		switch state[id] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("secret reference cycle: %s", strings.Join(append(chain, id), " -> "))
+		}
+
+		state[id] = visiting
+		for _, ref := range secretRefs(ms.secret.Data) {
+			// refs to secrets not managed here are read as they are
+			dep, ok := byID[ref]
+			if !ok || ref == id {
+				continue
+			}
+			if err := visit(dep, append(chain, id)); err != nil {
+				return err
+			}
+		}
+		state[id] = done
+		sorted = append(sorted, ms)
+		return nil
+	}
+
+	for _, ms := range secrets {
+		if err := visit(ms, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return sorted, nil
+}
+
+func secretRefs(value interface{}) []string {
+	var refs []string
+	switch val := value.(type) {
+	case string:
+		sources, _ := conf.ParseSources(val)
+		for _, src := range sources {
+			if src.Kind == "ref" {
+				refs = append(refs, src.Path)
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range val {
+			refs = append(refs, secretRefs(item)...)
+		}
+	case []interface{}:
+		for _, item := range val {
+			refs = append(refs, secretRefs(item)...)
+		}
+	}
+	return refs
+}
@@ -0,0 +1,341 @@
+package vault_manager
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"vault-unlocker/conf"
+	"vault-unlocker/storage"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSortSecretsByReference(t *testing.T) {
+	mounts := []conf.Mount{
+		{Path: "apps", Secrets: []conf.Secrets{
+			{Path: "web", Name: "db", Data: map[string]interface{}{
+				"password": "${ref:platform/postgres/admin#password}",
+				"url":      "postgres://web:${ref:platform/postgres/admin#password}@db",
+			}},
+		}},
+		{Path: "platform", Secrets: []conf.Secrets{
+			{Path: "postgres", Name: "admin", Data: map[string]interface{}{"password": "*random*"}},
+			{Path: "external", Name: "x", Data: map[string]interface{}{"k": "${ref:other/mount#k}"}},
+		}},
+	}
+
+	sorted, err := sortSecretsByReference(mounts)
+	assert.NoError(t, err)
+
+	ids := []string{}
+	for _, ms := range sorted {
+		ids = append(ids, ms.id())
+	}
+	assert.Equal(t, []string{"platform/postgres/admin", "apps/web/db", "platform/external/x"}, ids)
+
+	_, err = sortSecretsByReference([]conf.Mount{
+		{Path: "kv", Secrets: []conf.Secrets{
+			{Name: "a", Data: map[string]interface{}{"k": "${ref:kv/b#k}"}},
+			{Name: "b", Data: map[string]interface{}{"k": "${ref:kv/a#k}"}},
+		}},
+	})
+	assert.ErrorContains(t, err, "kv/a -> kv/b -> kv/a")
+}
+
+func TestSplitSecretRef(t *testing.T) {
+	mounts := []conf.Mount{{Path: "kv"}, {Path: "kv/team"}}
+
+	mount, secret := splitSecretRef("kv/team/app/db", mounts)
+	assert.Equal(t, "kv/team", mount)
+	assert.Equal(t, "app/db", secret)
+
+	mount, secret = splitSecretRef("other/app/db", mounts)
+	assert.Equal(t, "other", mount)
+	assert.Equal(t, "app/db", secret)
+}
+
+func TestSecretsProvisionedWithSources(t *testing.T) {
+	srv, stored := newKvStub()
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(file, []byte("certificate\n"), 0600))
+	t.Setenv("UNLOCKER_TEST_USER", "admin")
+
+	data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: apps
+    secrets:
+      - path: web
+        name: db
+        data:
+          user: ${env:UNLOCKER_TEST_USER}
+          password: ${ref:platform/postgres/admin#password}
+          ca: ${file:` + file + `}
+  - type: kv-v2
+    path: platform
+    secrets:
+      - path: postgres
+        name: admin
+        data:
+          password: "*random*"
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, nil, nil)
+	assert.NoError(t, err)
+
+	err = vm.ensureSecretsProvisioned(context.Background(), "token")
+	assert.NoError(t, err)
+
+	admin := stored["/v1/platform/postgres/admin"]
+	web := stored["/v1/apps/web/db"]
+	assert.Len(t, admin["password"], 32)
+	assert.Equal(t, admin["password"], web["password"])
+	assert.Equal(t, "admin", web["user"])
+	assert.Equal(t, "certificate", web["ca"])
+}
+
+func TestPlanSecretData(t *testing.T) {
+	cfg := map[string]interface{}{
+		"user":     "new",
+		"password": "*random*",
+		"hash":     "*bcrypt:password*",
+		"added":    "v",
+	}
+	existing := map[string]interface{}{
+		"user":     "old",
+		"password": "keep-me",
+		"hash":     "$2a$10$xyz",
+		"extra":    "x",
+	}
+
+	scenarios := []struct {
+		policy           string
+		rotate           bool
+		expectedToRender []string
+		expectedKeep     []string
+	}{
+		{policy: "merge_missing_keys", expectedToRender: []string{"added"}, expectedKeep: []string{"extra", "hash", "password", "user"}},
+		{policy: "overwrite", expectedToRender: []string{"added", "user"}, expectedKeep: []string{"hash", "password"}},
+		{policy: "rotate", expectedToRender: []string{"added", "user"}, expectedKeep: []string{"hash", "password"}},
+		{policy: "rotate", rotate: true, expectedToRender: []string{"added", "hash", "password", "user"}, expectedKeep: []string{}},
+	}
+
+	for _, scenario := range scenarios {
+		toRender, keep := planSecretData(cfg, existing, scenario.policy, scenario.rotate)
+		assert.ElementsMatch(t, scenario.expectedToRender, keys(toRender), scenario.policy)
+		assert.ElementsMatch(t, scenario.expectedKeep, keys(keep), scenario.policy)
+	}
+
+	// a missing hash is derived from the stored password, which is only kept
+	toRender, keep := planSecretData(cfg, map[string]interface{}{"password": "keep-me"}, "overwrite", false)
+	assert.NotContains(t, toRender, "password")
+	assert.Equal(t, "keep-me", keep["password"])
+}
+
+func TestSecretKeptVerbatim(t *testing.T) {
+	srv, stored := newKvStub()
+	defer srv.Close()
+
+	// a generated value that happens to look like a source
+	stored["/v1/apps/web/db"] = map[string]interface{}{"password": "${x}"}
+
+	data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: apps
+    secrets:
+      - path: web
+        name: db
+        update_policy: overwrite
+        data:
+          password: "*random*"
+          hash: "*bcrypt:password*"
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, &memStorage{data: map[string]string{}}, nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, vm.ensureSecretProvisioned(context.Background(), mountedSecret{mount: "apps", secret: cfg.Provisioner.Mount[0].Secrets[0]}, "token"))
+	assert.Equal(t, "${x}", stored["/v1/apps/web/db"]["password"])
+
+	hash, _ := stored["/v1/apps/web/db"]["hash"].(string)
+	assert.NoError(t, bcrypt.CompareHashAndPassword([]byte(hash), []byte("${x}")))
+}
+
+func TestSecretRotation(t *testing.T) {
+	srv, stored := newKvStub()
+	defer srv.Close()
+
+	data := []byte(`
+provisioner:
+  mounts:
+  - type: kv-v2
+    path: apps
+    secrets:
+      - path: web
+        name: db
+        update_policy: rotate
+        rotation_period: 24h
+        data:
+          user: web
+          password: "*random*"
+`)
+	cfg, err := conf.NewConfig(data)
+	assert.NoError(t, err)
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	store := &memStorage{data: map[string]string{}}
+	vm, err := NewVaultManager(cfg.Unlocker, cfg.Provisioner, client, store, nil)
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	assert.NoError(t, vm.ensureSecretsProvisioned(ctx, "token"))
+	first := stored["/v1/apps/web/db"]["password"]
+	assert.Len(t, first, 32)
+	assert.Contains(t, store.data, "secrets/apps/web/db")
+
+	// not due yet, nothing changes
+	assert.NoError(t, vm.ensureSecretsProvisioned(ctx, "token"))
+	assert.Equal(t, first, stored["/v1/apps/web/db"]["password"])
+
+	// config changes are applied without rotating
+	vm.provisioner.Mount[0].Secrets[0].Data["user"] = "web-v2"
+	assert.NoError(t, vm.ensureSecretsProvisioned(ctx, "token"))
+	assert.Equal(t, "web-v2", stored["/v1/apps/web/db"]["user"])
+	assert.Equal(t, first, stored["/v1/apps/web/db"]["password"])
+
+	store.data["secrets/apps/web/db"] = time.Now().Add(-25 * time.Hour).UTC().Format(time.RFC3339)
+	assert.NoError(t, vm.ensureSecretsProvisioned(ctx, "token"))
+	assert.NotEqual(t, first, stored["/v1/apps/web/db"]["password"])
+	assert.Equal(t, "web-v2", stored["/v1/apps/web/db"]["user"])
+}
+
+// newKvStub answers kv-v2 reads and writes from an in memory map keyed by the
+// request path without the data/ segment.
+func newKvStub() (*httptest.Server, map[string]map[string]interface{}) {
+	var mu sync.Mutex
+	stored := map[string]map[string]interface{}{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		key := strings.Replace(r.URL.Path, "/data/", "/", 1)
+		switch r.Method {
+		case http.MethodGet:
+			data, ok := stored[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = w.Write([]byte(`{"errors":[]}`))
+				return
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+		default:
+			body, _ := io.ReadAll(r.Body)
+			req := struct {
+				Data map[string]interface{} `json:"data"`
+			}{}
+			_ = json.Unmarshal(body, &req)
+			stored[key] = req.Data
+			_, _ = w.Write([]byte(`{"data":{}}`))
+		}
+	}))
+
+	return srv, stored
+}
+
+// memStorage keeps "table/key" entries in data.
+type memStorage struct {
+	data map[string]string
+}
+
+var _ storage.Storage = (*memStorage)(nil)
+
+func (m *memStorage) Get(table string, key string) ([]byte, error) {
+	value, ok := m.data[table+"/"+key]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return []byte(value), nil
+}
+
+func (m *memStorage) Put(table string, key string, value []byte) error {
+	m.data[table+"/"+key] = string(value)
+	return nil
+}
+
+func (m *memStorage) Delete(table string, key string) error {
+	delete(m.data, table+"/"+key)
+	return nil
+}
+
+func (m *memStorage) List(table string, prefix string) ([]string, error) {
+	result := []string{}
+	for k := range m.data {
+		if key, ok := strings.CutPrefix(k, table+"/"); ok && strings.HasPrefix(key, prefix) {
+			result = append(result, key)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (m *memStorage) CompareAndSwap(table string, key string, old []byte, value []byte) error {
+	current, ok := m.data[table+"/"+key]
+	if ok != (old != nil) || current != string(old) {
+		return storage.ErrConflict
+	}
+	return m.Put(table, key, value)
+}
+
+func (m *memStorage) View(fn func(tx storage.Tx) error) error {
+	return fn(m)
+}
+
+func (m *memStorage) Update(fn func(tx storage.Tx) error) error {
+	tx := &memStorage{data: maps.Clone(m.data)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	m.data = tx.data
+	return nil
+}
+
+func (m *memStorage) Close() error {
+	return nil
+}
+
+func keys(m map[string]interface{}) []string {
+	result := []string{}
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
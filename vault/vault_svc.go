@@ -2,12 +2,8 @@ package vault_manager
 
 import (
 	"context"
-	"crypto/rand"
-	"errors"
 	"fmt"
 	"log/slog"
-	randv2 "math/rand/v2"
-	"net/url"
 	"strconv"
 	"strings"
 	"vault-unlocker/conf"
@@ -26,16 +22,19 @@ type vaultManager struct {
 	accessKeysNum int
 	storage       storage.Storage
 	provisioner   *conf.Provisioner
-	k8sClient     *exporter.KubernetesClient
+	exporters     map[string]exporter.Exporter
+	// afterInitStep is called after each step of the first initialization,
+	// tests use it to simulate a crash
+	afterInitStep func(step initStep)
 }
 
-func NewVaultManager(cfg *conf.Unlocker, prov *conf.Provisioner, vClient *vaultClient, store storage.Storage, k8sClient *exporter.KubernetesClient) (*vaultManager, error) {
+func NewVaultManager(cfg *conf.Unlocker, prov *conf.Provisioner, vClient *vaultClient, store storage.Storage, exporters map[string]exporter.Exporter) (*vaultManager, error) {
 	return &vaultManager{
 		vaultClient:   vClient,
 		accessKeysNum: cfg.NumberKeys,
 		storage:       store,
 		provisioner:   prov,
-		k8sClient:     k8sClient,
+		exporters:     exporters,
 	}, nil
 }
 
@@ -46,11 +45,38 @@ func (v *vaultManager) Run(ctx context.Context) error {
 		return err
 	}
 
-	token, err := v.storage.RetrieveKey("keys", "token")
+	token, err := v.rootToken()
 	if err != nil {
 		return fmt.Errorf("get secrets error: [%w]", err)
 	}
 
+	if err := v.provision(ctx, token); err != nil {
+		return err
+	}
+
+	if dataKeys != nil {
+		err = v.creteOrUpdateKvV2Secret(ctx, kvKey, kvPath, dataKeys, token)
+		if err != nil {
+			return fmt.Errorf("add kv to secret: (%s, %s) [%w]", kvKey, kvPath, err)
+		}
+	}
+
+	v.export(ctx, token)
+
+	if err := v.ensureNamespacesProvisioned(ctx, token); err != nil {
+		return err
+	}
+
+	if len(v.exporters) > 0 {
+		if err := v.cleanupExports(ctx, token); err != nil {
+			slog.Warn("not possible to clean up exports, continuing...", "err", err)
+		}
+	}
+
+	return nil
+}
+
+func (v *vaultManager) provision(ctx context.Context, token string) error {
 	if err := v.ensurePoliciesProvisioned(ctx, token); err != nil {
 		return err
 	}
@@ -59,37 +85,51 @@ func (v *vaultManager) Run(ctx context.Context) error {
 		return err
 	}
 
-	if err := v.ensureSecretEngineMounts(ctx, token); err != nil {
+	if err := v.ensureIdentityProvisioned(ctx, token); err != nil {
 		return err
 	}
 
-	if dataKeys != nil {
-		err = v.creteOrUpdateKvV2Secret(ctx, kvKey, kvPath, dataKeys, token)
-		if err != nil {
-			return fmt.Errorf("add kv to secret: (%s, %s) [%w]", kvKey, kvPath, err)
-		}
+	return v.ensureSecretEngineMounts(ctx, token)
+}
+
+func (v *vaultManager) export(ctx context.Context, token string) {
+	if len(v.exporters) == 0 || v.provisioner == nil {
+		return
 	}
 
-	if v.k8sClient != nil {
-		for _, authMount := range v.provisioner.Auth {
+	for _, authMount := range v.provisioner.Auth {
+		switch authMount.AuthType {
+		case "approle":
 			if authMount.AppRoles == nil {
 				continue
 			}
-
-			switch authMount.AuthType {
-			case "approle":
-				err = v.exportSecretstoK8s(ctx, authMount.Path, authMount.AppRoles, token)
-				if err != nil {
-					slog.Warn("not possible to export secret to kubernetes", "error", err)
-				}
-			default:
+			err := v.exportAppRoles(ctx, authMount.Path, authMount.AppRoles, token)
+			if err != nil {
+				slog.Warn("not possible to export approles", "error", err)
+			}
+		case "userpass":
+			v.exportUsers(ctx, authMount.Path, authMount.Users)
+		default:
+			if authMount.AppRoles != nil {
 				slog.Info("auth type not supported for export, continuing...", "type", authMount.AuthType)
-				continue
 			}
 		}
 	}
 
-	return nil
+	v.exportKvSecrets(ctx, token)
+	v.exportCertificates(ctx, token)
+}
+
+// exporter returns the configured exporter, name defaults to kubernetes.
+func (v *vaultManager) exporter(name string) (exporter.Exporter, error) {
+	if name == "" {
+		name = exporter.DefaultExporter
+	}
+	exp, ok := v.exporters[name]
+	if !ok {
+		return nil, fmt.Errorf("exporter not available: %s", name)
+	}
+	return exp, nil
 }
 
 func (v *vaultManager) ensureSecretEngineMounts(ctx context.Context, token string) error {
@@ -107,8 +147,10 @@ func (v *vaultManager) ensureSecretEngineMounts(ctx context.Context, token strin
 				return fmt.Errorf("enable kv: (%s, %s) [%w]", mount.Path, mount.Type, err)
 			}
 
-			if err := v.ensureSecretsProvisioned(ctx, mount.Path, mount.Secrets, token); err != nil {
-				slog.Error("Not possible to provision all secrets, continuing ...", "err", err)
+		case "pki":
+			_, err := v.mountKvEnginePath(ctx, mount.Path, mount.Type, token)
+			if err != nil && !strings.Contains(err.Error(), "400 Bad") {
+				return fmt.Errorf("enable pki: (%s, %s) [%w]", mount.Path, mount.Type, err)
 			}
 
 		default:
@@ -117,6 +159,10 @@ func (v *vaultManager) ensureSecretEngineMounts(ctx context.Context, token strin
 
 	}
 
+	if err := v.ensureSecretsProvisioned(ctx, token); err != nil {
+		slog.Error("Not possible to provision all secrets, continuing ...", "err", err)
+	}
+
 	return nil
 }
 
@@ -171,13 +217,34 @@ func (v *vaultManager) ensurePoliciesProvisioned(ctx context.Context, token stri
 	for _, policy := range v.provisioner.Policies {
 		err := v.ensurePolicy(ctx, policy.Name, policy.Rules, token)
 		if err != nil {
-			return fmt.Errorf("create policy: (%s) [%w]", policy, err)
+			return fmt.Errorf("create policy: (%s) [%w]", policy.Name, err)
 		}
 	}
 
 	return nil
 }
 
+func (v *vaultManager) rootToken() (string, error) {
+	token, err := v.storage.Get(kvKey, "token")
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+func (v *vaultManager) storedUnsealKeys() ([]interface{}, error) {
+	var unsealKeys []interface{}
+	for i := range v.accessKeysNum {
+		res, err := v.storage.Get(kvKey, strconv.Itoa(i))
+		if err != nil {
+			return nil, fmt.Errorf("retrieve key: [%w]", err)
+		}
+		unsealKeys = append(unsealKeys, string(res))
+	}
+	slog.Info("keys retrieval", "operation", "completed")
+	return unsealKeys, nil
+}
+
 func (v *vaultManager) unlock(ctx context.Context) (map[string]interface{}, error) {
 
 	isInit, err := v.isInitialized(ctx)
@@ -185,40 +252,19 @@ func (v *vaultManager) unlock(ctx context.Context) (map[string]interface{}, erro
 		return nil, fmt.Errorf("checking if vault is initialized: [%w]", err)
 	}
 
-	var dataKeys map[string]interface{}
-	var token string
-	var unsealKeys []interface{}
+	// a crash during the first initialization left a journal behind
+	dataKeys, err := v.recoverInit(isInit)
+	if err != nil {
+		return nil, fmt.Errorf("recover initialization: [%w]", err)
+	}
 
 	if !isInit {
-		dataKeys, err = v.init(ctx, int32(v.accessKeysNum))
+		dataKeys, err = v.initialize(ctx)
 		if err != nil {
 			return nil, err
 		}
 
-		tmp, ok := dataKeys["root_token"]
-		if !ok {
-			return nil, errors.New("root_token not received")
-		}
-
-		token = tmp.(string)
-		if err := v.storage.InsertKeyValue("keys", "token", token); err != nil {
-			return nil, fmt.Errorf("not possible to insert key in boldtd: [%w]", err)
-		}
-
-		tmp, ok = dataKeys["keys"]
-		if !ok {
-			return nil, errors.New("keys not received")
-		}
-		unsealKeys = tmp.([]interface{})
-
-		for i, key := range unsealKeys {
-			err := v.storage.InsertKeyValue(kvKey, strconv.Itoa(i), key.(string))
-			if err != nil {
-				return nil, fmt.Errorf("unlock store keys: [%w]", err)
-			}
-		}
-
-		err = v.unseal(ctx, unsealKeys)
+		err = v.unseal(ctx, dataKeys["keys"].([]interface{}))
 		if err != nil {
 			return nil, fmt.Errorf("unseal: [%w]", err)
 		}
@@ -233,18 +279,12 @@ func (v *vaultManager) unlock(ctx context.Context) (map[string]interface{}, erro
 
 	if !sealed {
 		slog.Info("vault is already unsealed")
-		return nil, nil
+		return dataKeys, nil
 	}
 
-	if len(unsealKeys) == 0 {
-		for i := range v.accessKeysNum {
-			res, err := v.storage.RetrieveKey(kvKey, strconv.Itoa(i))
-			if err != nil {
-				return nil, fmt.Errorf("retrieve key: [%w]", err)
-			}
-			unsealKeys = append(unsealKeys, res)
-		}
-		slog.Info("keys retrieval", "operation", "completed")
+	unsealKeys, err := v.storedUnsealKeys()
+	if err != nil {
+		return nil, err
 	}
 
 	err = v.unseal(ctx, unsealKeys)
@@ -252,102 +292,5 @@ func (v *vaultManager) unlock(ctx context.Context) (map[string]interface{}, erro
 		return nil, fmt.Errorf("unseal: [%w]", err)
 	}
 
-	return nil, nil
-}
-
-func (v *vaultManager) ensureSecretsProvisioned(ctx context.Context, mountPath string, secrets []conf.Secrets, token string) error {
-
-	for _, secret := range secrets {
-		secretPathName, err := url.JoinPath(secret.Path, secret.Name)
-		if err != nil {
-			slog.Error("error manipulating secret path", "mount", mountPath, "path", secret.Path, "secret", secret.Name, "err", err)
-			continue
-		}
-
-		err = v.isKVSecretExistent(ctx, mountPath, secretPathName, token)
-		if err == nil {
-			slog.Info("secret already exists, continuing....", "mount", mountPath, "secret", secretPathName)
-			continue
-		}
-
-		if strings.Contains(err.Error(), "404") {
-			err = v.creteOrUpdateKvV2Secret(ctx, secretPathName, mountPath, randomize(secret.Data, 32), token)
-			if err != nil {
-				slog.Error("error when adding secret", "mount", mountPath, "path", secret.Path, "secret", secret.Name, "error", err)
-			}
-		} else {
-			slog.Info("not possible to check if secret exists", "mount", mountPath, "secret", secretPathName)
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (v *vaultManager) exportSecretstoK8s(ctx context.Context, path string, roles []conf.AppRole, token string) error {
-	for _, role := range roles {
-		if role.Export == nil || role.Export.Namespace == "" {
-			continue
-		}
-
-		roleID, err := v.getAppRoleRoleID(ctx, role.Name, path, token)
-		if err != nil {
-			slog.Warn("not possible to get roleID for approle, continuing...", "role", role.Name, "path", path, "err", err)
-			continue
-		}
-
-		slog.Info("retrieved roleID for approle", "role", role.Name, "roleID", roleID)
-
-		slog.Info("exporting approle to kubernetes", "role", role.Name)
-		secretID, err := v.generateAppRoleSecretID(ctx, role.Name, path, token)
-		if err != nil {
-			slog.Warn("not possible to generate secretID for approle, continuing...", "role", role.Name, "path", path, "err", err)
-			continue
-		}
-
-		_, err = v.k8sClient.CreateOrUpdateSecret(ctx, role.Export.Namespace, role.Name, map[string][]byte{
-			"role_id":   []byte(roleID),
-			"secret_id": []byte(secretID),
-		})
-		if err != nil {
-			slog.Warn("not possible to create or update secret in kubernetes, continuing...", "role", role.Name, "namespace", role.Export.Namespace, "err", err)
-			continue
-		}
-	}
-
-	return nil
-}
-
-func randomize(m map[string]interface{}, size int) map[string]interface{} {
-	result := make(map[string]interface{})
-	for k, v := range m {
-		if str, ok := v.(string); ok && str == "*random*" {
-			result[k] = generateRandomString(size)
-		} else if nestedMap, ok := v.(map[string]interface{}); ok {
-			result[k] = randomize(nestedMap, size)
-		} else {
-			result[k] = v
-		}
-	}
-	return result
-}
-
-// Helper function to generate a random string of specified length
-func generateRandomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
-	result := make([]byte, length)
-
-	randomBytes := make([]byte, length)
-	_, err := rand.Read(randomBytes)
-	if err != nil {
-		for i := range result {
-			result[i] = charset[randv2.IntN(len(charset))]
-		}
-		return string(result)
-	}
-
-	for i, b := range randomBytes {
-		result[i] = charset[int(b)%len(charset)]
-	}
-	return string(result)
+	return dataKeys, nil
 }
@@ -2,6 +2,12 @@ package vault_manager
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
 	"testing"
 	"vault-unlocker/conf"
 	"vault-unlocker/storage"
@@ -26,13 +32,8 @@ import (
 // }
 
 	var data = []byte(`
-manager:
-  repeat_interval: 60 # seconds
-  operation_timeout: 50 # seconds
-
 unlocker:
   number_keys: 3
-  request_timeout: 5
   url: http://localhost:8212
 
 storage:
@@ -69,7 +70,7 @@ provisioner:
       approles:
       - name: external-secret-operator
         policies:
-          - external-secret-operator-policy
+          - external-secret-operator
         secret_id_ttl: 0
         token_ttl: 3600
         token_max_ttl: 7200
@@ -98,7 +99,7 @@ func setup(data []byte) (*vaultManager, error) {
 	if err != nil {
 		return nil, err
 	}
-	store, err := storage.NewBoltDBStorage(appCfg.Storage.BoltDB)
+	store, err := storage.NewBoltDBStorage(appCfg.Storage.BoltDB, 0)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +133,7 @@ func TestRun(t *testing.T){
 // 	if err != nil {
 // 		return nil, err
 // 	}
-// 	store, err := storage.NewBoltDBStorage(appCfg.Storage.BoltDB)
+// 	store, err := storage.NewBoltDBStorage(appCfg.Storage.BoltDB, 0)
 // 	if err != nil {
 // 		return nil, err
 // 	}
@@ -325,7 +326,7 @@ func TestRun(t *testing.T){
 //       approles:
 //       - name: external-secret-operator
 //         policies:
-//           - external-secret-operator-policy
+//           - external-secret-operator
 //         secret_id_ttl: 0
 //         token_ttl: 3600
 //         token_max_ttl: 7200
@@ -467,3 +468,63 @@ func TestRun(t *testing.T){
 // 		}
 // 	})
 // }
+
+// failingStorage fails every write of key
+type failingStorage struct {
+	*memStorage
+	key string
+}
+
+func (f *failingStorage) Update(fn func(tx storage.Tx) error) error {
+	return f.memStorage.Update(func(tx storage.Tx) error {
+		return fn(&failingStorage{memStorage: tx.(*memStorage), key: f.key})
+	})
+}
+
+func (f *failingStorage) Put(table string, key string, value []byte) error {
+	if key == f.key {
+		return errors.New("disk full")
+	}
+	return f.memStorage.Put(table, key, value)
+}
+
+func TestUnlockStoresKeysTogether(t *testing.T) {
+	initialized, unsealed := false, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v1/sys/init" && r.Method == http.MethodGet:
+			fmt.Fprintf(w, `{"initialized":%t}`, initialized)
+		case r.URL.Path == "/v1/sys/init":
+			initialized = true
+			_, _ = w.Write([]byte(`{"keys":["k0","k1","k2"],"root_token":"root"}`))
+		case r.URL.Path == "/v1/sys/seal-status":
+			fmt.Fprintf(w, `{"data":{"sealed":%t}}`, unsealed < 3)
+		case r.URL.Path == "/v1/sys/unseal":
+			unsealed++
+			fmt.Fprintf(w, `{"data":{"sealed":%t}}`, unsealed < 3)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := NewVaultClient(&conf.Unlocker{Url: srv.URL})
+	assert.NoError(t, err)
+
+	store := &failingStorage{memStorage: &memStorage{data: map[string]string{}}, key: "2"}
+	vm, err := NewVaultManager(&conf.Unlocker{NumberKeys: 3}, nil, client, store, nil)
+	assert.NoError(t, err)
+
+	_, err = vm.unlock(context.Background())
+	assert.ErrorContains(t, err, "disk full")
+	assert.ElementsMatch(t, []string{"journal/init", "keys/staged-init"}, slices.Collect(maps.Keys(store.data)))
+	assert.Zero(t, unsealed)
+
+	// the staged response is committed on the next run
+	store.key = ""
+	dataKeys, err := vm.unlock(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "root", dataKeys["root_token"])
+	assert.Equal(t, map[string]string{"keys/token": "root", "keys/0": "k0", "keys/1": "k1", "keys/2": "k2"}, store.data)
+	assert.Equal(t, 3, unsealed)
+}